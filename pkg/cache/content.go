@@ -0,0 +1,549 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContentStore holds values once by their SHA256 digest, for any number of owners that reference them by key.
+// A value is removed once no owner references it. If a size limit is configured, least recently used values are
+// evicted to fit, along with every reference to them.
+//
+// Values are stored at sha256/<shard>/<digest>. Each reference is a file under refs/<owner>/, in the layout of
+// FileStorage, that holds the value's Metadata.
+type ContentStore struct {
+	Path    string
+	maxSize int64
+
+	mu sync.Mutex
+	// refs holds the paths of the references to each digest.
+	refs map[string]map[string]struct{}
+	// index accounts for the stored values, keyed by digest.
+	index *fileIndex
+}
+
+type ContentConfig struct {
+	// Path is where values are stored. Caches configured with the same path share values.
+	Path string `yaml:"path"`
+	// TTL is how long a reference is kept after it was last used. Defaults to 7 days.
+	TTL time.Duration `yaml:"ttl"`
+	// MaxSize limits the bytes of stored values. Zero is unlimited.
+	// Caches sharing a path share the limit, which is set by the first cache configured with the path.
+	MaxSize ByteSize `yaml:"maxSize"`
+}
+
+const defaultContentTTL = 7 * 24 * time.Hour
+
+func NewContentStore(cfg ContentConfig) *ContentStore {
+	s := &ContentStore{Path: cfg.Path, maxSize: int64(cfg.MaxSize), refs: map[string]map[string]struct{}{}, index: newFileIndex()}
+	if err := s.scan(); err != nil {
+		slog.Error("cache.ContentStore scan error", slog.String("path", cfg.Path), slog.String("error", err.Error()))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict()
+	return s
+}
+
+// scan indexes the references of every owner, and accounts for the stored values.
+func (s *ContentStore) scan() error {
+	err := s.walkRefs(func(p string, meta Metadata) error {
+		s.addRef(meta.SHA256, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var items []fileItem
+	err = filepath.WalkDir(filepath.Join(s.Path, "sha256"), func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		digest := d.Name()
+		if !d.Type().IsRegular() || !validDigest(digest) {
+			return nil
+		}
+		// Values can outlive their last reference if the process stopped in between:
+		if len(s.refs[digest]) == 0 {
+			if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		items = append(items, fileItem{key: Key(digest), size: info.Size(), modified: info.ModTime(), accessed: accessTime(info)})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Add the least recently used first, so each is added to the front of the list:
+	sort.Slice(items, func(i, j int) bool { return items[i].accessed.Before(items[j].accessed) })
+	for _, item := range items {
+		s.index.add(item)
+	}
+	return nil
+}
+
+// walkRefs calls fn with each reference of every owner.
+func (s *ContentStore) walkRefs(fn func(p string, meta Metadata) error) error {
+	owners, err := os.ReadDir(filepath.Join(s.Path, "refs"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, owner := range owners {
+		err := walkKeys(filepath.Join(s.Path, "refs", owner.Name()), "", func(p string, _ Key, _ fs.FileInfo) error {
+			if meta, ok := readRef(p); ok {
+				return fn(p, meta)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size returns the total size of stored values.
+func (s *ContentStore) Size(_ context.Context) (int64, error) {
+	return s.index.total(), nil
+}
+
+// Storage returns the Storage of an owner, whose keys reference values in the store.
+// References that are not used for ttl are removed by GC.
+func (s *ContentStore) Storage(owner string, ttl time.Duration) *ContentStorage {
+	if ttl == 0 {
+		ttl = defaultContentTTL
+	}
+	return &ContentStorage{
+		store: s,
+		root:  filepath.Join(s.Path, "refs", escapeName(owner)),
+		ttl:   ttl,
+	}
+}
+
+func (s *ContentStore) blobPath(digest string) string {
+	return filepath.Join(s.Path, "sha256", digest[:2], digest)
+}
+
+// link references a value from p, replacing any previous reference. The value must already be stored.
+// It must be called with s.mu held.
+func (s *ContentStore) link(p string, meta Metadata) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	prev, hadPrev := readRef(p)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(p, b, false); err != nil {
+		return err
+	}
+	s.addRef(meta.SHA256, p)
+	if hadPrev && prev.SHA256 != meta.SHA256 {
+		s.release(prev.SHA256, p)
+	}
+	return nil
+}
+
+// addRef indexes the reference at p to digest. It must be called with s.mu held.
+func (s *ContentStore) addRef(digest, p string) {
+	paths, ok := s.refs[digest]
+	if !ok {
+		paths = map[string]struct{}{}
+		s.refs[digest] = paths
+	}
+	paths[p] = struct{}{}
+}
+
+// release drops the reference at p to digest, and removes the value if it was the last.
+// It must be called with s.mu held.
+func (s *ContentStore) release(digest, p string) {
+	delete(s.refs[digest], p)
+	if len(s.refs[digest]) > 0 {
+		return
+	}
+	delete(s.refs, digest)
+	s.remove(digest)
+}
+
+// drop removes a value and every reference to it. It must be called with s.mu held.
+func (s *ContentStore) drop(digest string) {
+	for p := range s.refs[digest] {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("cache.ContentStore reference remove error", slog.String("path", p), slog.String("error", err.Error()))
+		}
+	}
+	delete(s.refs, digest)
+	s.remove(digest)
+}
+
+// remove deletes a value. It must be called with s.mu held.
+func (s *ContentStore) remove(digest string) {
+	if err := os.Remove(s.blobPath(digest)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("cache.ContentStore remove error", slog.String("digest", digest), slog.String("error", err.Error()))
+	}
+	s.index.remove(Key(digest))
+}
+
+// evict removes the least recently used values and their references, until the store fits its size limit.
+// It must be called with s.mu held.
+func (s *ContentStore) evict() {
+	if s.maxSize <= 0 {
+		return
+	}
+	victims := s.index.victims(s.maxSize, func(Namespace) int { return 0 })
+	if len(victims) == 0 {
+		return
+	}
+	for _, key := range victims {
+		s.drop(string(key))
+	}
+	slog.Debug("evicted values", slog.String("path", s.Path), slog.Int("values", len(victims)), slog.Int64("size", s.index.total()))
+}
+
+// ContentStorage is an owner's view of a ContentStore. Values never expire, since their content can't change.
+type ContentStorage struct {
+	store *ContentStore
+	root  string
+	ttl   time.Duration
+}
+
+var _ Storage = (*ContentStorage)(nil)
+
+func (c *ContentStorage) Get(ctx context.Context, key Key) ([]byte, bool) {
+	entry, ok := c.Open(ctx, key)
+	if !ok {
+		return nil, false
+	}
+	defer entry.Close()
+
+	b, err := io.ReadAll(entry)
+	if err != nil {
+		slog.Error("cache.ContentStorage.get error", slog.String("error", err.Error()))
+		return nil, false
+	}
+	return b, true
+}
+
+func (c *ContentStorage) Add(ctx context.Context, key Key, value []byte) {
+	w, err := c.Create(ctx, key, Metadata{})
+	if err != nil {
+		slog.Error("cache.ContentStorage.add create error", slog.String("error", err.Error()))
+		return
+	}
+	if _, err := w.Write(value); err != nil {
+		slog.Error("cache.ContentStorage.add write error", slog.String("error", err.Error()))
+		_ = w.Discard()
+		return
+	}
+	if err := w.Commit(); err != nil {
+		slog.Error("cache.ContentStorage.add commit error", slog.String("error", err.Error()))
+	}
+}
+
+func (c *ContentStorage) Open(_ context.Context, key Key) (*Entry, bool) {
+	ref := keyPath(c.root, key)
+	meta, ok := readRef(ref)
+	if !ok {
+		return nil, false
+	}
+	p := c.store.blobPath(meta.SHA256)
+	file, err := os.Open(p)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("cache.ContentStorage.open error", slog.String("error", err.Error()))
+		}
+		return nil, false
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		slog.Error("cache.ContentStorage.open stat error", slog.String("error", err.Error()))
+		_ = file.Close()
+		return nil, false
+	}
+
+	// References are kept while they are used:
+	if info, err := os.Stat(ref); err == nil && time.Since(info.ModTime()) > atimeResolution {
+		c.touch(ref)
+	}
+	// Persist the value's access time for the startup scan, but not on every read:
+	now := time.Now()
+	if prev, ok := c.store.index.access(Key(meta.SHA256), now); ok && now.Sub(prev) > atimeResolution {
+		if err := os.Chtimes(p, now, stat.ModTime()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("cache.ContentStorage.open chtimes error", slog.String("error", err.Error()))
+		}
+	}
+
+	// Verify the whole value before it is first served, so a corrupt value is a miss instead of a bad response:
+	version := versionOf(stat)
+	if c.store.index.isVerified(Key(meta.SHA256), version) {
+		return c.entry(file, stat, meta), true
+	}
+	if err := verifyValue(io.NewSectionReader(file, 0, stat.Size()), meta.SHA256); err != nil {
+		slog.Error("cache.ContentStorage.open verify error", slog.Any("key", key), slog.String("error", err.Error()))
+		if errors.Is(err, ErrCorrupt) {
+			if dst, ok := quarantineFile(c.store.Path, p, file); ok {
+				slog.Warn("quarantined corrupt value", slog.Any("key", key), slog.String("path", dst))
+			}
+			// Every reference to the value is now a miss:
+			c.store.mu.Lock()
+			c.store.drop(meta.SHA256)
+			c.store.mu.Unlock()
+		}
+		_ = file.Close()
+		return nil, false
+	}
+	c.store.index.markVerified(Key(meta.SHA256), version)
+	return c.entry(file, stat, meta), true
+}
+
+func (c *ContentStorage) entry(file *os.File, stat fs.FileInfo, meta Metadata) *Entry {
+	return &Entry{
+		ReadCloser: fileValue{SectionReader: io.NewSectionReader(file, 0, stat.Size()), file: file},
+		Size:       stat.Size(),
+		ModTime:    stat.ModTime(),
+		Metadata:   meta,
+	}
+}
+
+func (c *ContentStorage) Stale(ctx context.Context, key Key) (*Entry, bool) {
+	return c.Open(ctx, key)
+}
+
+func (c *ContentStorage) Touch(_ context.Context, key Key) {
+	c.touch(keyPath(c.root, key))
+}
+
+func (c *ContentStorage) touch(ref string) {
+	now := time.Now()
+	if err := os.Chtimes(ref, now, now); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("cache.ContentStorage.touch error", slog.String("error", err.Error()))
+	}
+}
+
+// Create streams a value into the store. If the store already has a value with the same digest, it is kept.
+func (c *ContentStorage) Create(_ context.Context, key Key, meta Metadata) (Writer, error) {
+	dir := filepath.Join(c.store.Path, "sha256")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &contentWriter{File: tmp, storage: c, key: key, meta: meta, digest: sha256.New()}, nil
+}
+
+// Link references a value that is already in the store from key, returning false if the store does not have it.
+func (c *ContentStorage) Link(_ context.Context, key Key, digest string) bool {
+	if !validDigest(digest) {
+		return false
+	}
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+
+	ref := keyPath(c.root, key)
+	if meta, ok := readRef(ref); ok && meta.SHA256 == digest {
+		return true
+	}
+	if _, err := os.Stat(c.store.blobPath(digest)); err != nil {
+		return false
+	}
+	if err := c.store.link(ref, Metadata{SHA256: digest}); err != nil {
+		slog.Error("cache.ContentStorage.link error", slog.String("error", err.Error()))
+		return false
+	}
+	return true
+}
+
+// NamespaceTTL is ignored, values never expire.
+func (c *ContentStorage) NamespaceTTL(Namespace, time.Duration) {}
+
+// Delete removes the reference from key, and the value if no other key references it.
+func (c *ContentStorage) Delete(_ context.Context, key Key) error {
+	c.store.mu.Lock()
+	defer c.store.mu.Unlock()
+
+	ref := keyPath(c.root, key)
+	meta, ok := readRef(ref)
+	if err := os.Remove(ref); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if ok {
+		c.store.release(meta.SHA256, ref)
+	}
+	return nil
+}
+
+func (c *ContentStorage) Keys(_ context.Context, prefix Key) ([]Key, error) {
+	var keys []Key
+	err := walkKeys(c.root, prefix, func(_ string, key Key, _ fs.FileInfo) error {
+		if strings.HasPrefix(string(key), string(prefix)) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// GC removes references that were not used within the TTL, and values that are no longer referenced.
+// It returns how many references were removed.
+func (c *ContentStorage) GC(ctx context.Context) (int, error) {
+	before := time.Now().Add(-c.ttl)
+	var unused []Key
+	err := walkKeys(c.root, "", func(_ string, key Key, info fs.FileInfo) error {
+		if info.ModTime().Before(before) {
+			unused = append(unused, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range unused {
+		if err := c.Delete(ctx, key); err != nil {
+			return i, err
+		}
+	}
+	if err := removeLeftovers(c.store.Path, before); err != nil {
+		return len(unused), err
+	}
+	return len(unused), nil
+}
+
+// RunGC calls GC periodically, until ctx is cancelled.
+func (c *ContentStorage) RunGC(ctx context.Context) {
+	ticker := time.NewTicker(defaultGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := c.GC(ctx); err != nil {
+			slog.Error("cache.ContentStorage GC error", slog.String("path", c.root), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// readRef returns the Metadata of a reference, if it exists and names a valid digest.
+func readRef(p string) (Metadata, bool) {
+	var meta Metadata
+	b, err := os.ReadFile(p)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("cache.ContentStore reference read error", slog.String("error", err.Error()))
+		}
+		return meta, false
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		slog.Error("cache.ContentStore reference decode error", slog.String("error", err.Error()))
+		return meta, false
+	}
+	return meta, validDigest(meta.SHA256)
+}
+
+// validDigest reports whether s is a SHA256 digest in lowercase hex, safe to use as a filename.
+func validDigest(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size && hex.EncodeToString(b) == s
+}
+
+// contentWriter streams to a temporary file, that is moved to its digest's path on Commit.
+type contentWriter struct {
+	*os.File
+	storage *ContentStorage
+	key     Key
+	meta    Metadata
+	digest  hash.Hash
+	written int64
+}
+
+func (w *contentWriter) Write(p []byte) (int, error) {
+	n, err := w.File.Write(p)
+	w.digest.Write(p[:n])
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *contentWriter) Commit() error {
+	if err := closeFile(w.File, false); err != nil {
+		_ = os.Remove(w.Name())
+		return err
+	}
+	digest := hex.EncodeToString(w.digest.Sum(nil))
+	if w.meta.SHA256 != "" && w.meta.SHA256 != digest {
+		_ = os.Remove(w.Name())
+		return fmt.Errorf("%w: expected %s, got %s", ErrCorrupt, w.meta.SHA256, digest)
+	}
+	w.meta.SHA256 = digest
+
+	store := w.storage.store
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	p := store.blobPath(digest)
+	if _, err := os.Stat(p); err == nil {
+		// Another key already stored this value:
+		_ = os.Remove(w.Name())
+	} else {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			_ = os.Remove(w.Name())
+			return err
+		}
+		info, err := os.Stat(w.Name())
+		if err != nil {
+			_ = os.Remove(w.Name())
+			return err
+		}
+		if err := os.Rename(w.Name(), p); err != nil {
+			_ = os.Remove(w.Name())
+			return err
+		}
+		// The value was digested as it was written:
+		now := time.Now()
+		store.index.add(fileItem{key: Key(digest), size: w.written, modified: now, accessed: now, verified: versionOf(info)})
+	}
+	if err := store.link(keyPath(w.storage.root, w.key), w.meta); err != nil {
+		return err
+	}
+	store.evict()
+	return nil
+}
+
+func (w *contentWriter) Discard() error {
+	_ = w.File.Close()
+	return os.Remove(w.Name())
+}
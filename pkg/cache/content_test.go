@@ -0,0 +1,156 @@
+package cache_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/debcache/pkg/cache"
+)
+
+func TestContentStore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	store := cache.NewContentStore(cache.ContentConfig{Path: dir})
+	debian, security := store.Storage("debian", 0), store.Storage("debian-security", 0)
+	key := cache.Namespace("pool").Key("main/f/foo.deb")
+	blob := filepath.Join(dir, "sha256", testValueSHA256[:2], testValueSHA256)
+
+	debian.Add(ctx, key, []byte("testValue"))
+	entry, ok := debian.Open(ctx, key)
+	require.True(t, ok)
+	assert.Equal(t, testValueSHA256, entry.Metadata.SHA256)
+	require.NoError(t, entry.Close())
+
+	// Another owner references the same value, without storing it again:
+	_, ok = security.Get(ctx, key)
+	assert.False(t, ok)
+	assert.True(t, security.Link(ctx, key, testValueSHA256))
+	b, ok := security.Get(ctx, key)
+	require.True(t, ok)
+	assert.Equal(t, []byte("testValue"), b)
+	other := cache.Namespace("pool").Key("main/f/other.deb")
+	security.Add(ctx, other, []byte("testValue"))
+	blobs, err := filepath.Glob(filepath.Join(dir, "sha256", "*", "*"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{blob}, blobs)
+
+	// Values are removed with their last reference, including references from before a restart:
+	require.NoError(t, debian.Delete(ctx, key))
+	security = cache.NewContentStore(cache.ContentConfig{Path: dir}).Storage("debian-security", 0)
+	require.NoError(t, security.Delete(ctx, key))
+	assert.FileExists(t, blob)
+	n, err := cache.Purge(ctx, security, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoFileExists(t, blob)
+
+	// Values can't be linked once they are gone:
+	assert.False(t, debian.Link(ctx, key, testValueSHA256))
+	assert.False(t, debian.Link(ctx, key, "../../etc/passwd"))
+}
+
+func TestContentStore_Verify(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	stor := cache.NewContentStore(cache.ContentConfig{Path: dir}).Storage("debian", 0)
+	key := cache.Namespace("pool").Key("main/f/foo.deb")
+
+	w, err := stor.Create(ctx, key, cache.Metadata{SHA256: testValueSHA256})
+	require.NoError(t, err)
+	_, err = w.Write([]byte("otherValue"))
+	require.NoError(t, err)
+	require.ErrorIs(t, w.Commit(), cache.ErrCorrupt)
+	_, ok := stor.Open(ctx, key)
+	assert.False(t, ok)
+
+	stor.Add(ctx, key, []byte("testValue"))
+	other := cache.Namespace("pool").Key("main/f/other.deb")
+	require.True(t, stor.Link(ctx, other, testValueSHA256))
+	blob := filepath.Join(dir, "sha256", testValueSHA256[:2], testValueSHA256)
+	require.NoError(t, os.WriteFile(blob, []byte("corrupted"), 0o600))
+	modified := time.Now().Add(-time.Second)
+	require.NoError(t, os.Chtimes(blob, modified, modified))
+	_, ok = stor.Get(ctx, key)
+	assert.False(t, ok)
+	assert.NoFileExists(t, blob)
+
+	// Every reference to the quarantined value is dropped:
+	keys, err := stor.Keys(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	size, err := cache.NewContentStore(cache.ContentConfig{Path: dir}).Size(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, size)
+}
+
+func TestContentStore_MaxSize(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	store := cache.NewContentStore(cache.ContentConfig{Path: dir, MaxSize: 20})
+	debian, security := store.Storage("debian", 0), store.Storage("debian-security", 0)
+	a, b, c := cache.Namespace("pool").Key("a.deb"), cache.Namespace("pool").Key("b.deb"), cache.Namespace("pool").Key("c.deb")
+	debian.Add(ctx, a, []byte("testValue"))
+	require.True(t, security.Link(ctx, a, testValueSHA256))
+	debian.Add(ctx, b, []byte("otherValue"))
+	_, ok := security.Get(ctx, a)
+	require.True(t, ok)
+
+	// The least recently used value is evicted, with every reference to it:
+	debian.Add(ctx, c, []byte("thirdValue!"))
+	size, err := store.Size(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), size)
+	keys, err := debian.Keys(ctx, "")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []cache.Key{a, c}, keys)
+	keys, err = security.Keys(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []cache.Key{a}, keys)
+
+	// Existing values are accounted for on startup, and evicted if the limit shrinks:
+	store = cache.NewContentStore(cache.ContentConfig{Path: dir, MaxSize: 11})
+	size, err = store.Size(ctx)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, size, int64(11))
+	for _, owner := range []string{"debian", "debian-security"} {
+		stor := store.Storage(owner, 0)
+		keys, err := stor.Keys(ctx, "")
+		require.NoError(t, err)
+		for _, key := range keys {
+			_, ok := stor.Get(ctx, key)
+			assert.True(t, ok, key)
+		}
+	}
+	blobs, err := filepath.Glob(filepath.Join(dir, "sha256", "*", "*"))
+	require.NoError(t, err)
+	assert.Len(t, blobs, 1)
+}
+
+func TestContentStore_GC(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	stor := cache.NewContentStore(cache.ContentConfig{Path: dir}).Storage("debian", time.Millisecond)
+	stor.Add(ctx, cache.Namespace("pool").Key("main/f/foo.deb"), []byte("testValue"))
+	time.Sleep(5 * time.Millisecond)
+
+	removed, err := stor.GC(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	keys, err := stor.Keys(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	assert.NoFileExists(t, filepath.Join(dir, "sha256", testValueSHA256[:2], testValueSHA256))
+}
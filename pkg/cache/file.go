@@ -2,25 +2,68 @@ package cache
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash"
+	"io"
 	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+// FileStorage holds values on disk. If a size limit is configured, least recently used values are evicted to fit.
 type FileStorage struct {
-	Path  string
-	ttl   time.Duration
-	nsTTL map[Namespace]time.Duration
+	Path          string
+	ttl           time.Duration
+	nsTTL         map[Namespace]time.Duration
+	maxSize       int64
+	retainExpired time.Duration
+	gcInterval    time.Duration
+	fsync         bool
+	priorities    priorities
+
+	index    *fileIndex
+	evicting sync.Mutex
 }
 
 type FileConfig struct {
 	Path string        `yaml:"path"`
 	TTL  time.Duration `yaml:"ttl"`
+
+	// MaxSize limits the bytes of stored values. Zero is unlimited.
+	MaxSize ByteSize `yaml:"maxSize"`
+	// MaxPercent limits the bytes of stored values to a percentage of the filesystem's capacity. Zero is unlimited.
+	MaxPercent float64 `yaml:"maxPercent"`
+	// RetainExpired is how long expired values are kept to be revalidated or served stale, before GC removes them.
+	// Defaults to 24h.
+	RetainExpired time.Duration `yaml:"retainExpired"`
+	// GCInterval is how often RunGC removes expired values. Defaults to 10m.
+	GCInterval time.Duration `yaml:"gcInterval"`
+	// Fsync flushes values to disk before they are stored, so they survive power loss. Writes are slower.
+	Fsync bool `yaml:"fsync"`
+	// Priorities overrides the order namespaces are evicted in, lowest first.
+	// By default pool files are evicted before indexes, and releases last.
+	Priorities map[Namespace]int `yaml:"priorities"`
 }
 
+const (
+	// metadataSuffix is appended to a value's path to store its Metadata, by earlier versions.
+	metadataSuffix = ".meta"
+
+	defaultRetainExpired = 24 * time.Hour
+	defaultGCInterval    = 10 * time.Minute
+	// atimeResolution is how often reads of a value update the file's access time.
+	atimeResolution = time.Minute
+)
+
 func NewFileStorage(cfg FileConfig) *FileStorage {
 	var ttl time.Duration
 	if cfg.TTL == 0 {
@@ -28,54 +71,414 @@ func NewFileStorage(cfg FileConfig) *FileStorage {
 	} else {
 		ttl = cfg.TTL
 	}
-	return &FileStorage{
-		Path:  cfg.Path,
-		ttl:   ttl,
-		nsTTL: map[Namespace]time.Duration{},
+	retainExpired := cfg.RetainExpired
+	if retainExpired == 0 {
+		retainExpired = defaultRetainExpired
+	}
+	gcInterval := cfg.GCInterval
+	if gcInterval == 0 {
+		gcInterval = defaultGCInterval
+	}
+
+	f := &FileStorage{
+		Path:          cfg.Path,
+		ttl:           ttl,
+		nsTTL:         map[Namespace]time.Duration{},
+		maxSize:       int64(cfg.MaxSize),
+		retainExpired: retainExpired,
+		gcInterval:    gcInterval,
+		fsync:         cfg.Fsync,
+		priorities:    newPriorities(cfg.Priorities),
+		index:         newFileIndex(),
+	}
+	if cfg.MaxPercent > 0 {
+		f.limitPercent(cfg.MaxPercent)
+	}
+	if err := f.migrate(); err != nil {
+		slog.Error("cache.FileStorage migrate error", slog.String("path", f.Path), slog.String("error", err.Error()))
+	}
+	if err := f.scan(); err != nil {
+		slog.Error("cache.FileStorage scan error", slog.String("path", f.Path), slog.String("error", err.Error()))
+	}
+	f.evict()
+	return f
+}
+
+// limitPercent lowers the size limit to a percentage of the filesystem's capacity.
+func (f *FileStorage) limitPercent(percent float64) {
+	if err := os.MkdirAll(f.Path, 0755); err != nil {
+		slog.Error("cache.FileStorage mkdir error", slog.String("error", err.Error()))
+		return
+	}
+	capacity, err := filesystemSize(f.Path)
+	if err != nil {
+		slog.Error("cache.FileStorage filesystem size error", slog.String("error", err.Error()))
+		return
+	}
+	if limit := int64(float64(capacity) * percent / 100); f.maxSize == 0 || limit < f.maxSize {
+		f.maxSize = limit
 	}
 }
 
+// scan accounts for the values already on disk.
+func (f *FileStorage) scan() error {
+	var items []fileItem
+	err := f.walk("", func(p string, key Key, info fs.FileInfo) error {
+		items = append(items, fileItem{key: key, size: valueSize(p, info), modified: info.ModTime(), accessed: accessTime(info)})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Add the least recently used first, so each is added to the front of its list:
+	sort.Slice(items, func(i, j int) bool { return items[i].accessed.Before(items[j].accessed) })
+	for _, item := range items {
+		f.index.add(item)
+	}
+	slog.Debug("scanned file cache", slog.String("path", f.Path), slog.Int("values", len(items)), slog.Int64("size", f.index.total()))
+	return nil
+}
+
 var _ Storage = (*FileStorage)(nil)
 
-func (f *FileStorage) Get(_ context.Context, key Key) ([]byte, bool) {
-	p := filepath.Join(f.Path, string(key))
+func (f *FileStorage) Get(ctx context.Context, key Key) ([]byte, bool) {
+	entry, ok := f.Open(ctx, key)
+	if !ok {
+		return nil, false
+	}
+	defer entry.Close()
+
+	b, err := io.ReadAll(entry)
+	if err != nil {
+		slog.Error("cache.FileStorage.get error", slog.String("error", err.Error()))
+		return nil, false
+	}
+	return b, true
+}
+
+func (f *FileStorage) Open(_ context.Context, key Key) (*Entry, bool) {
+	return f.open(key, true)
+}
+
+func (f *FileStorage) Stale(_ context.Context, key Key) (*Entry, bool) {
+	return f.open(key, false)
+}
+
+func (f *FileStorage) open(key Key, checkTTL bool) (*Entry, bool) {
+	p := f.path(key)
+
+	file, err := os.Open(p)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("cache.FileStorage.open error", slog.String("error", err.Error()))
+		}
+		return nil, false
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		slog.Error("cache.FileStorage.open stat error", slog.String("error", err.Error()))
+		_ = file.Close()
+		return nil, false
+	}
+
+	// Check the file's mtime and ignore if expired:
+	var expires time.Time
+	if ttl := f.namespaceTTL(key.Namespace()); ttl > 0 {
+		expires = stat.ModTime().Add(ttl)
+	}
+	if checkTTL && !expires.IsZero() && time.Now().After(expires) {
+		_ = file.Close()
+		return nil, false
+	}
 
-	ttl, ok := f.nsTTL[key.Namespace()]
+	f.accessed(key, stat)
+
+	// Values stored by earlier versions have no trailer, but may have a metadata sidecar:
+	meta, size, ok := readTrailer(file, stat.Size())
 	if !ok {
-		ttl = f.ttl
+		meta, size = readMetadata(p), stat.Size()
 	}
-	if ttl > 0 {
-		// Check the file's mtime and ignore if expired:
-		stat, err := os.Stat(p)
-		if errors.Is(err, fs.ErrNotExist) {
-			return nil, false
-		} else if err == nil && time.Since(stat.ModTime()) > ttl {
+
+	// Verify the whole value before it is first served, so a corrupt value is a miss instead of a bad response:
+	if version := versionOf(stat); meta.SHA256 != "" && !f.index.isVerified(key, version) {
+		if err := verifyValue(io.NewSectionReader(file, 0, size), meta.SHA256); err != nil {
+			slog.Error("cache.FileStorage.open verify error", slog.Any("key", key), slog.String("error", err.Error()))
+			if errors.Is(err, ErrCorrupt) {
+				f.quarantine(key, file)
+			}
+			_ = file.Close()
 			return nil, false
 		}
+		f.index.markVerified(key, version)
+	}
+
+	return &Entry{
+		ReadCloser: fileValue{SectionReader: io.NewSectionReader(file, 0, size), file: file},
+		Size:       size,
+		ModTime:    stat.ModTime(),
+		Expires:    expires,
+		Metadata:   meta,
+	}, true
+}
+
+// accessed marks a value as used. The access time is persisted for the startup scan, but not on every read.
+// If info is nil, the file is only read when the access time is persisted.
+func (f *FileStorage) accessed(key Key, info fs.FileInfo) {
+	now := time.Now()
+	if prev, ok := f.index.access(key, now); !ok || now.Sub(prev) <= atimeResolution {
+		return
+	}
+	p := f.path(key)
+	if info == nil {
+		var err error
+		if info, err = os.Stat(p); err != nil {
+			return
+		}
+	}
+	if err := os.Chtimes(p, now, info.ModTime()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("cache.FileStorage chtimes error", slog.String("error", err.Error()))
+	}
+}
+
+func (f *FileStorage) namespaceTTL(ns Namespace) time.Duration {
+	if ttl, ok := f.nsTTL[ns]; ok {
+		return ttl
+	}
+	return f.ttl
+}
+
+func (f *FileStorage) Add(ctx context.Context, key Key, value []byte) {
+	w, err := f.Create(ctx, key, Metadata{})
+	if err != nil {
+		slog.Error("FileCacheStorage.add create error", slog.String("error", err.Error()))
+		return
+	}
+	if _, err := w.Write(value); err != nil {
+		slog.Error("FileCacheStorage.add write error", slog.String("error", err.Error()))
+		_ = w.Discard()
+		return
+	}
+	if err := w.Commit(); err != nil {
+		slog.Error("FileCacheStorage.add commit error", slog.String("error", err.Error()))
 	}
+}
 
-	b, err := os.ReadFile(p)
+// stored accounts for a new value, evicting others if the storage is full.
+// The value was digested as it was written, so that version of the file is verified.
+func (f *FileStorage) stored(key Key, size int64, version fileVersion) {
+	now := time.Now()
+	f.index.add(fileItem{key: key, size: size, modified: now, accessed: now, verified: version})
+	f.evict()
+}
+
+func (f *FileStorage) Touch(_ context.Context, key Key) {
+	p := f.path(key)
+	before, err := os.Stat(p)
 	if err != nil {
 		if !errors.Is(err, fs.ErrNotExist) {
-			slog.Error("cache.FileStorage.get error", slog.String("error", err.Error()))
+			slog.Error("FileCacheStorage.touch error", slog.String("error", err.Error()))
 		}
-		return nil, false
+		return
 	}
-	return b, true
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("FileCacheStorage.touch error", slog.String("error", err.Error()))
+		}
+		return
+	}
+	after, err := os.Stat(p)
+	if err != nil {
+		return
+	}
+	f.index.touch(key, now, versionOf(before), versionOf(after))
 }
 
-func (f *FileStorage) Add(_ context.Context, key Key, value []byte) {
-	p := filepath.Join(f.Path, string(key))
+func (f *FileStorage) Create(_ context.Context, key Key, meta Metadata) (Writer, error) {
+	p := f.path(key)
 	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
-		slog.Error("FileCacheStorage.add mkdir error", slog.String("error", err.Error()))
-		return
+		return nil, err
 	}
 
-	if err := os.WriteFile(p, value, 0644); err != nil {
-		slog.Error("FileCacheStorage.add write error", slog.String("error", err.Error()))
+	// Write to a temporary file, so partial values are never visible:
+	tmp, err := os.CreateTemp(filepath.Dir(p), tempPrefix+"*")
+	if err != nil {
+		return nil, err
 	}
+	return &fileWriter{File: tmp, path: p, meta: meta, digest: sha256.New(), sync: f.fsync, stored: func(size int64, version fileVersion) {
+		f.stored(key, size, version)
+	}}, nil
 }
 
 func (f *FileStorage) NamespaceTTL(namepace Namespace, ttl time.Duration) {
 	f.nsTTL[namepace] = ttl
 }
+
+func (f *FileStorage) Delete(_ context.Context, key Key) error {
+	p := f.path(key)
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	f.index.remove(key)
+	if err := os.Remove(p + metadataSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (f *FileStorage) Keys(_ context.Context, prefix Key) ([]Key, error) {
+	var keys []Key
+	err := f.walk(prefix, func(_ string, key Key, _ fs.FileInfo) error {
+		if strings.HasPrefix(string(key), string(prefix)) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Size returns the total size of stored values.
+func (f *FileStorage) Size(_ context.Context) (int64, error) {
+	return f.index.total(), nil
+}
+
+// GC removes values that expired more than RetainExpired ago, along with old quarantined and abandoned files, then evicts values until the storage fits its size limit.
+// It returns how many values were removed.
+func (f *FileStorage) GC(ctx context.Context) (int, error) {
+	now := time.Now()
+	expired := f.index.expired(func(ns Namespace) time.Time {
+		ttl := f.namespaceTTL(ns)
+		if ttl <= 0 {
+			return time.Time{}
+		}
+		return now.Add(-ttl - f.retainExpired)
+	})
+	for i, key := range expired {
+		if err := f.Delete(ctx, key); err != nil {
+			return i, err
+		}
+	}
+	if len(expired) > 0 {
+		slog.Debug("removed expired values", slog.String("path", f.Path), slog.Int("values", len(expired)))
+	}
+	if err := removeLeftovers(f.Path, now.Add(-f.retainExpired)); err != nil {
+		return len(expired), err
+	}
+	return len(expired) + f.evict(), nil
+}
+
+// RunGC calls GC periodically, until ctx is cancelled.
+func (f *FileStorage) RunGC(ctx context.Context) {
+	ticker := time.NewTicker(f.gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := f.GC(ctx); err != nil {
+			slog.Error("cache.FileStorage GC error", slog.String("path", f.Path), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// evict removes the least recently used values of the lowest priority namespaces, until the storage fits its size limit.
+// It returns how many values were evicted.
+func (f *FileStorage) evict() int {
+	if f.maxSize <= 0 {
+		return 0
+	}
+	f.evicting.Lock()
+	defer f.evicting.Unlock()
+
+	victims := f.index.victims(f.maxSize, f.priorities.of)
+	for _, key := range victims {
+		if err := f.Delete(context.Background(), key); err != nil {
+			slog.Error("cache.FileStorage evict error", slog.Any("key", key), slog.String("error", err.Error()))
+		}
+	}
+	if len(victims) > 0 {
+		slog.Debug("evicted values", slog.String("path", f.Path), slog.Int("values", len(victims)), slog.Int64("size", f.index.total()))
+	}
+	return len(victims)
+}
+
+func readMetadata(p string) Metadata {
+	var meta Metadata
+	b, err := os.ReadFile(p + metadataSuffix)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("cache.FileStorage metadata read error", slog.String("error", err.Error()))
+		}
+		return meta
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		slog.Error("cache.FileStorage metadata decode error", slog.String("error", err.Error()))
+	}
+	return meta
+}
+
+// fileWriter streams to a temporary file, that is renamed into place on Commit.
+type fileWriter struct {
+	*os.File
+	path    string
+	meta    Metadata
+	digest  hash.Hash
+	written int64
+	sync    bool
+	// stored is called with the size of the value and the version of its file once committed.
+	stored func(size int64, version fileVersion)
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	n, err := w.File.Write(p)
+	w.digest.Write(p[:n])
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *fileWriter) Commit() error {
+	digest := hex.EncodeToString(w.digest.Sum(nil))
+	if w.meta.SHA256 != "" && w.meta.SHA256 != digest {
+		_ = w.Discard()
+		return fmt.Errorf("%w: expected %s, got %s", ErrCorrupt, w.meta.SHA256, digest)
+	}
+	w.meta.SHA256 = digest
+
+	// The metadata is written after the value, so both are replaced by a single rename:
+	if err := appendTrailer(w.File, w.meta); err != nil {
+		_ = w.Discard()
+		return err
+	}
+	if err := closeFile(w.File, w.sync); err != nil {
+		_ = os.Remove(w.Name())
+		return err
+	}
+	info, err := os.Stat(w.Name())
+	if err != nil {
+		_ = os.Remove(w.Name())
+		return err
+	}
+	if err := os.Rename(w.Name(), w.path); err != nil {
+		_ = os.Remove(w.Name())
+		return err
+	}
+	// Drop the sidecar of a value stored by an earlier version:
+	if err := os.Remove(w.path + metadataSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if w.sync {
+		if err := syncDir(filepath.Dir(w.path)); err != nil {
+			return err
+		}
+	}
+	w.stored(w.written, versionOf(info))
+	return nil
+}
+
+func (w *fileWriter) Discard() error {
+	_ = w.File.Close()
+	return os.Remove(w.Name())
+}
@@ -0,0 +1,24 @@
+//go:build !linux && !darwin
+
+package cache
+
+import (
+	"errors"
+	"io/fs"
+	"time"
+)
+
+// accessTime returns when a file was last read, falling back to when it was modified.
+func accessTime(info fs.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// inode returns the inode number of a file, or 0 if it is unknown.
+func inode(fs.FileInfo) uint64 {
+	return 0
+}
+
+// filesystemSize returns the capacity in bytes of the filesystem that contains path.
+func filesystemSize(string) (int64, error) {
+	return 0, errors.New("filesystem size is not supported on this platform")
+}
@@ -1,8 +1,16 @@
 package cache_test
 
 import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/thepwagner/debcache/pkg/cache"
 )
 
@@ -13,3 +21,307 @@ func TestFileStorage(t *testing.T) {
 		return cache.NewFileStorage(cache.FileConfig{Path: t.TempDir()})
 	})
 }
+
+func TestFileStorage_Stale(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stor := cache.NewFileStorage(cache.FileConfig{Path: t.TempDir(), TTL: 10 * time.Millisecond})
+	key := cache.Namespace("foo").Key("bar")
+	stor.Add(ctx, key, []byte("testValue"))
+	time.Sleep(20 * time.Millisecond)
+
+	_, ok := stor.Open(ctx, key)
+	assert.False(t, ok)
+	entry, ok := stor.Stale(ctx, key)
+	require.True(t, ok)
+	require.NoError(t, entry.Close())
+
+	stor.Touch(ctx, key)
+	entry, ok = stor.Open(ctx, key)
+	require.True(t, ok)
+	require.NoError(t, entry.Close())
+}
+
+func TestFileStorage_Size(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stor := cache.NewFileStorage(cache.FileConfig{Path: t.TempDir()})
+	size, err := stor.Size(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, size)
+
+	stor.Add(ctx, cache.Namespace("foo").Key("bar"), []byte("testValue"))
+	size, err = stor.Size(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(9), size)
+
+	// Missing directories are empty:
+	size, err = cache.NewFileStorage(cache.FileConfig{Path: filepath.Join(t.TempDir(), "missing")}).Size(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, size)
+}
+
+func TestFileStorage_MaxSize(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	stor := cache.NewFileStorage(cache.FileConfig{Path: dir, MaxSize: 30})
+	release := cache.Namespace("releases").Key("bookworm")
+	a, b, c := cache.Namespace("pool").Key("a.deb"), cache.Namespace("pool").Key("b.deb"), cache.Namespace("pool").Key("c.deb")
+	for _, key := range []cache.Key{release, a, b} {
+		stor.Add(ctx, key, []byte("testValue"))
+	}
+	entry, ok := stor.Open(ctx, a)
+	require.True(t, ok)
+	require.NoError(t, entry.Close())
+
+	// The least recently used package is evicted before indexes:
+	stor.Add(ctx, c, []byte("testValue"))
+	keys, err := stor.Keys(ctx, "")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []cache.Key{release, a, c}, keys)
+	size, err := stor.Size(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(27), size)
+
+	// Existing values are accounted for on startup:
+	stor = cache.NewFileStorage(cache.FileConfig{Path: dir, MaxSize: 30})
+	size, err = stor.Size(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(27), size)
+
+	// And evicted if the limit shrinks:
+	stor = cache.NewFileStorage(cache.FileConfig{Path: dir, MaxSize: 10})
+	keys, err = stor.Keys(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []cache.Key{release}, keys)
+}
+
+func TestFileStorage_GC(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stor := cache.NewFileStorage(cache.FileConfig{Path: t.TempDir(), TTL: 10 * time.Millisecond, RetainExpired: 10 * time.Millisecond})
+	expired, fresh := cache.Namespace("foo").Key("expired"), cache.Namespace("foo").Key("fresh")
+	stor.Add(ctx, expired, []byte("testValue"))
+	time.Sleep(30 * time.Millisecond)
+	stor.Add(ctx, fresh, []byte("testValue"))
+
+	removed, err := stor.GC(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	keys, err := stor.Keys(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []cache.Key{fresh}, keys)
+	size, err := stor.Size(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(9), size)
+}
+
+func TestFileStorage_Corrupt(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	stor := cache.NewFileStorage(cache.FileConfig{Path: dir, Fsync: true})
+	key := cache.Namespace("foo").Key("bar")
+	stor.Add(ctx, key, []byte("testValue"))
+	b, ok := stor.Get(ctx, key)
+	require.True(t, ok)
+	assert.Equal(t, []byte("testValue"), b)
+
+	// Corruption is detected before the value is served, and quarantined:
+	paths, err := filepath.Glob(filepath.Join(dir, "foo", "*", "bar"))
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+	stored, err := os.ReadFile(paths[0])
+	require.NoError(t, err)
+	stored[0] = 'b'
+	require.NoError(t, os.WriteFile(paths[0], stored, 0o600))
+	// Modification times can be coarser than the test, the file must look changed:
+	modified := time.Now().Add(-time.Second)
+	require.NoError(t, os.Chtimes(paths[0], modified, modified))
+	_, ok = stor.Open(ctx, key)
+	assert.False(t, ok)
+	keys, err := stor.Keys(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	quarantined, err := os.ReadDir(filepath.Join(dir, ".quarantine"))
+	require.NoError(t, err)
+	assert.Len(t, quarantined, 1)
+
+	// Values are seekable, without their metadata:
+	stor.Add(ctx, key, []byte("testValue"))
+	entry, ok := stor.Open(ctx, key)
+	require.True(t, ok)
+	defer entry.Close()
+	assert.Equal(t, int64(9), entry.Size)
+	seeker, ok := entry.ReadCloser.(io.ReadSeeker)
+	require.True(t, ok)
+	_, err = seeker.Seek(4, io.SeekStart)
+	require.NoError(t, err)
+	b, err = io.ReadAll(seeker)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("Value"), b)
+	end, err := seeker.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	assert.Equal(t, int64(9), end)
+}
+
+func TestFileStorage_VerifiedOnce(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	stor := cache.NewFileStorage(cache.FileConfig{Path: dir})
+	key := cache.Namespace("foo").Key("bar")
+	stor.Add(ctx, key, []byte("testValue"))
+	paths, err := filepath.Glob(filepath.Join(dir, "foo", "*", "bar"))
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+	info, err := os.Stat(paths[0])
+	require.NoError(t, err)
+
+	// A file is not verified again while it is unchanged, so changes that keep its size and time go unnoticed:
+	stored, err := os.ReadFile(paths[0])
+	require.NoError(t, err)
+	stored[0] = 'b'
+	require.NoError(t, os.WriteFile(paths[0], stored, 0o600))
+	require.NoError(t, os.Chtimes(paths[0], info.ModTime(), info.ModTime()))
+	b, ok := stor.Get(ctx, key)
+	require.True(t, ok)
+	assert.Equal(t, []byte("bestValue"), b)
+	stor.Touch(ctx, key)
+	_, ok = stor.Get(ctx, key)
+	assert.True(t, ok)
+
+	// Until the file is verified again after a restart:
+	_, ok = cache.NewFileStorage(cache.FileConfig{Path: dir}).Get(ctx, key)
+	assert.False(t, ok)
+}
+
+func TestFileStorage_ConcurrentOverwrite(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	stor := cache.NewFileStorage(cache.FileConfig{Path: dir})
+	key := cache.Namespace("releases").Key("bookworm")
+	values := [][]byte{[]byte("first value"), []byte("second, longer value")}
+	stor.Add(ctx, key, values[0])
+
+	// Readers see either value while it is replaced, never a mix of a value and the other's digest:
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				b, ok := stor.Get(ctx, key)
+				if assert.True(t, ok) {
+					assert.Contains(t, values, b)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		stor.Add(ctx, key, values[i%2])
+	}
+	close(done)
+	wg.Wait()
+	assert.NoDirExists(t, filepath.Join(dir, ".quarantine"))
+}
+
+func TestFileStorage_GCLeftovers(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	stor := cache.NewFileStorage(cache.FileConfig{Path: dir, RetainExpired: time.Millisecond})
+	abandoned := filepath.Join(dir, ".tmp-abandoned")
+	require.NoError(t, os.WriteFile(abandoned, []byte("partial"), 0o600))
+	time.Sleep(5 * time.Millisecond)
+
+	_, err := stor.GC(ctx)
+	require.NoError(t, err)
+	assert.NoFileExists(t, abandoned)
+}
+
+func TestFileStorage_Layout(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	stor := cache.NewFileStorage(cache.FileConfig{Path: dir})
+	keys := []cache.Key{
+		cache.Namespace("pool").Key("main/f/foo/foo_1.0_amd64.deb"),
+		cache.Namespace("pool").Key("../../../etc/passwd"),
+		cache.Namespace("packages").Key("bookworm", "main", "amd64", ""),
+		cache.Namespace("by-hash").Key(".."),
+		cache.Namespace("pool").Key(""),
+		cache.Namespace("pool").Key("%"),
+		cache.Namespace("releases").Key("bookworm.meta"),
+		cache.Namespace("releases").Key("bookworm"),
+		cache.Key("no namespace"),
+		cache.Key(":::empty namespace"),
+	}
+	for _, key := range keys {
+		stor.Add(ctx, key, []byte(key))
+	}
+	for _, key := range keys {
+		b, ok := stor.Get(ctx, key)
+		require.True(t, ok, key)
+		assert.Equal(t, []byte(key), b)
+	}
+	stored, err := stor.Keys(ctx, "")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, keys, stored)
+
+	// Values are contained in the storage's directory, grouped by namespace:
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var namespaces []string
+	for _, e := range entries {
+		namespaces = append(namespaces, e.Name())
+	}
+	assert.ElementsMatch(t, []string{"%", "by-hash", "packages", "pool", "releases"}, namespaces)
+	_, err = os.Stat(filepath.Join(filepath.Dir(dir), "etc"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFileStorage_Migrate(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	// Values stored at their raw key, by earlier versions:
+	release, pool := cache.Namespace("releases").Key("bookworm"), cache.Namespace("pool").Key("main/f/foo.deb")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "releases:::bookworm"), []byte("release"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "releases:::bookworm.meta"), []byte(`{"etag":"\"abc\""}`), 0o600))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "pool:::main", "f"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pool:::main", "f", "foo.deb"), []byte("foo"), 0o600))
+
+	stor := cache.NewFileStorage(cache.FileConfig{Path: dir})
+	entry, ok := stor.Open(ctx, release)
+	require.True(t, ok)
+	assert.Equal(t, `"abc"`, entry.Metadata.ETag)
+	require.NoError(t, entry.Close())
+	b, ok := stor.Get(ctx, pool)
+	require.True(t, ok)
+	assert.Equal(t, []byte("foo"), b)
+
+	keys, err := stor.Keys(ctx, "")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []cache.Key{release, pool}, keys)
+	assert.NoFileExists(t, filepath.Join(dir, "releases:::bookworm"))
+	assert.NoDirExists(t, filepath.Join(dir, "pool:::main"))
+}
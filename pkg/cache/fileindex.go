@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultPriorities keeps indexes over package files, which are larger and cheaper to fetch again.
+// Namespaces with lower priority are evicted first.
+var defaultPriorities = map[Namespace]int{
+	"pool":         0,
+	"source-pool":  0,
+	"contents":     1,
+	"translations": 1,
+	"sources":      1,
+	"by-hash":      2,
+	"packages":     2,
+	"releases":     3,
+}
+
+// defaultPriority is the priority of namespaces that are not configured.
+const defaultPriority = 1
+
+// priorities is the order namespaces are evicted in, lowest first.
+type priorities map[Namespace]int
+
+// newPriorities returns the default priorities, with overrides applied.
+func newPriorities(overrides map[Namespace]int) priorities {
+	p := make(priorities, len(defaultPriorities)+len(overrides))
+	for ns, priority := range defaultPriorities {
+		p[ns] = priority
+	}
+	for ns, priority := range overrides {
+		p[ns] = priority
+	}
+	return p
+}
+
+func (p priorities) of(ns Namespace) int {
+	if priority, ok := p[ns]; ok {
+		return priority
+	}
+	return defaultPriority
+}
+
+// fileIndex accounts for the values in a FileStorage or ContentStore, with a least-recently-used list per namespace.
+type fileIndex struct {
+	mu       sync.Mutex
+	size     int64
+	elements map[Key]*list.Element
+	// lists hold *fileItem, most recently used first.
+	lists map[Namespace]*list.List
+}
+
+type fileItem struct {
+	key  Key
+	size int64
+	// modified is when the value was stored, accessed is when it was last read.
+	modified time.Time
+	accessed time.Time
+	// verified is the version of the file whose value was last checked against its digest.
+	verified fileVersion
+}
+
+func newFileIndex() *fileIndex {
+	return &fileIndex{
+		elements: map[Key]*list.Element{},
+		lists:    map[Namespace]*list.List{},
+	}
+}
+
+// add records a stored value, replacing any previous value for the key.
+func (i *fileIndex) add(item fileItem) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.removeLocked(item.key)
+
+	l, ok := i.lists[item.key.Namespace()]
+	if !ok {
+		l = list.New()
+		i.lists[item.key.Namespace()] = l
+	}
+	// Scanned values are not added in order of use:
+	e := l.Front()
+	for e != nil && e.Value.(*fileItem).accessed.After(item.accessed) {
+		e = e.Next()
+	}
+	if e == nil {
+		i.elements[item.key] = l.PushBack(&item)
+	} else {
+		i.elements[item.key] = l.InsertBefore(&item, e)
+	}
+	i.size += item.size
+}
+
+// access marks key as used, returning when it was previously used.
+func (i *fileIndex) access(key Key, now time.Time) (time.Time, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	e, ok := i.elements[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	item := e.Value.(*fileItem)
+	prev := item.accessed
+	item.accessed = now
+	i.lists[key.Namespace()].MoveToFront(e)
+	return prev, true
+}
+
+// touch resets when key was stored. If the file was verified before it was touched, it stays verified.
+func (i *fileIndex) touch(key Key, now time.Time, before, after fileVersion) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if e, ok := i.elements[key]; ok {
+		item := e.Value.(*fileItem)
+		item.modified = now
+		if item.verified.equal(before) {
+			item.verified = after
+		}
+	}
+}
+
+// isVerified reports whether the value of key was verified in this version of its file.
+func (i *fileIndex) isVerified(key Key, version fileVersion) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	e, ok := i.elements[key]
+	return ok && e.Value.(*fileItem).verified.equal(version)
+}
+
+// markVerified records that the value of key was verified in this version of its file.
+func (i *fileIndex) markVerified(key Key, version fileVersion) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if e, ok := i.elements[key]; ok {
+		e.Value.(*fileItem).verified = version
+	}
+}
+
+func (i *fileIndex) remove(key Key) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.removeLocked(key)
+}
+
+func (i *fileIndex) removeLocked(key Key) {
+	e, ok := i.elements[key]
+	if !ok {
+		return
+	}
+	ns := key.Namespace()
+	i.lists[ns].Remove(e)
+	if i.lists[ns].Len() == 0 {
+		delete(i.lists, ns)
+	}
+	delete(i.elements, key)
+	i.size -= e.Value.(*fileItem).size
+}
+
+func (i *fileIndex) total() int64 {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.size
+}
+
+// expired returns the keys that were stored before the deadline returned for their namespace.
+func (i *fileIndex) expired(deadline func(Namespace) time.Time) []Key {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var keys []Key
+	for ns, l := range i.lists {
+		before := deadline(ns)
+		if before.IsZero() {
+			continue
+		}
+		for e := l.Front(); e != nil; e = e.Next() {
+			if item := e.Value.(*fileItem); item.modified.Before(before) {
+				keys = append(keys, item.key)
+			}
+		}
+	}
+	return keys
+}
+
+// victims returns the keys to evict so the total size fits in limit.
+// The least recently used values of the lowest priority namespace are evicted first.
+func (i *fileIndex) victims(limit int64, priority func(Namespace) int) []Key {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	excess := i.size - limit
+	if excess <= 0 {
+		return nil
+	}
+
+	namespaces := make([]Namespace, 0, len(i.lists))
+	for ns := range i.lists {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Slice(namespaces, func(a, b int) bool {
+		pa, pb := priority(namespaces[a]), priority(namespaces[b])
+		if pa != pb {
+			return pa < pb
+		}
+		return namespaces[a] < namespaces[b]
+	})
+
+	var keys []Key
+	for _, ns := range namespaces {
+		for e := i.lists[ns].Back(); e != nil && excess > 0; e = e.Prev() {
+			item := e.Value.(*fileItem)
+			keys = append(keys, item.key)
+			excess -= item.size
+		}
+		if excess <= 0 {
+			break
+		}
+	}
+	return keys
+}
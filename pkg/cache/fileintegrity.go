@@ -0,0 +1,249 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrCorrupt is returned when a value does not match its SHA256 digest.
+var ErrCorrupt = errors.New("value does not match its digest")
+
+const (
+	// quarantineDir holds corrupted values, for inspection until GC removes them.
+	quarantineDir = ".quarantine"
+	// tempPrefix marks files that are still being written.
+	tempPrefix = ".tmp-"
+)
+
+// Values are stored with their Metadata in a trailer, so a value and its digest are replaced by a single rename:
+//
+//	<value> <metadata JSON> <length of the JSON, 4 bytes big endian> <metadataMagic>
+//
+// Earlier versions stored Metadata in a sidecar file at the value's path with metadataSuffix, which is still read for
+// values without a trailer.
+const (
+	metadataMagic = "debcache-meta-v1"
+	trailerSize   = 4 + len(metadataMagic)
+	// maxMetadataSize limits the JSON read from a trailer.
+	maxMetadataSize = 1 << 20
+)
+
+// appendTrailer appends meta to a value being written.
+func appendTrailer(w io.Writer, meta Metadata) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(len(b)))
+	b = append(b, metadataMagic...)
+	_, err = w.Write(b)
+	return err
+}
+
+// readTrailer returns the Metadata stored after a value and the size of the value, if the file has a trailer.
+func readTrailer(file io.ReaderAt, size int64) (Metadata, int64, bool) {
+	var meta Metadata
+	valueSize, ok := trailerValueSize(file, size)
+	if !ok {
+		return meta, 0, false
+	}
+	b := make([]byte, size-int64(trailerSize)-valueSize)
+	if _, err := file.ReadAt(b, valueSize); err != nil {
+		return meta, 0, false
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		slog.Error("cache.FileStorage metadata decode error", slog.String("error", err.Error()))
+		return meta, 0, false
+	}
+	return meta, valueSize, true
+}
+
+// trailerValueSize returns the size of the value before a file's trailer, if it has one.
+func trailerValueSize(file io.ReaderAt, size int64) (int64, bool) {
+	if size < int64(trailerSize) {
+		return 0, false
+	}
+	footer := make([]byte, trailerSize)
+	if _, err := file.ReadAt(footer, size-int64(trailerSize)); err != nil || string(footer[4:]) != metadataMagic {
+		return 0, false
+	}
+	n := int64(binary.BigEndian.Uint32(footer))
+	valueSize := size - int64(trailerSize) - n
+	if n > maxMetadataSize || valueSize < 0 {
+		return 0, false
+	}
+	return valueSize, true
+}
+
+// valueSize returns the size of the value stored at p, without its trailer.
+func valueSize(p string, info fs.FileInfo) int64 {
+	file, err := os.Open(p)
+	if err != nil {
+		return info.Size()
+	}
+	defer file.Close()
+	if size, ok := trailerValueSize(file, info.Size()); ok {
+		return size
+	}
+	return info.Size()
+}
+
+// verifyValue checks that a stored value has the expected digest, before it is served.
+func verifyValue(r io.Reader, expected string) error {
+	digest := sha256.New()
+	if _, err := io.Copy(digest, r); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(digest.Sum(nil)); actual != expected {
+		return fmt.Errorf("%w: expected %s, got %s", ErrCorrupt, expected, actual)
+	}
+	return nil
+}
+
+// fileVersion identifies the contents of a file, so a verified value is not verified again until it changes.
+type fileVersion struct {
+	inode   uint64
+	size    int64
+	modTime time.Time
+}
+
+func versionOf(info fs.FileInfo) fileVersion {
+	return fileVersion{inode: inode(info), size: info.Size(), modTime: info.ModTime()}
+}
+
+func (v fileVersion) equal(o fileVersion) bool {
+	return v.inode == o.inode && v.size == o.size && v.modTime.Equal(o.modTime)
+}
+
+// fileValue reads a value from a file, without the trailer that follows it.
+type fileValue struct {
+	*io.SectionReader
+	file *os.File
+}
+
+var _ io.ReadSeekCloser = fileValue{}
+
+func (v fileValue) Close() error { return v.file.Close() }
+
+// quarantine moves a corrupted value aside, unless it was replaced since file was opened.
+func (f *FileStorage) quarantine(key Key, file *os.File) {
+	p := f.path(key)
+	dst, ok := quarantineFile(f.Path, p, file)
+	if !ok {
+		return
+	}
+	_ = os.Rename(p+metadataSuffix, dst+metadataSuffix)
+	f.index.remove(key)
+	slog.Warn("quarantined corrupt value", slog.Any("key", key), slog.String("path", dst))
+}
+
+// quarantineFile moves p to the quarantine directory under root if it is still the opened file, returning where it was moved.
+func quarantineFile(root, p string, file *os.File) (string, bool) {
+	opened, err := file.Stat()
+	if err != nil {
+		return "", false
+	}
+	current, err := os.Stat(p)
+	if err != nil || !os.SameFile(opened, current) {
+		return "", false
+	}
+
+	dir := filepath.Join(root, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		slog.Error("cache quarantine mkdir error", slog.String("error", err.Error()))
+		return "", false
+	}
+	dst := filepath.Join(dir, fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(p)))
+	if err := os.Rename(p, dst); err != nil {
+		slog.Error("cache quarantine error", slog.String("error", err.Error()))
+		return "", false
+	}
+	return dst, true
+}
+
+// removeLeftovers removes quarantined values and abandoned temporary files under root that are older than before.
+func removeLeftovers(root string, before time.Time) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		quarantined := filepath.Base(filepath.Dir(p)) == quarantineDir
+		if !quarantined && !strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.ModTime().Before(before) {
+			if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writeFileAtomic replaces a file with data, so readers see either the old or the new content.
+func writeFileAtomic(p string, data []byte, sync bool) error {
+	tmp, err := os.CreateTemp(filepath.Dir(p), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := closeFile(tmp, sync); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// closeFile closes a temporary file, after flushing it to disk if sync is set, and makes it readable.
+func closeFile(file *os.File, sync bool) error {
+	if sync {
+		if err := file.Sync(); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(file.Name(), 0644)
+}
+
+// syncDir flushes a directory to disk, so files renamed into it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
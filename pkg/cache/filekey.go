@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Values are stored at <namespace>/<shard>/<name>:
+//   - namespace is the key's escaped Namespace, or noNamespaceDir for keys without one.
+//   - shard is the first byte of the key's SHA256 digest in hex, so no directory grows too large.
+//   - name is the rest of the key, escaped so it is a single path segment.
+//
+// Escaping keeps letters, digits and "-_.+~", and encodes other bytes as %XX.
+// A leading "." is encoded, so names never collide with "..", temporary files or the quarantine.
+// A trailing metadataSuffix is encoded, so names never collide with metadata sidecars.
+// An empty name is stored as emptyName, so it never collides with its shard's directory.
+
+const (
+	// noNamespaceDir holds keys without a namespace. Escaping never produces a lone "%".
+	noNamespaceDir = "%"
+	// emptyName is the escaped empty name.
+	emptyName = "%"
+)
+
+func (f *FileStorage) path(key Key) string {
+	return keyPath(f.Path, key)
+}
+
+// keyPath returns where key is stored, in the layout described above under root.
+func keyPath(root string, key Key) string {
+	ns, name, ok := strings.Cut(string(key), ":::")
+	dir := escapeName(ns)
+	if !ok || ns == "" {
+		dir, name = noNamespaceDir, string(key)
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(root, dir, hex.EncodeToString(sum[:1]), escapeName(name))
+}
+
+// pathKey returns the key stored at a path relative to f.Path.
+func pathKey(rel string) (Key, bool) {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) != 3 || len(parts[1]) != 2 {
+		return "", false
+	}
+	name, err := unescapeName(parts[2])
+	if err != nil {
+		return "", false
+	}
+	if parts[0] == noNamespaceDir {
+		return Key(name), true
+	}
+	ns, err := unescapeName(parts[0])
+	if err != nil || ns == "" {
+		return "", false
+	}
+	return Namespace(ns).Key(name), true
+}
+
+func escapeName(s string) string {
+	if s == "" {
+		return emptyName
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if unreserved(c) && (c != '.' || i > 0) {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	escaped := sb.String()
+	if strings.HasSuffix(escaped, metadataSuffix) {
+		escaped = strings.TrimSuffix(escaped, metadataSuffix) + "%2E" + metadataSuffix[1:]
+	}
+	return escaped
+}
+
+func unescapeName(s string) (string, error) {
+	if s == emptyName {
+		return "", nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		b, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		sb.WriteByte(b[0])
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+func unreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-_.+~", c) >= 0
+}
+
+// walk calls fn for each value on disk with a key that might start with prefix.
+func (f *FileStorage) walk(prefix Key, fn func(p string, key Key, info fs.FileInfo) error) error {
+	return walkKeys(f.Path, prefix, fn)
+}
+
+// walkKeys calls fn for each file stored under root by keyPath, with a key that might start with prefix.
+func walkKeys(root string, prefix Key, fn func(p string, key Key, info fs.FileInfo) error) error {
+	dir := root
+	if ns, _, ok := strings.Cut(string(prefix), ":::"); ok && ns != "" {
+		dir = filepath.Join(root, escapeName(ns))
+	}
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// Skip metadata sidecars, quarantined values and values that are still being written:
+		name := d.Name()
+		if d.IsDir() && name == quarantineDir {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(name, metadataSuffix) || strings.HasPrefix(name, tempPrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		key, ok := pathKey(rel)
+		if !ok {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return fn(p, key, info)
+	})
+}
+
+// migrate moves values stored by earlier versions, at the raw key joined to f.Path, to their escaped path.
+// Every namespaced key started a top level directory or file containing ":::", which escaped namespaces never contain.
+func (f *FileStorage) migrate() error {
+	entries, err := os.ReadDir(f.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var migrated int
+	for _, entry := range entries {
+		if !strings.Contains(entry.Name(), ":::") {
+			continue
+		}
+		old := filepath.Join(f.Path, entry.Name())
+		err := filepath.WalkDir(old, func(p string, d fs.DirEntry, err error) error {
+			// Sidecars are moved with their value:
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			name := d.Name()
+			if !d.Type().IsRegular() || strings.HasSuffix(name, metadataSuffix) || strings.HasPrefix(name, tempPrefix) {
+				return nil
+			}
+			rel, err := filepath.Rel(f.Path, p)
+			if err != nil {
+				return err
+			}
+
+			dst := f.path(Key(filepath.ToSlash(rel)))
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(p, dst); err != nil {
+				return err
+			}
+			if err := os.Rename(p+metadataSuffix, dst+metadataSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			migrated++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Only leftovers, like abandoned temporary files, remain:
+		if err := os.RemoveAll(old); err != nil {
+			return err
+		}
+	}
+	if migrated > 0 {
+		slog.Info("migrated file cache layout", slog.String("path", f.Path), slog.Int("values", migrated))
+	}
+	return nil
+}
@@ -1,64 +1,268 @@
 package cache
 
 import (
+	"bytes"
 	"context"
+	"log/slog"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/golang-lru/v2/expirable"
 )
 
+// LRUStorage holds values in memory. Expired values are evicted, so Stale never returns an expired value.
+// If byte limits are configured, least recently used values are evicted to fit.
 type LRUStorage struct {
-	size       int
-	defaultTTL time.Duration
+	size              int
+	defaultTTL        time.Duration
+	maxBytes          int64
+	namespaceMaxBytes map[Namespace]int64
+	maxItemSize       int64
+	priorities        priorities
 
 	mu   sync.RWMutex
-	data map[Namespace]*expirable.LRU[Key, []byte]
+	data map[Namespace]*lruNamespace
+	// used is the total size of values in memory.
+	used atomic.Int64
+	// writing serializes changes to values, so replaced values are accounted for once.
+	writing sync.Mutex
 }
+
 type LRUConfig struct {
-	// Size is the number of entries to store in the cache
+	// Size limits the number of entries stored per namespace. Zero is unlimited if byte limits are configured, otherwise 100.
 	Size int
 	TTL  time.Duration `yaml:"ttl"`
+
+	// MaxBytes limits the bytes of stored values. Zero is unlimited.
+	MaxBytes ByteSize `yaml:"maxBytes"`
+	// NamespaceMaxBytes limits the bytes of stored values in a namespace (e.g. "pool").
+	NamespaceMaxBytes map[Namespace]ByteSize `yaml:"namespaceMaxBytes"`
+	// MaxItemSize is the size of the largest value stored. Larger values are served without being cached.
+	MaxItemSize ByteSize `yaml:"maxItemSize"`
+	// Priorities overrides the order namespaces are evicted in to fit MaxBytes, lowest first.
+	// By default pool files are evicted before indexes, and releases last.
+	Priorities map[Namespace]int `yaml:"priorities"`
+}
+
+// lruNamespace holds the values of a namespace, accounting for their size.
+type lruNamespace struct {
+	*expirable.LRU[Key, lruEntry]
+	ttl  time.Duration
+	used atomic.Int64
+}
+
+type lruEntry struct {
+	value   []byte
+	meta    Metadata
+	modTime time.Time
 }
 
 func NewLRUStorage(cfg LRUConfig) *LRUStorage {
 	size := cfg.Size
-	if size == 0 {
+	if size == 0 && cfg.MaxBytes == 0 && len(cfg.NamespaceMaxBytes) == 0 {
 		size = 100
 	}
 	ttl := cfg.TTL
 	if ttl == 0 {
 		ttl = time.Hour
 	}
+	namespaceMaxBytes := make(map[Namespace]int64, len(cfg.NamespaceMaxBytes))
+	for ns, limit := range cfg.NamespaceMaxBytes {
+		namespaceMaxBytes[ns] = int64(limit)
+	}
 	return &LRUStorage{
-		size:       size,
-		defaultTTL: ttl,
-		data:       map[Namespace]*expirable.LRU[Key, []byte]{},
+		size:              size,
+		defaultTTL:        ttl,
+		maxBytes:          int64(cfg.MaxBytes),
+		namespaceMaxBytes: namespaceMaxBytes,
+		maxItemSize:       int64(cfg.MaxItemSize),
+		priorities:        newPriorities(cfg.Priorities),
+		data:              map[Namespace]*lruNamespace{},
 	}
 }
 
 var _ Storage = (*LRUStorage)(nil)
 
 func (l *LRUStorage) Get(_ context.Context, key Key) ([]byte, bool) {
-	return l.dataMap(key).Get(key)
+	e, ok := l.dataMap(key).Get(key)
+	if !ok {
+		return nil, false
+	}
+	return e.value, true
 }
 
 func (l *LRUStorage) Add(_ context.Context, key Key, value []byte) {
-	l.dataMap(key).Add(key, value)
+	l.store(key, lruEntry{value: value, modTime: time.Now()})
+}
+
+func (l *LRUStorage) Open(_ context.Context, key Key) (*Entry, bool) {
+	m := l.dataMap(key)
+	e, ok := m.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return &Entry{
+		ReadCloser: nopCloser{bytes.NewReader(e.value)},
+		Size:       int64(len(e.value)),
+		ModTime:    e.modTime,
+		Expires:    e.modTime.Add(m.ttl),
+		Metadata:   e.meta,
+	}, true
+}
+
+func (l *LRUStorage) Stale(ctx context.Context, key Key) (*Entry, bool) {
+	return l.Open(ctx, key)
+}
+
+func (l *LRUStorage) Touch(_ context.Context, key Key) {
+	if e, ok := l.dataMap(key).Get(key); ok {
+		e.modTime = time.Now()
+		l.store(key, e)
+	}
+}
+
+func (l *LRUStorage) Create(_ context.Context, key Key, meta Metadata) (Writer, error) {
+	return &bufferWriter{meta: meta, limit: l.itemLimit(key.Namespace()), add: func(value []byte, meta Metadata) {
+		l.store(key, lruEntry{value: value, meta: meta, modTime: time.Now()})
+	}}, nil
 }
 
 func (l *LRUStorage) NamespaceTTL(namespace Namespace, ttl time.Duration) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	// Values in the replaced map are discarded:
+	if m, ok := l.data[namespace]; ok {
+		m.Purge()
+	}
 	if ttl == 0 {
 		delete(l.data, namespace)
 		return
 	}
-	l.data[namespace] = expirable.NewLRU[Key, []byte](l.size, nil, ttl)
+	l.data[namespace] = l.newNamespace(ttl)
+}
+
+func (l *LRUStorage) Delete(_ context.Context, key Key) error {
+	l.dataMap(key).Remove(key)
+	return nil
+}
+
+func (l *LRUStorage) Keys(_ context.Context, prefix Key) ([]Key, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var keys []Key
+	for _, m := range l.data {
+		for _, key := range m.Keys() {
+			if strings.HasPrefix(string(key), string(prefix)) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Size returns the total size of values in memory.
+func (l *LRUStorage) Size(_ context.Context) (int64, error) {
+	return l.used.Load(), nil
+}
+
+// NamespaceSize returns the size of a namespace's values in memory.
+func (l *LRUStorage) NamespaceSize(namespace Namespace) int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if m, ok := l.data[namespace]; ok {
+		return m.used.Load()
+	}
+	return 0
+}
+
+// store adds a value, then evicts values until the storage fits its limits.
+func (l *LRUStorage) store(key Key, e lruEntry) {
+	ns := key.Namespace()
+	if limit := l.itemLimit(ns); limit > 0 && int64(len(e.value)) > limit {
+		slog.Debug("value too large to store", slog.Any("key", key), slog.Int("size", len(e.value)))
+		// The previous value is outdated:
+		l.dataMap(key).Remove(key)
+		return
+	}
+
+	l.writing.Lock()
+	defer l.writing.Unlock()
+
+	m := l.dataMap(key)
+	// Removing first accounts for the value being replaced:
+	m.Remove(key)
+	m.Add(key, e)
+	m.used.Add(int64(len(e.value)))
+	l.used.Add(int64(len(e.value)))
+
+	if limit, ok := l.namespaceMaxBytes[ns]; ok && limit > 0 {
+		for m.used.Load() > limit {
+			if _, _, ok := m.RemoveOldest(); !ok {
+				break
+			}
+		}
+	}
+	l.evict()
+}
+
+// evict removes the least recently used values of the lowest priority namespaces, until the storage fits MaxBytes.
+func (l *LRUStorage) evict() {
+	if l.maxBytes <= 0 {
+		return
+	}
+	for l.used.Load() > l.maxBytes {
+		victim := l.victim()
+		if victim == nil {
+			return
+		}
+		victim.RemoveOldest()
+	}
+}
+
+// victim returns the lowest priority namespace that holds values, preferring the largest.
+func (l *LRUStorage) victim() *lruNamespace {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var victim *lruNamespace
+	var victimPriority int
+	for ns, m := range l.data {
+		if m.used.Load() == 0 {
+			continue
+		}
+		p := l.priorities.of(ns)
+		if victim == nil || p < victimPriority || (p == victimPriority && m.used.Load() > victim.used.Load()) {
+			victim, victimPriority = m, p
+		}
+	}
+	return victim
+}
+
+// itemLimit is the size of the largest value stored in a namespace, zero is unlimited.
+func (l *LRUStorage) itemLimit(ns Namespace) int64 {
+	limit := l.maxItemSize
+	for _, other := range []int64{l.namespaceMaxBytes[ns], l.maxBytes} {
+		if other > 0 && (limit == 0 || other < limit) {
+			limit = other
+		}
+	}
+	return limit
+}
+
+func (l *LRUStorage) newNamespace(ttl time.Duration) *lruNamespace {
+	m := &lruNamespace{ttl: ttl}
+	m.LRU = expirable.NewLRU[Key, lruEntry](l.size, func(_ Key, e lruEntry) {
+		m.used.Add(-int64(len(e.value)))
+		l.used.Add(-int64(len(e.value)))
+	}, ttl)
+	return m
 }
 
-func (l *LRUStorage) dataMap(key Key) *expirable.LRU[Key, []byte] {
+func (l *LRUStorage) dataMap(key Key) *lruNamespace {
 	ns := key.Namespace()
 
 	l.mu.RLock()
@@ -71,7 +275,7 @@ func (l *LRUStorage) dataMap(key Key) *expirable.LRU[Key, []byte] {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	if m, ok = l.data[ns]; !ok {
-		m = expirable.NewLRU[Key, []byte](l.size, nil, l.defaultTTL)
+		m = l.newNamespace(l.defaultTTL)
 		l.data[ns] = m
 	}
 
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/thepwagner/debcache/pkg/cache"
 )
 
@@ -58,3 +59,108 @@ func TestLRUStorage_Expiry(t *testing.T) {
 	assert.False(t, ok)
 	assert.Nil(t, storedValue)
 }
+
+func TestLRUStorage_Size(t *testing.T) {
+	t.Parallel()
+
+	lru := cache.NewLRUStorage(cache.LRUConfig{})
+	ctx := context.Background()
+	lru.Add(ctx, cache.Namespace("foo").Key("a"), []byte("testValue"))
+	lru.Add(ctx, cache.Namespace("bar").Key("b"), []byte("test"))
+
+	size, err := lru.Size(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(13), size)
+}
+
+func TestLRUStorage_MaxBytes(t *testing.T) {
+	t.Parallel()
+
+	lru := cache.NewLRUStorage(cache.LRUConfig{MaxBytes: 10})
+	ctx := context.Background()
+	pool, releases := cache.Namespace("pool"), cache.Namespace("releases")
+	lru.Add(ctx, releases.Key("a"), []byte("1234"))
+	lru.Add(ctx, pool.Key("a"), []byte("1234"))
+	lru.Add(ctx, pool.Key("b"), []byte("1234"))
+
+	// Pool files are evicted before indexes:
+	_, ok := lru.Get(ctx, pool.Key("a"))
+	assert.False(t, ok)
+	_, ok = lru.Get(ctx, pool.Key("b"))
+	assert.True(t, ok)
+	_, ok = lru.Get(ctx, releases.Key("a"))
+	assert.True(t, ok)
+	size, err := lru.Size(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), size)
+
+	// Replacing a value accounts for the replaced size:
+	lru.Add(ctx, releases.Key("a"), []byte("12"))
+	size, err = lru.Size(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), size)
+	assert.Equal(t, int64(2), lru.NamespaceSize(releases))
+	assert.Equal(t, int64(4), lru.NamespaceSize(pool))
+
+	require.NoError(t, lru.Delete(ctx, pool.Key("b")))
+	assert.Equal(t, int64(0), lru.NamespaceSize(pool))
+}
+
+func TestLRUStorage_MaxBytesUnlimitedEntries(t *testing.T) {
+	t.Parallel()
+
+	lru := cache.NewLRUStorage(cache.LRUConfig{MaxBytes: 1000})
+	ctx := context.Background()
+	pool := cache.Namespace("pool")
+	for i := 0; i < 500; i++ {
+		lru.Add(ctx, pool.Key(fmt.Sprint(i)), []byte("1"))
+	}
+
+	// Small values are limited by bytes, not by a count of entries:
+	_, ok := lru.Get(ctx, pool.Key("0"))
+	assert.True(t, ok)
+	assert.Equal(t, int64(500), lru.NamespaceSize(pool))
+}
+
+func TestLRUStorage_NamespaceMaxBytes(t *testing.T) {
+	t.Parallel()
+
+	pool, releases := cache.Namespace("pool"), cache.Namespace("releases")
+	lru := cache.NewLRUStorage(cache.LRUConfig{NamespaceMaxBytes: map[cache.Namespace]cache.ByteSize{pool: 5}})
+	ctx := context.Background()
+	lru.Add(ctx, pool.Key("a"), []byte("123"))
+	lru.Add(ctx, pool.Key("b"), []byte("123"))
+	lru.Add(ctx, releases.Key("a"), []byte("123456"))
+
+	_, ok := lru.Get(ctx, pool.Key("a"))
+	assert.False(t, ok)
+	_, ok = lru.Get(ctx, pool.Key("b"))
+	assert.True(t, ok)
+	_, ok = lru.Get(ctx, releases.Key("a"))
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), lru.NamespaceSize(pool))
+}
+
+func TestLRUStorage_MaxItemSize(t *testing.T) {
+	t.Parallel()
+
+	lru := cache.NewLRUStorage(cache.LRUConfig{MaxItemSize: 4})
+	ctx := context.Background()
+	lru.Add(ctx, cache.Key("small"), []byte("1234"))
+	lru.Add(ctx, cache.Key("large"), []byte("12345"))
+	_, ok := lru.Get(ctx, cache.Key("small"))
+	assert.True(t, ok)
+	_, ok = lru.Get(ctx, cache.Key("large"))
+	assert.False(t, ok)
+
+	// Streamed values are rejected once they are too large, without buffering the rest:
+	w, err := lru.Create(ctx, cache.Key("streamed"), cache.Metadata{})
+	require.NoError(t, err)
+	_, err = w.Write([]byte("123"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("45"))
+	require.ErrorIs(t, err, cache.ErrTooLarge)
+	require.NoError(t, w.Discard())
+	_, ok = lru.Open(ctx, cache.Key("streamed"))
+	assert.False(t, ok)
+}
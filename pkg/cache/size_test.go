@@ -0,0 +1,41 @@
+package cache_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/debcache/pkg/cache"
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseByteSize(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]cache.ByteSize{
+		"1024":    1024,
+		"100B":    100,
+		"2KB":     2000,
+		"1.5 GiB": 3 << 29,
+		"10GB":    10_000_000_000,
+		"1TiB":    1 << 40,
+	}
+	for s, expected := range cases {
+		s, expected := s, expected
+		t.Run(s, func(t *testing.T) {
+			t.Parallel()
+			size, err := cache.ParseByteSize(s)
+			require.NoError(t, err)
+			assert.Equal(t, expected, size)
+		})
+	}
+
+	for _, s := range []string{"", "GB", "-1MB", "1XB"} {
+		_, err := cache.ParseByteSize(s)
+		assert.Error(t, err, s)
+	}
+
+	var cfg cache.FileConfig
+	require.NoError(t, yaml.Unmarshal([]byte("maxSize: 512MiB"), &cfg))
+	assert.Equal(t, cache.ByteSize(512<<20), cfg.MaxSize)
+}
@@ -1,12 +1,119 @@
 package cache
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"time"
 )
 
 type Storage interface {
 	Get(ctx context.Context, key Key) ([]byte, bool)
 	Add(ctx context.Context, key Key, value []byte)
+	// Open streams a value from the cache.
+	Open(ctx context.Context, key Key) (*Entry, bool)
+	// Stale streams a value from the cache, even if it has expired.
+	Stale(ctx context.Context, key Key) (*Entry, bool)
+	// Touch resets the age of a value, without rewriting it.
+	Touch(ctx context.Context, key Key)
+	// Create streams a value into the cache. The value is stored once the Writer is committed.
+	// If meta.SHA256 is set, Commit fails with ErrCorrupt unless the value has that digest.
+	Create(ctx context.Context, key Key, meta Metadata) (Writer, error)
 	NamespaceTTL(namepace Namespace, ttl time.Duration)
+	// Delete removes a value, if it exists.
+	Delete(ctx context.Context, key Key) error
+	// Keys lists the stored keys that start with prefix, including expired values.
+	Keys(ctx context.Context, prefix Key) ([]Key, error)
 }
+
+// Purge deletes every value with a key that starts with prefix, returning how many were deleted.
+func Purge(ctx context.Context, s Storage, prefix Key) (int, error) {
+	keys, err := s.Keys(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		if err := s.Delete(ctx, key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// Entry is a value streamed from Storage. The ReadCloser is also an io.Seeker, if the Storage supports it.
+type Entry struct {
+	io.ReadCloser
+	// Size is the length of the value in bytes.
+	Size int64
+	// ModTime is when the value was stored, zero if unknown.
+	ModTime time.Time
+	// Expires is when the value expires, zero if it never does.
+	Expires  time.Time
+	Metadata Metadata
+}
+
+// Metadata describes a stored value.
+type Metadata struct {
+	// ETag is the origin's validator for the value.
+	ETag string `json:"etag,omitempty"`
+	// LastModified is when the origin last modified the value.
+	LastModified time.Time `json:"lastModified"`
+	// SHA256 is the hex digest of the value, calculated by the Storage. Values that no longer match are not served.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Writer streams a value into Storage.
+type Writer interface {
+	io.Writer
+	// Commit stores the written value.
+	Commit() error
+	// Discard abandons the written value.
+	Discard() error
+}
+
+// ErrTooLarge is returned when writing a value larger than the Storage accepts.
+var ErrTooLarge = errors.New("value too large to store")
+
+// bufferWriter is a Writer for storage that holds values in memory.
+type bufferWriter struct {
+	bytes.Buffer
+	meta Metadata
+	add  func(value []byte, meta Metadata)
+	// limit is the size of the largest value accepted, zero is unlimited.
+	limit int64
+}
+
+func (b *bufferWriter) Write(p []byte) (int, error) {
+	if b.limit > 0 && int64(b.Len()+len(p)) > b.limit {
+		b.Reset()
+		return 0, ErrTooLarge
+	}
+	return b.Buffer.Write(p)
+}
+
+func (b *bufferWriter) Commit() error {
+	sum := sha256.Sum256(b.Bytes())
+	digest := hex.EncodeToString(sum[:])
+	if b.meta.SHA256 != "" && b.meta.SHA256 != digest {
+		return fmt.Errorf("%w: expected %s, got %s", ErrCorrupt, b.meta.SHA256, digest)
+	}
+	b.meta.SHA256 = digest
+	b.add(b.Bytes(), b.meta)
+	return nil
+}
+
+func (b *bufferWriter) Discard() error {
+	b.Reset()
+	return nil
+}
+
+// nopCloser is an io.ReadCloser that keeps the io.Seeker of a bytes.Reader.
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
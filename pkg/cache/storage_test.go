@@ -2,13 +2,18 @@ package cache_test
 
 import (
 	"context"
+	"io"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/thepwagner/debcache/pkg/cache"
 )
 
+// testValueSHA256 is the digest of "testValue".
+const testValueSHA256 = "82fe0c834cbea069013c5eb7828e599a693e0d2411887e2ab273271662973082"
+
 func testCache(t *testing.T, storage func() cache.Storage) {
 	t.Helper()
 
@@ -37,6 +42,93 @@ func testCache(t *testing.T, storage func() cache.Storage) {
 		assert.Equal(t, value, storedValue)
 	})
 
+	t.Run("stream", func(t *testing.T) {
+		t.Parallel()
+		stor := storage()
+
+		committed := cache.Namespace("foo").Key("committed")
+		meta := cache.Metadata{ETag: `"abc"`, LastModified: time.Unix(1700000000, 0).UTC()}
+		w, err := stor.Create(ctx, committed, meta)
+		require.NoError(t, err)
+		_, err = w.Write(value)
+		require.NoError(t, err)
+		_, ok := stor.Open(ctx, committed)
+		assert.False(t, ok, "value visible before commit")
+		require.NoError(t, w.Commit())
+
+		entry, ok := stor.Open(ctx, committed)
+		require.True(t, ok)
+		defer entry.Close()
+		assert.Equal(t, int64(len(value)), entry.Size)
+		assert.Equal(t, meta.ETag, entry.Metadata.ETag)
+		assert.True(t, meta.LastModified.Equal(entry.Metadata.LastModified))
+		assert.Equal(t, testValueSHA256, entry.Metadata.SHA256)
+		b, err := io.ReadAll(entry)
+		require.NoError(t, err)
+		assert.Equal(t, value, b)
+
+		discarded := cache.Namespace("foo").Key("discarded")
+		w, err = stor.Create(ctx, discarded, cache.Metadata{})
+		require.NoError(t, err)
+		_, err = w.Write(value)
+		require.NoError(t, err)
+		require.NoError(t, w.Discard())
+		_, ok = stor.Open(ctx, discarded)
+		assert.False(t, ok)
+	})
+
+	t.Run("expected digest", func(t *testing.T) {
+		t.Parallel()
+		stor := storage()
+
+		key := cache.Namespace("foo").Key("digest")
+		w, err := stor.Create(ctx, key, cache.Metadata{SHA256: testValueSHA256})
+		require.NoError(t, err)
+		_, err = w.Write([]byte("otherValue"))
+		require.NoError(t, err)
+		require.ErrorIs(t, w.Commit(), cache.ErrCorrupt)
+		_, ok := stor.Open(ctx, key)
+		assert.False(t, ok)
+
+		w, err = stor.Create(ctx, key, cache.Metadata{SHA256: testValueSHA256})
+		require.NoError(t, err)
+		_, err = w.Write(value)
+		require.NoError(t, err)
+		require.NoError(t, w.Commit())
+		storedValue, ok := stor.Get(ctx, key)
+		assert.True(t, ok)
+		assert.Equal(t, value, storedValue)
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		t.Parallel()
+		stor := storage()
+
+		kept := cache.Namespace("foo").Key("kept")
+		stor.Add(ctx, kept, value)
+		purged := []cache.Key{cache.Namespace("bar").Key("a"), cache.Namespace("bar").Key("b/c")}
+		for _, key := range purged {
+			stor.Add(ctx, key, value)
+		}
+
+		keys, err := stor.Keys(ctx, cache.Namespace("bar").Key())
+		require.NoError(t, err)
+		assert.ElementsMatch(t, purged, keys)
+
+		n, err := cache.Purge(ctx, stor, cache.Namespace("bar").Key())
+		require.NoError(t, err)
+		assert.Equal(t, 2, n)
+		for _, key := range purged {
+			_, ok := stor.Get(ctx, key)
+			assert.False(t, ok)
+		}
+		_, ok := stor.Get(ctx, kept)
+		assert.True(t, ok)
+
+		// Deleting a missing value is not an error:
+		require.NoError(t, stor.Delete(ctx, purged[0]))
+	})
+
 	t.Run("namespace expiry", func(t *testing.T) {
 		t.Parallel()
 		stor := storage()
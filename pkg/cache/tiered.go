@@ -0,0 +1,287 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TieredStorage holds every value on disk, and keeps small values of hot namespaces in memory.
+// Values read from disk are promoted to memory, if their namespace is in the memory tier.
+type TieredStorage struct {
+	memory *LRUStorage
+	disk   *FileStorage
+	tiers  map[Namespace]Tier
+}
+
+type TieredConfig struct {
+	FileConfig `yaml:",inline"`
+	// Memory configures the memory tier. MaxBytes defaults to 256MiB and MaxItemSize to 16MiB.
+	Memory LRUConfig `yaml:"memory"`
+	// Tiers overrides which namespaces are kept in memory.
+	// By default releases, packages and by-hash indexes are, other namespaces are only on disk.
+	Tiers map[Namespace]Tier `yaml:"tiers"`
+}
+
+// Tier is where a namespace's values are stored.
+type Tier string
+
+const (
+	// TierMemory keeps values in memory, and on disk.
+	TierMemory Tier = "memory"
+	// TierDisk keeps values on disk.
+	TierDisk Tier = "disk"
+)
+
+func (t *Tier) UnmarshalYAML(value *yaml.Node) error {
+	switch tier := Tier(value.Value); tier {
+	case TierMemory, TierDisk:
+		*t = tier
+		return nil
+	default:
+		return fmt.Errorf("unknown tier %q", value.Value)
+	}
+}
+
+var defaultTiers = map[Namespace]Tier{
+	"releases": TierMemory,
+	"packages": TierMemory,
+	"by-hash":  TierMemory,
+}
+
+const (
+	defaultTieredMemoryBytes    = 256 << 20
+	defaultTieredMemoryItemSize = 16 << 20
+)
+
+func NewTieredStorage(cfg TieredConfig) *TieredStorage {
+	memoryCfg := cfg.Memory
+	if memoryCfg.MaxBytes == 0 {
+		memoryCfg.MaxBytes = defaultTieredMemoryBytes
+	}
+	if memoryCfg.MaxItemSize == 0 {
+		memoryCfg.MaxItemSize = defaultTieredMemoryItemSize
+	}
+	if memoryCfg.TTL == 0 {
+		memoryCfg.TTL = cfg.TTL
+	}
+	tiers := make(map[Namespace]Tier, len(defaultTiers)+len(cfg.Tiers))
+	for ns, tier := range defaultTiers {
+		tiers[ns] = tier
+	}
+	for ns, tier := range cfg.Tiers {
+		tiers[ns] = tier
+	}
+	return &TieredStorage{
+		memory: NewLRUStorage(memoryCfg),
+		disk:   NewFileStorage(cfg.FileConfig),
+		tiers:  tiers,
+	}
+}
+
+var _ Storage = (*TieredStorage)(nil)
+
+func (t *TieredStorage) Get(ctx context.Context, key Key) ([]byte, bool) {
+	entry, ok := t.Open(ctx, key)
+	if !ok {
+		return nil, false
+	}
+	defer entry.Close()
+	b, err := io.ReadAll(entry)
+	if err != nil {
+		slog.Error("cache.TieredStorage.Get read error", slog.String("error", err.Error()))
+		return nil, false
+	}
+	return b, true
+}
+
+func (t *TieredStorage) Add(ctx context.Context, key Key, value []byte) {
+	t.disk.Add(ctx, key, value)
+	if t.inMemory(key) {
+		t.memory.Add(ctx, key, value)
+	}
+}
+
+func (t *TieredStorage) Open(ctx context.Context, key Key) (*Entry, bool) {
+	if !t.inMemory(key) {
+		return t.disk.Open(ctx, key)
+	}
+
+	// Values promoted from disk keep their age, so expire with the copy on disk:
+	if entry, ok := t.memory.Open(ctx, key); ok {
+		// Keep the copy on disk from being evicted while it is served from memory:
+		t.disk.accessed(key, nil)
+		ttl := t.disk.namespaceTTL(key.Namespace())
+		if ttl <= 0 {
+			entry.Expires = time.Time{}
+			return entry, true
+		}
+		if entry.Expires = entry.ModTime.Add(ttl); time.Now().Before(entry.Expires) {
+			return entry, true
+		}
+		_ = entry.Close()
+	}
+
+	entry, ok := t.disk.Open(ctx, key)
+	if !ok {
+		return nil, false
+	}
+	if limit := t.memory.itemLimit(key.Namespace()); limit > 0 && entry.Size > limit {
+		return entry, true
+	}
+	return t.promote(ctx, key, entry)
+}
+
+// promote copies a value from disk into memory, serving the copy.
+func (t *TieredStorage) promote(ctx context.Context, key Key, entry *Entry) (*Entry, bool) {
+	defer entry.Close()
+	value, err := io.ReadAll(entry)
+	if err != nil {
+		slog.Error("cache.TieredStorage.promote read error", slog.String("error", err.Error()))
+		return nil, false
+	}
+	t.memory.store(key, lruEntry{value: value, meta: entry.Metadata, modTime: entry.ModTime})
+	promoted, ok := t.memory.Open(ctx, key)
+	if !ok {
+		// The memory tier did not keep the value, so serve what was read from disk:
+		promoted = &Entry{
+			ReadCloser: nopCloser{bytes.NewReader(value)},
+			Size:       int64(len(value)),
+			ModTime:    entry.ModTime,
+			Metadata:   entry.Metadata,
+		}
+	}
+	promoted.Expires = entry.Expires
+	return promoted, true
+}
+
+func (t *TieredStorage) Stale(ctx context.Context, key Key) (*Entry, bool) {
+	if t.inMemory(key) {
+		if entry, ok := t.memory.Stale(ctx, key); ok {
+			return entry, true
+		}
+	}
+	return t.disk.Stale(ctx, key)
+}
+
+func (t *TieredStorage) Touch(ctx context.Context, key Key) {
+	t.disk.Touch(ctx, key)
+	if t.inMemory(key) {
+		t.memory.Touch(ctx, key)
+	}
+}
+
+func (t *TieredStorage) Create(ctx context.Context, key Key, meta Metadata) (Writer, error) {
+	disk, err := t.disk.Create(ctx, key, meta)
+	if err != nil {
+		return nil, err
+	}
+	w := &tieredWriter{disk: disk, drop: func() { _ = t.memory.Delete(ctx, key) }}
+	if t.inMemory(key) {
+		if w.memory, err = t.memory.Create(ctx, key, meta); err != nil {
+			_ = disk.Discard()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (t *TieredStorage) NamespaceTTL(namespace Namespace, ttl time.Duration) {
+	t.disk.NamespaceTTL(namespace, ttl)
+	t.memory.NamespaceTTL(namespace, ttl)
+}
+
+func (t *TieredStorage) Delete(ctx context.Context, key Key) error {
+	_ = t.memory.Delete(ctx, key)
+	return t.disk.Delete(ctx, key)
+}
+
+// Keys lists the keys stored in either tier. Values evicted from disk can still be in memory.
+func (t *TieredStorage) Keys(ctx context.Context, prefix Key) ([]Key, error) {
+	keys, err := t.disk.Keys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	memory, err := t.memory.Keys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[Key]struct{}, len(keys))
+	for _, key := range keys {
+		seen[key] = struct{}{}
+	}
+	for _, key := range memory {
+		if _, ok := seen[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Size returns the total size of values on disk, which includes every value in memory.
+func (t *TieredStorage) Size(ctx context.Context) (int64, error) {
+	return t.disk.Size(ctx)
+}
+
+// MemorySize returns the total size of values in memory.
+func (t *TieredStorage) MemorySize(ctx context.Context) (int64, error) {
+	return t.memory.Size(ctx)
+}
+
+// RunGC periodically removes expired values from disk, until ctx is cancelled.
+func (t *TieredStorage) RunGC(ctx context.Context) {
+	t.disk.RunGC(ctx)
+}
+
+func (t *TieredStorage) inMemory(key Key) bool {
+	return t.tiers[key.Namespace()] == TierMemory
+}
+
+// tieredWriter writes a value to disk, and to memory until it is too large.
+type tieredWriter struct {
+	disk Writer
+	// memory is nil if the value is not kept in memory.
+	memory Writer
+	// drop removes the previous value from memory, if the new value is not kept there.
+	drop func()
+}
+
+func (w *tieredWriter) Write(p []byte) (int, error) {
+	n, err := w.disk.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if w.memory != nil {
+		if _, err := w.memory.Write(p); err != nil {
+			_ = w.memory.Discard()
+			w.memory = nil
+		}
+	}
+	return n, nil
+}
+
+func (w *tieredWriter) Commit() error {
+	if err := w.disk.Commit(); err != nil {
+		if w.memory != nil {
+			_ = w.memory.Discard()
+		}
+		return err
+	}
+	if w.memory != nil {
+		return w.memory.Commit()
+	}
+	w.drop()
+	return nil
+}
+
+func (w *tieredWriter) Discard() error {
+	if w.memory != nil {
+		_ = w.memory.Discard()
+	}
+	return w.disk.Discard()
+}
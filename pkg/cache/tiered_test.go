@@ -0,0 +1,134 @@
+package cache_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/debcache/pkg/cache"
+	"gopkg.in/yaml.v3"
+)
+
+func TestTieredStorage(t *testing.T) {
+	t.Parallel()
+
+	testCache(t, func() cache.Storage {
+		return cache.NewTieredStorage(cache.TieredConfig{
+			FileConfig: cache.FileConfig{Path: t.TempDir()},
+			Tiers:      map[cache.Namespace]cache.Tier{"foo": cache.TierMemory, "bar": cache.TierMemory, "fast": cache.TierMemory},
+		})
+	})
+}
+
+func TestTieredStorage_Promote(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ctx := context.Background()
+	packages, pool := cache.Namespace("packages"), cache.Namespace("pool")
+	cold := cache.NewTieredStorage(cache.TieredConfig{FileConfig: cache.FileConfig{Path: dir}})
+	cold.Add(ctx, packages.Key("a"), []byte("packages"))
+	cold.Add(ctx, pool.Key("a"), []byte("pool"))
+	size, err := cold.MemorySize(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), size)
+
+	// A new storage starts with an empty memory tier, that values are promoted to as they are read:
+	tiered := cache.NewTieredStorage(cache.TieredConfig{
+		FileConfig: cache.FileConfig{Path: dir},
+		Memory:     cache.LRUConfig{MaxItemSize: 8},
+	})
+	size, err = tiered.MemorySize(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+	for _, key := range []cache.Key{packages.Key("a"), pool.Key("a")} {
+		value, ok := tiered.Get(ctx, key)
+		require.True(t, ok)
+		assert.NotEmpty(t, value)
+	}
+	size, err = tiered.MemorySize(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), size)
+	size, err = tiered.Size(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), size)
+
+	// Values too large for memory are only on disk, replacing the copy in memory:
+	tiered.Add(ctx, packages.Key("a"), []byte("packages, but larger"))
+	size, err = tiered.MemorySize(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+	value, ok := tiered.Get(ctx, packages.Key("a"))
+	require.True(t, ok)
+	assert.Equal(t, []byte("packages, but larger"), value)
+}
+
+func TestTieredStorage_PromoteEvicted(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	ctx := context.Background()
+	key := cache.Namespace("packages").Key("a")
+	cache.NewTieredStorage(cache.TieredConfig{FileConfig: cache.FileConfig{Path: dir}}).Add(ctx, key, []byte("packages"))
+
+	// Values the memory tier can't keep are served from disk:
+	tiered := cache.NewTieredStorage(cache.TieredConfig{
+		FileConfig: cache.FileConfig{Path: dir},
+		Memory:     cache.LRUConfig{MaxBytes: 4, MaxItemSize: 8},
+	})
+	value, ok := tiered.Get(ctx, key)
+	require.True(t, ok)
+	assert.Equal(t, []byte("packages"), value)
+	size, err := tiered.MemorySize(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, size)
+}
+
+func TestTieredStorage_Keys(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	tiered := cache.NewTieredStorage(cache.TieredConfig{FileConfig: cache.FileConfig{Path: t.TempDir(), MaxSize: 10}})
+	a, b := cache.Namespace("packages").Key("a"), cache.Namespace("packages").Key("b")
+	tiered.Add(ctx, a, []byte("testValue"))
+	tiered.Add(ctx, b, []byte("testValue"))
+
+	// Values evicted from disk are still listed while they are in memory:
+	keys, err := tiered.Keys(ctx, "")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []cache.Key{a, b}, keys)
+	_, ok := tiered.Get(ctx, a)
+	assert.True(t, ok)
+}
+
+func TestTieredStorage_MemoryHitsKeepDisk(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	tiered := cache.NewTieredStorage(cache.TieredConfig{FileConfig: cache.FileConfig{Path: dir, MaxSize: 10}})
+	a, b, c := cache.Namespace("packages").Key("a"), cache.Namespace("packages").Key("b"), cache.Namespace("packages").Key("c")
+	tiered.Add(ctx, a, []byte("1234"))
+	tiered.Add(ctx, b, []byte("1234"))
+
+	// Values served from memory are used on disk too, so the least recently used on disk is b:
+	_, ok := tiered.Get(ctx, a)
+	require.True(t, ok)
+	tiered.Add(ctx, c, []byte("1234"))
+	keys, err := cache.NewFileStorage(cache.FileConfig{Path: dir}).Keys(ctx, "")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []cache.Key{a, c}, keys)
+}
+
+func TestTieredConfig(t *testing.T) {
+	t.Parallel()
+
+	var cfg cache.TieredConfig
+	require.NoError(t, yaml.Unmarshal([]byte("path: /tmp/cache\nmemory:\n  maxBytes: 1MiB\ntiers:\n  pool: disk\n  translations: memory\n"), &cfg))
+	assert.Equal(t, "/tmp/cache", cfg.Path)
+	assert.Equal(t, cache.ByteSize(1<<20), cfg.Memory.MaxBytes)
+	assert.Equal(t, map[cache.Namespace]cache.Tier{"pool": cache.TierDisk, "translations": cache.TierMemory}, cfg.Tiers)
+
+	assert.Error(t, yaml.Unmarshal([]byte("tiers:\n  pool: cloud\n"), &cfg))
+}
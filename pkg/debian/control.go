@@ -19,9 +19,13 @@ var keyValueRE = regexp.MustCompile(`^([^\s:]+):(.*)$`)
 
 // multilineKeys maintain newlines in their values.
 var multilineKeys = map[string]struct{}{
-	"MD5Sum":    {},
-	"SHA256":    {},
-	"Signed-By": {},
+	"MD5Sum":           {},
+	"SHA256":           {},
+	"Signed-By":        {},
+	"Files":            {},
+	"Checksums-Sha1":   {},
+	"Checksums-Sha256": {},
+	"Package-List":     {},
 }
 
 // ParseControlFile parses a Debian control file.
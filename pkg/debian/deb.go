@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/blakesmith/ar"
+	"github.com/klauspost/compress/zstd"
 	"github.com/ulikunitz/xz"
 )
 
@@ -75,3 +77,68 @@ func ParagraphFromDebFile(fn string) (*Paragraph, error) {
 
 	return ParagraphFromDeb(f)
 }
+
+// FilesFromDeb lists the files installed by a .deb, as paths relative to the filesystem root.
+func FilesFromDeb(in io.Reader) ([]string, error) {
+	for reader := ar.NewReader(in); ; {
+		hdr, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("data archive not found")
+		} else if err != nil {
+			return nil, fmt.Errorf("reading archive: %w", err)
+		}
+
+		var dataIn io.Reader
+		switch hdr.Name {
+		case "data.tar":
+			dataIn = reader
+		case "data.tar.gz":
+			gzIn, err := gzip.NewReader(reader)
+			if err != nil {
+				return nil, fmt.Errorf("creating gzip reader: %w", err)
+			}
+			defer gzIn.Close()
+			dataIn = gzIn
+		case "data.tar.xz":
+			dataIn, err = xz.NewReader(reader)
+			if err != nil {
+				return nil, fmt.Errorf("creating xz reader: %w", err)
+			}
+		case "data.tar.zst":
+			zstIn, err := zstd.NewReader(reader)
+			if err != nil {
+				return nil, fmt.Errorf("creating zstd reader: %w", err)
+			}
+			defer zstIn.Close()
+			dataIn = zstIn
+		default:
+			continue
+		}
+
+		// Directories are implied by the files within them:
+		var files []string
+		for tarR := tar.NewReader(dataIn); ; {
+			hdr, err := tarR.Next()
+			if errors.Is(err, io.EOF) {
+				return files, nil
+			} else if err != nil {
+				return nil, fmt.Errorf("reading data archive: %w", err)
+			}
+			if hdr.Typeflag == tar.TypeDir {
+				continue
+			}
+			files = append(files, strings.TrimLeft(strings.TrimPrefix(hdr.Name, "."), "/"))
+		}
+	}
+}
+
+// FilesFromDebFile lists the files installed by a .deb file.
+func FilesFromDebFile(fn string) ([]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return FilesFromDeb(f)
+}
@@ -28,3 +28,21 @@ func TestParagraphFromDeb(t *testing.T) {
 		"Version":        "1.2.3",
 	}, graph)
 }
+
+func TestFilesFromDebFile(t *testing.T) {
+	t.Parallel()
+
+	t.Run("no files", func(t *testing.T) {
+		t.Parallel()
+		files, err := debian.FilesFromDebFile("testdata/foobar_1.2.3_amd64.deb")
+		require.NoError(t, err)
+		assert.Empty(t, files)
+	})
+
+	t.Run("files", func(t *testing.T) {
+		t.Parallel()
+		files, err := debian.FilesFromDebFile("../dynamic/testdata/hello_1.0.0_amd64.deb")
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"usr/bin/hello", "usr/bin/hi", "usr/share/doc/hello/README"}, files)
+	})
+}
@@ -0,0 +1,60 @@
+package debian
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+)
+
+// ParagraphFromDsc reads the paragraph from a source package's .dsc.
+// Signed .dsc files are accepted, but the signature is not verified.
+func ParagraphFromDsc(in io.Reader) (*Paragraph, error) {
+	b, err := io.ReadAll(in)
+	if err != nil {
+		return nil, fmt.Errorf("reading dsc: %w", err)
+	}
+	if signed, _ := clearsign.Decode(b); signed != nil {
+		b = signed.Plaintext
+	}
+
+	graphs, err := ParseControlFile(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("parsing dsc: %w", err)
+	}
+	if len(graphs) != 1 {
+		return nil, nil
+	}
+	return &graphs[0], nil
+}
+
+// ParagraphFromDscFile reads the paragraph from a .dsc file.
+func ParagraphFromDscFile(fn string) (*Paragraph, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParagraphFromDsc(f)
+}
+
+// SourceFiles lists the files referenced by a source package's checksums.
+func SourceFiles(p Paragraph) []string {
+	checksums := p["Checksums-Sha256"]
+	if checksums == "" {
+		checksums = p["Files"]
+	}
+
+	var files []string
+	for _, line := range strings.Split(checksums, "\n") {
+		// Each line is "<digest> <size> <filename>":
+		if fields := strings.Fields(line); len(fields) == 3 {
+			files = append(files, fields[2])
+		}
+	}
+	return files
+}
@@ -0,0 +1,52 @@
+package debian_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/debcache/pkg/debian"
+)
+
+func TestParagraphFromDscFile(t *testing.T) {
+	t.Parallel()
+	graph, err := debian.ParagraphFromDscFile("../dynamic/testdata/hello_1.0.0.dsc")
+	require.NoError(t, err)
+	require.NotNil(t, graph)
+
+	assert.Equal(t, "hello", (*graph)["Source"])
+	assert.Equal(t, "1.0.0", (*graph)["Version"])
+	assert.Equal(t, "hello deb utils optional arch=amd64", (*graph)["Package-List"])
+	assert.Equal(t, []string{"hello_1.0.0.tar.xz"}, debian.SourceFiles(*graph))
+}
+
+func TestSourceFiles(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		graph    debian.Paragraph
+		expected []string
+	}{
+		"none": {
+			graph: debian.Paragraph{"Source": "hello"},
+		},
+		"sha256": {
+			graph: debian.Paragraph{
+				"Checksums-Sha256": "abc 1 hello_1.0.orig.tar.gz\ndef 2 hello_1.0-1.debian.tar.xz",
+				"Files":            "123 1 ignored.tar.gz",
+			},
+			expected: []string{"hello_1.0.orig.tar.gz", "hello_1.0-1.debian.tar.xz"},
+		},
+		"md5 fallback": {
+			graph:    debian.Paragraph{"Files": "123 1 hello_1.0.tar.gz"},
+			expected: []string{"hello_1.0.tar.gz"},
+		},
+	}
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.expected, debian.SourceFiles(tc.graph))
+		})
+	}
+}
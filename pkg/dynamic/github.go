@@ -12,7 +12,6 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -21,12 +20,17 @@ import (
 	"github.com/google/go-github/v70/github"
 	"github.com/thepwagner/debcache/pkg/cache"
 	"github.com/thepwagner/debcache/pkg/debian"
+	"github.com/thepwagner/debcache/pkg/httpclient"
+	"github.com/thepwagner/debcache/pkg/metrics"
 	"github.com/thepwagner/debcache/pkg/repo"
+	"github.com/thepwagner/debcache/pkg/secret"
 	"github.com/thepwagner/debcache/pkg/signature"
 )
 
 type GitHubReleasesSource struct {
 	github *github.Client
+	// downloads follows redirects from the GitHub API to asset storage.
+	downloads *http.Client
 
 	cache         cache.Storage
 	architectures map[repo.Architecture]struct{}
@@ -42,6 +46,8 @@ type GitHubReleasesConfig struct {
 	Architectures []repo.Architecture                 `yaml:"architectures"`
 	// Cache will be used for storing downloaded assets.
 	Cache cache.FileConfig `yaml:"cache"`
+	// HTTP configures the client used for the GitHub API and downloads.
+	HTTP httpclient.Config `yaml:"http"`
 }
 
 type GitHubReleasesRepoConfig struct {
@@ -60,13 +66,15 @@ type releaseRepo struct {
 }
 
 func NewGitHubReleasesSource(ctx context.Context, config GitHubReleasesConfig) (*GitHubReleasesSource, error) {
-	client := github.NewClient(&http.Client{})
+	downloads, err := httpclient.New(config.HTTP)
+	if err != nil {
+		return nil, fmt.Errorf("creating github client: %w", err)
+	}
+	client := github.NewClient(&http.Client{Transport: metrics.GitHubTransport(downloads.Transport)})
 	if config.Token != "" {
-		var tok string
-		if strings.HasPrefix(config.Token, "env.") {
-			tok = os.Getenv(strings.TrimPrefix(config.Token, "env."))
-		} else {
-			tok = config.Token
+		tok, err := secret.Value(config.Token)
+		if err != nil {
+			return nil, fmt.Errorf("reading github token: %w", err)
 		}
 		client = client.WithAuthToken(tok)
 	}
@@ -138,6 +146,7 @@ func NewGitHubReleasesSource(ctx context.Context, config GitHubReleasesConfig) (
 	slog.Debug("github releases repo", slog.Int("repo_count", len(repos)), slog.Any("arches", arches))
 	return &GitHubReleasesSource{
 		github:        client,
+		downloads:     downloads,
 		repos:         repos,
 		cache:         storage,
 		architectures: arches,
@@ -218,7 +227,7 @@ func (gh *GitHubReleasesSource) Packages(ctx context.Context) (PackageList, time
 						return nil, time.Time{}, fmt.Errorf("calculating checksum: %w", err)
 					}
 					if actual := fmt.Sprintf("%x", hash.Sum(nil)); actual != expected {
-						return nil, time.Time{}, fmt.Errorf("checksum mismatch on %s: expected %s, got %s", fn, expected, actual)
+						return nil, time.Time{}, fmt.Errorf("%w: checksum mismatch on %s: expected %s, got %s", repo.ErrVerificationFailed, fn, expected, actual)
 					}
 					log.Debug("checksum verified", slog.String("expected", expected))
 				}
@@ -275,7 +284,7 @@ func (gh *GitHubReleasesSource) get(ctx context.Context, owner, repo string, ass
 		return b, nil
 	}
 
-	body, _, err := gh.github.Repositories.DownloadReleaseAsset(ctx, owner, repo, assetID, http.DefaultClient)
+	body, _, err := gh.github.Repositories.DownloadReleaseAsset(ctx, owner, repo, assetID, gh.downloads)
 	if err != nil {
 		return nil, fmt.Errorf("getting asset %d: %w", assetID, err)
 	}
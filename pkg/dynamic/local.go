@@ -4,11 +4,13 @@ import (
 	"context"
 	"crypto/md5"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -22,7 +24,10 @@ type LocalSource struct {
 	dir string
 }
 
-var _ PackageSource = (*LocalSource)(nil)
+var (
+	_ PackageSource       = (*LocalSource)(nil)
+	_ SourcePackageSource = (*LocalSource)(nil)
+)
 
 type LocalConfig struct {
 	Directory string `yaml:"dir"`
@@ -70,9 +75,53 @@ func (s LocalSource) Packages(_ context.Context) (PackageList, time.Time, error)
 	return ret, latest, nil
 }
 
+func (s LocalSource) Sources(_ context.Context) (SourceList, time.Time, error) {
+	ret := SourceList{}
+	var latest time.Time
+	err := filepath.Walk(s.dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(info.Name()) != ".dsc" {
+			return nil
+		}
+
+		if mt := info.ModTime(); mt.After(latest) {
+			latest = mt
+		}
+
+		src, err := debian.ParagraphFromDscFile(path)
+		if err != nil {
+			return err
+		} else if src == nil {
+			slog.Warn("no source paragraph found", "file", path)
+			return nil
+		}
+
+		if err := s.addSourceFileData(*src, path); errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("source package is incomplete", "file", path, "error", err)
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		ret.Add("main", *src)
+		return nil
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return ret, latest, nil
+}
+
 func (s LocalSource) Deb(_ context.Context, filename string) ([]byte, error) {
 	filename = strings.TrimPrefix(filename, "main/p/pkg/")
-	return os.ReadFile(filepath.Join(s.dir, filename))
+	b, err := os.ReadFile(filepath.Join(s.dir, filename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", repo.ErrNotFound, filename)
+	}
+	return b, err
 }
 
 func (s LocalSource) addFileData(pkg debian.Paragraph, fn string, info fs.FileInfo) error {
@@ -99,3 +148,39 @@ func (s LocalSource) addFileData(pkg debian.Paragraph, fn string, info fs.FileIn
 	pkg["SHA256"] = fmt.Sprintf("%x", sha256sum.Sum(nil))
 	return nil
 }
+
+// addSourceFileData converts a .dsc paragraph to a Sources entry, with checksums of the .dsc and the files it references.
+func (s LocalSource) addSourceFileData(src debian.Paragraph, fn string) error {
+	dir := filepath.Dir(fn)
+	files := append([]string{filepath.Base(fn)}, debian.SourceFiles(src)...)
+
+	var md5sums, sha256sums []string
+	for _, name := range files {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		md5sum := md5.New()
+		sha256sum := sha256.New()
+		size, err := io.Copy(io.MultiWriter(md5sum, sha256sum), f)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+		md5sums = append(md5sums, fmt.Sprintf("%x %d %s", md5sum.Sum(nil), size, name))
+		sha256sums = append(sha256sums, fmt.Sprintf("%x %d %s", sha256sum.Sum(nil), size, name))
+	}
+
+	rel, err := filepath.Rel(s.dir, dir)
+	if err != nil {
+		return err
+	}
+
+	src["Package"] = src["Source"]
+	delete(src, "Source")
+	delete(src, "Checksums-Sha1")
+	src["Directory"] = path.Join("pool/main/p/pkg", filepath.ToSlash(rel))
+	src["Files"] = strings.Join(md5sums, "\n")
+	src["Checksums-Sha256"] = strings.Join(sha256sums, "\n")
+	return nil
+}
@@ -58,3 +58,33 @@ func TestLocalSource_Deb(t *testing.T) {
 		assert.NotEmpty(t, deb)
 	})
 }
+
+func TestLocalSource_Sources(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	t.Run("no sources found", func(t *testing.T) {
+		t.Parallel()
+		src := dynamic.NewLocalSource(dynamic.LocalConfig{Directory: debianTestDataDir})
+		srcs, _, err := src.Sources(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, srcs)
+	})
+
+	t.Run("sources found", func(t *testing.T) {
+		t.Parallel()
+		src := dynamic.NewLocalSource(dynamic.LocalConfig{Directory: "testdata"})
+		srcs, ts, err := src.Sources(ctx)
+		require.NoError(t, err)
+		assert.False(t, ts.IsZero())
+
+		require.Len(t, srcs["main"], 1)
+		pkg := srcs["main"][0]
+		assert.Equal(t, "hello", pkg["Package"])
+		assert.Equal(t, "pool/main/p/pkg", pkg["Directory"])
+		assert.NotContains(t, pkg, "Source")
+		assert.Contains(t, pkg["Checksums-Sha256"], "e74bbfc9a638b61c14bf4263fbfd0637db77de0bb1d970210bca3b7c5799cdfa 580 hello_1.0.0.tar.xz")
+		assert.Contains(t, pkg["Checksums-Sha256"], " hello_1.0.0.dsc")
+		assert.Contains(t, pkg["Files"], "e388048dc703c06640a9dab8babc2454 580 hello_1.0.0.tar.xz")
+	})
+}
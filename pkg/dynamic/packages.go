@@ -14,3 +14,10 @@ func (pl PackageList) Add(component repo.Component, architecture repo.Architectu
 	}
 	pl[component][architecture] = append(pl[component][architecture], p)
 }
+
+// SourceList are source packages indexed by Component.
+type SourceList map[repo.Component][]debian.Paragraph
+
+func (sl SourceList) Add(component repo.Component, p debian.Paragraph) {
+	sl[component] = append(sl[component], p)
+}
@@ -3,8 +3,10 @@ package dynamic
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"log/slog"
 	"sort"
 	"strings"
@@ -14,7 +16,9 @@ import (
 	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/ProtonMail/go-crypto/openpgp/armor"
 	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
 	"github.com/thepwagner/debcache/pkg/debian"
+	"github.com/thepwagner/debcache/pkg/metrics"
 	"github.com/thepwagner/debcache/pkg/repo"
 )
 
@@ -24,37 +28,92 @@ type PackageSource interface {
 	Deb(ctx context.Context, filename string) ([]byte, error)
 }
 
+// SourcePackageSource is a PackageSource that also provides source packages.
+// Files referenced by the source packages are served by Deb.
+type SourcePackageSource interface {
+	Sources(ctx context.Context) (SourceList, time.Time, error)
+}
+
 // Repo is dynamically generated from a PackageSource.
 type Repo struct {
 	signer *openpgp.Entity
 	src    PackageSource
 	maxAge time.Duration
 
-	mu         sync.RWMutex
+	// suites are the distributions served. Other distributions are not found.
+	suites map[repo.Distribution]Suite
+
+	// rendering serializes renders, which download packages, without blocking reads of the previous render.
+	rendering sync.Mutex
+
+	mu      sync.RWMutex
+	renders map[repo.Distribution]*distRender
+
+	contentsMu sync.Mutex
+	// contents lists the files shipped by each package by its SHA256, so renders only download new packages.
+	contents map[string]*packageContents
+}
+
+// distRender is the latest render of a distribution.
+type distRender struct {
 	renderTime time.Time
 	rendered   *RenderedPackages
 }
 
+// packageContents is the files shipped by a package, and when a render last listed them.
+type packageContents struct {
+	files []string
+	used  time.Time
+}
+
+// contentsRetention is how long the files of a package that is no longer rendered are remembered.
+const contentsRetention = 24 * time.Hour
+
+// contentsDownloads limits the packages a render downloads at once to list their files.
+const contentsDownloads = 4
+
 type RepoConfig struct {
-	SigningConfig  SigningConfig        `yaml:",inline"`
+	SigningConfig SigningConfig `yaml:",inline"`
+	// Suites are the distributions served, other distributions are not found. Defaults to DefaultSuite.
+	Suites         []SuiteConfig        `yaml:"suites"`
 	Files          LocalConfig          `yaml:"files"`
 	GitHubReleases GitHubReleasesConfig `yaml:"github-releases"`
 }
 
 type RenderedPackages struct {
-	inRelease []byte
-	packages  map[repo.Component]map[repo.Architecture][]byte
-	byHash    map[string][]byte
+	// renderTime is when the packages were rendered, which is the modification time of all files.
+	renderTime time.Time
+	inRelease  []byte
+	release    []byte
+	releaseGPG []byte
+	packages   map[repo.Component]map[repo.Architecture][]byte
+	contents   map[repo.Component]map[repo.Architecture][]byte
+	sources    map[repo.Component][]byte
+	byHash     map[string][]byte
 }
 
 var _ repo.Repo = (*Repo)(nil)
 
-func NewRepo(signer *openpgp.Entity, src PackageSource) *Repo {
-	return &Repo{
-		signer: signer,
-		src:    src,
-		maxAge: 5 * time.Minute,
+// DefaultSuite is served with every package, if a Repo is not given suites.
+const DefaultSuite = repo.Distribution("bookworm")
+
+// NewRepo creates a Repo serving suites, or DefaultSuite if no suites are given.
+func NewRepo(signer *openpgp.Entity, src PackageSource, suites ...Suite) *Repo {
+	if len(suites) == 0 {
+		suites = []Suite{{Name: DefaultSuite}}
+	}
+	r := &Repo{
+		signer:   signer,
+		src:      src,
+		maxAge:   5 * time.Minute,
+		suites:   make(map[repo.Distribution]Suite, len(suites)),
+		renders:  map[repo.Distribution]*distRender{},
+		contents: map[string]*packageContents{},
 	}
+	for _, suite := range suites {
+		r.suites[suite.Name] = suite
+	}
+	return r
 }
 
 func RepoFromConfig(ctx context.Context, cfg RepoConfig) (*Repo, error) {
@@ -78,97 +137,245 @@ func RepoFromConfig(ctx context.Context, cfg RepoConfig) (*Repo, error) {
 		return nil, fmt.Errorf("no source configured")
 	}
 
-	return NewRepo(entity, src), nil
+	suites := make([]Suite, 0, len(cfg.Suites))
+	for _, suiteCfg := range cfg.Suites {
+		suite, err := SuiteFromConfig(suiteCfg)
+		if err != nil {
+			return nil, err
+		}
+		suites = append(suites, suite)
+	}
+
+	return NewRepo(entity, src, suites...), nil
+}
+
+func (r *Repo) InRelease(ctx context.Context, dist repo.Distribution) (*repo.Body, error) {
+	rendered, err := r.render(ctx, dist)
+	if err != nil {
+		return nil, err
+	}
+	return repo.NewBody(rendered.inRelease, rendered.renderTime), nil
+}
+
+func (r *Repo) Release(ctx context.Context, dist repo.Distribution) (*repo.Body, error) {
+	rendered, err := r.render(ctx, dist)
+	if err != nil {
+		return nil, err
+	}
+	return repo.NewBody(rendered.release, rendered.renderTime), nil
 }
 
-func (r *Repo) InRelease(ctx context.Context, dist repo.Distribution) ([]byte, error) {
-	if err := r.render(ctx, dist); err != nil {
+func (r *Repo) ReleaseGPG(ctx context.Context, dist repo.Distribution) (*repo.Body, error) {
+	rendered, err := r.render(ctx, dist)
+	if err != nil {
 		return nil, err
 	}
-	return r.rendered.inRelease, nil
+	return repo.NewBody(rendered.releaseGPG, rendered.renderTime), nil
 }
 
-func (r *Repo) Packages(ctx context.Context, dist repo.Distribution, component repo.Component, arch repo.Architecture, compression repo.Compression) ([]byte, error) {
-	if err := r.render(ctx, dist); err != nil {
+func (r *Repo) Packages(ctx context.Context, dist repo.Distribution, component repo.Component, arch repo.Architecture, compression repo.Compression) (*repo.Body, error) {
+	rendered, err := r.render(ctx, dist)
+	if err != nil {
 		return nil, err
 	}
 
-	componentData := r.rendered.packages[component]
-	if componentData == nil {
-		return nil, nil
+	pkgRaw, ok := rendered.packages[component][arch]
+	if !ok {
+		return nil, fmt.Errorf("%w: no packages for %s/%s", repo.ErrNotFound, component, arch)
 	}
-	pkgRaw := componentData[arch]
 
-	return compression.Compress(pkgRaw)
+	b, err := compression.Compress(pkgRaw)
+	if err != nil {
+		return nil, err
+	}
+	return repo.NewBody(b, rendered.renderTime), nil
 }
 
-func (r *Repo) Translations(_ context.Context, _ repo.Distribution, _ repo.Component, _ repo.Language, _ repo.Compression) ([]byte, error) {
-	return nil, fmt.Errorf("translations not supported")
+func (r *Repo) Translations(_ context.Context, _ repo.Distribution, _ repo.Component, _ repo.Language, _ repo.Compression) (*repo.Body, error) {
+	return nil, fmt.Errorf("%w: translations not supported", repo.ErrNotFound)
 }
 
-func (r *Repo) ByHash(ctx context.Context, dist repo.Distribution, _ repo.Component, _ repo.Architecture, digest string) ([]byte, error) {
-	if err := r.render(ctx, dist); err != nil {
+func (r *Repo) Sources(ctx context.Context, dist repo.Distribution, component repo.Component, compression repo.Compression) (*repo.Body, error) {
+	rendered, err := r.render(ctx, dist)
+	if err != nil {
+		return nil, err
+	}
+
+	sourcesRaw, ok := rendered.sources[component]
+	if !ok {
+		return nil, fmt.Errorf("%w: no sources for %s", repo.ErrNotFound, component)
+	}
+
+	b, err := compression.Compress(sourcesRaw)
+	if err != nil {
 		return nil, err
 	}
-	return r.rendered.byHash[digest], nil
+	return repo.NewBody(b, rendered.renderTime), nil
 }
 
-func (r *Repo) Pool(ctx context.Context, filename string) ([]byte, error) {
-	return r.src.Deb(ctx, filename)
+func (r *Repo) Contents(ctx context.Context, dist repo.Distribution, component repo.Component, arch repo.Architecture, compression repo.Compression) (*repo.Body, error) {
+	rendered, err := r.render(ctx, dist)
+	if err != nil {
+		return nil, err
+	}
+
+	contentsRaw, ok := rendered.contents[component][arch]
+	if !ok {
+		return nil, fmt.Errorf("%w: no contents for %s/%s", repo.ErrNotFound, component, arch)
+	}
+
+	b, err := compression.Compress(contentsRaw)
+	if err != nil {
+		return nil, err
+	}
+	return repo.NewBody(b, rendered.renderTime), nil
 }
 
-func (r *Repo) SigningKeyPEM() ([]byte, error) {
-	var buf bytes.Buffer
-	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+func (r *Repo) ByHash(ctx context.Context, dist repo.Distribution, _ repo.Component, _ repo.Architecture, digest string) (*repo.Body, error) {
+	rendered, err := r.render(ctx, dist)
 	if err != nil {
 		return nil, err
 	}
-	if err := r.signer.Serialize(w); err != nil {
+	b, ok := rendered.byHash[digest]
+	if !ok {
+		return nil, fmt.Errorf("%w: digest %s", repo.ErrNotFound, digest)
+	}
+	return repo.NewBody(b, rendered.renderTime), nil
+}
+
+func (r *Repo) Pool(ctx context.Context, filename string) (*repo.Body, error) {
+	if err := repo.CheckPoolFilename(filename); err != nil {
 		return nil, err
 	}
-	if err := w.Close(); err != nil {
+	b, err := r.src.Deb(ctx, filename)
+	if err != nil {
 		return nil, err
+	} else if b == nil {
+		return nil, fmt.Errorf("%w: %s", repo.ErrNotFound, filename)
+	}
+	return repo.NewBody(b, time.Time{}), nil
+}
+
+func (r *Repo) SigningKeyPEM() ([]byte, error) {
+	return repo.ArmorKeyring(openpgp.EntityList{r.signer})
+}
+
+// Render re-renders a distribution immediately, even if the last render is recent or packages appear unchanged.
+func (r *Repo) Render(ctx context.Context, dist repo.Distribution) error {
+	suite, ok := r.suite(dist)
+	if !ok {
+		return fmt.Errorf("%w: unknown suite %q", repo.ErrNotFound, dist)
+	}
+	r.rendering.Lock()
+	defer r.rendering.Unlock()
+
+	r.mu.Lock()
+	if cur, ok := r.renders[dist]; ok {
+		r.renders[dist] = &distRender{rendered: cur.rendered}
 	}
-	return buf.Bytes(), nil
+	r.mu.Unlock()
+	_, err := r.renderLocked(ctx, dist, suite)
+	return err
 }
 
-func (r *Repo) render(ctx context.Context, dist repo.Distribution) error {
+// render returns the packages rendered for a distribution, rendering them if they are older than maxAge.
+func (r *Repo) render(ctx context.Context, dist repo.Distribution) (*RenderedPackages, error) {
+	suite, ok := r.suite(dist)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown suite %q", repo.ErrNotFound, dist)
+	}
+
 	// Fast read lock path:
 	r.mu.RLock()
-	age := time.Since(r.renderTime)
+	cur := r.renders[dist]
 	r.mu.RUnlock()
-	if age < r.maxAge {
-		slog.Debug("skipping render", slog.Duration("age", age))
-		return nil
+	if cur != nil {
+		if age := time.Since(cur.renderTime); age < r.maxAge {
+			slog.Debug("skipping render", slog.Any("dist", dist), slog.Duration("age", age))
+			return cur.rendered, nil
+		}
 	}
 
-	// Slow write lock, avoid concurrent renders:
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	if age := time.Since(r.renderTime); age < r.maxAge {
-		slog.Debug("skipping render", slog.Duration("age", age))
-		return nil
+	// Avoid concurrent renders, serving the previous render while another is in progress:
+	if cur == nil {
+		r.rendering.Lock()
+	} else if !r.rendering.TryLock() {
+		slog.Debug("serving previous render", slog.Any("dist", dist))
+		return cur.rendered, nil
 	}
+	defer r.rendering.Unlock()
+	return r.renderLocked(ctx, dist, suite)
+}
+
+// renderLocked renders the packages of a distribution, unless the last render is recent or packages are unchanged.
+// It must be called with r.rendering held.
+func (r *Repo) renderLocked(ctx context.Context, dist repo.Distribution, suite Suite) (_ *RenderedPackages, err error) {
+	r.mu.RLock()
+	cur := r.renders[dist]
+	r.mu.RUnlock()
+	if cur != nil {
+		if age := time.Since(cur.renderTime); age < r.maxAge {
+			slog.Debug("skipping render", slog.Any("dist", dist), slog.Duration("age", age))
+			return cur.rendered, nil
+		}
+	}
+
+	start := time.Now()
+	result := "rendered"
+	defer func() {
+		if err != nil {
+			result = "error"
+		}
+		repoName := metrics.Repo(ctx)
+		metrics.Renders.WithLabelValues(repoName, result).Inc()
+		metrics.RenderDuration.WithLabelValues(repoName).Observe(time.Since(start).Seconds())
+	}()
 
 	pkgs, pkgTime, err := r.src.Packages(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var srcs SourceList
+	if srcSource, ok := r.src.(SourcePackageSource); ok {
+		var srcTime time.Time
+		srcs, srcTime, err = srcSource.Sources(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if srcTime.After(pkgTime) {
+			pkgTime = srcTime
+		}
 	}
 	// If packages have not changed since the last render, we can skip:
-	if pkgTime.Before(r.renderTime) {
-		slog.Debug("skipping render", slog.Time("pkgTime", pkgTime), slog.Time("renderTime", r.renderTime))
-		r.renderTime = time.Now()
-		return nil
+	if cur != nil && pkgTime.Before(cur.renderTime) {
+		slog.Debug("skipping render", slog.Any("dist", dist), slog.Time("pkgTime", pkgTime), slog.Time("renderTime", cur.renderTime))
+		r.setRender(dist, &distRender{renderTime: start, rendered: cur.rendered})
+		result = "unchanged"
+		return cur.rendered, nil
 	}
 
-	slog.Debug("rendering packages", slog.Int("count", len(pkgs)))
-	r.renderTime = time.Now()
-	rendered, err := r.renderPackages(pkgs, pkgTime, dist)
+	pkgs = suite.filterPackages(pkgs)
+	srcs = suite.filterSources(srcs)
+	slog.Debug("rendering packages", slog.Any("dist", dist), slog.Int("count", len(pkgs)), slog.Int("sources", len(srcs)))
+	rendered, err := r.renderPackages(ctx, pkgs, srcs, pkgTime, dist)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	r.rendered = rendered
-	return nil
+	r.setRender(dist, &distRender{renderTime: start, rendered: rendered})
+	r.pruneContents(start.Add(-contentsRetention))
+	return rendered, nil
+}
+
+func (r *Repo) setRender(dist repo.Distribution, render *distRender) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.renders[dist] = render
+}
+
+// suite returns the configuration for a distribution, if the Repo serves it.
+func (r *Repo) suite(dist repo.Distribution) (Suite, bool) {
+	suite, ok := r.suites[dist]
+	return suite, ok
 }
 
 type inReleaseDigestEntry struct {
@@ -183,15 +390,18 @@ var compressors = []repo.Compression{
 	repo.CompressionXZ,
 }
 
-func (r *Repo) renderPackages(pkgs PackageList, pkgTime time.Time, dist repo.Distribution) (*RenderedPackages, error) {
+func (r *Repo) renderPackages(ctx context.Context, pkgs PackageList, srcs SourceList, pkgTime time.Time, dist repo.Distribution) (*RenderedPackages, error) {
 	// We have three things to index:
 	var components []string
 	var architectures []string
 	var digests []inReleaseDigestEntry
 
 	ret := RenderedPackages{
-		packages: map[repo.Component]map[repo.Architecture][]byte{},
-		byHash:   map[string][]byte{},
+		renderTime: time.Now(),
+		packages:   map[repo.Component]map[repo.Architecture][]byte{},
+		contents:   map[repo.Component]map[repo.Architecture][]byte{},
+		sources:    map[repo.Component][]byte{},
+		byHash:     map[string][]byte{},
 	}
 
 	// If translations WERE supported, they need to be in this index.
@@ -200,6 +410,7 @@ func (r *Repo) renderPackages(pkgs PackageList, pkgTime time.Time, dist repo.Dis
 	for name, component := range pkgs {
 		components = append(components, string(name))
 		renderedComponent := map[repo.Architecture][]byte{}
+		renderedContents := map[repo.Architecture][]byte{}
 
 		for arch, packages := range component {
 			archIndex[arch] = struct{}{}
@@ -223,8 +434,52 @@ func (r *Repo) renderPackages(pkgs PackageList, pkgTime time.Time, dist repo.Dis
 				})
 				ret.byHash[digest] = compressed
 			}
+
+			contentsRaw := r.renderContents(ctx, packages)
+			renderedContents[arch] = contentsRaw
+
+			for _, compressor := range compressors {
+				compressed, err := compressor.Compress(contentsRaw)
+				if err != nil {
+					return nil, err
+				}
+				digest := fmt.Sprintf("%x", sha256.Sum256(compressed))
+				digests = append(digests, inReleaseDigestEntry{
+					Digest: digest,
+					Size:   int64(len(compressed)),
+					Path:   fmt.Sprintf("%s/Contents-%s%s", name, arch, compressor.Extension()),
+				})
+				ret.byHash[digest] = compressed
+			}
 		}
 		ret.packages[name] = renderedComponent
+		ret.contents[name] = renderedContents
+	}
+
+	for name, sources := range srcs {
+		if _, ok := pkgs[name]; !ok {
+			components = append(components, string(name))
+		}
+
+		var sourcesRaw bytes.Buffer
+		if err := debian.WriteControlFile(&sourcesRaw, sources...); err != nil {
+			return nil, err
+		}
+		ret.sources[name] = sourcesRaw.Bytes()
+
+		for _, compressor := range compressors {
+			compressed, err := compressor.Compress(sourcesRaw.Bytes())
+			if err != nil {
+				return nil, err
+			}
+			digest := fmt.Sprintf("%x", sha256.Sum256(compressed))
+			digests = append(digests, inReleaseDigestEntry{
+				Digest: digest,
+				Size:   int64(len(compressed)),
+				Path:   fmt.Sprintf("%s/source/Sources%s", name, compressor.Extension()),
+			})
+			ret.byHash[digest] = compressed
+		}
 	}
 	for arch := range archIndex {
 		architectures = append(architectures, string(arch))
@@ -245,6 +500,7 @@ func (r *Repo) renderPackages(pkgs PackageList, pkgTime time.Time, dist repo.Dis
 		"Acquire-By-Hash": "yes",
 		"Description":     "Debian",
 		"Codename":        dist.String(),
+		"Suite":           dist.String(),
 	}
 	var sha256 strings.Builder
 	for _, digest := range digests {
@@ -252,13 +508,19 @@ func (r *Repo) renderPackages(pkgs PackageList, pkgTime time.Time, dist repo.Dis
 	}
 	release["SHA256"] = sha256.String()
 
-	// Sign the release:
+	var releaseRaw bytes.Buffer
+	if err := debian.WriteControlFile(&releaseRaw, release); err != nil {
+		return nil, err
+	}
+	ret.release = releaseRaw.Bytes()
+
+	// Sign the release, inline for InRelease:
 	var inRelease bytes.Buffer
 	enc, err := clearsign.Encode(&inRelease, r.signer.PrivateKey, nil)
 	if err != nil {
 		return nil, err
 	}
-	if err := debian.WriteControlFile(enc, release); err != nil {
+	if _, err := enc.Write(ret.release); err != nil {
 		return nil, err
 	}
 	if err := enc.Close(); err != nil {
@@ -267,7 +529,136 @@ func (r *Repo) renderPackages(pkgs PackageList, pkgTime time.Time, dist repo.Dis
 	if _, err = fmt.Fprintln(&inRelease); err != nil {
 		return nil, err
 	}
-
 	ret.inRelease = inRelease.Bytes()
+
+	// And detached for Release.gpg:
+	var releaseGPG bytes.Buffer
+	if err := detachSign(&releaseGPG, r.signer.PrivateKey, ret.release); err != nil {
+		return nil, err
+	}
+	ret.releaseGPG = releaseGPG.Bytes()
+
 	return &ret, nil
 }
+
+// renderContents indexes the files shipped by packages, in the format of a Contents-<arch> file.
+// Packages that can't be fetched from the source or listed are left out of the index, so they don't fail the render.
+func (r *Repo) renderContents(ctx context.Context, packages []debian.Paragraph) []byte {
+	listed := make([][]string, len(packages))
+	downloads := make(chan struct{}, contentsDownloads)
+	var wg sync.WaitGroup
+	for i, pkg := range packages {
+		downloads <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-downloads
+				wg.Done()
+			}()
+			listed[i] = r.packageFiles(ctx, pkg)
+		}()
+	}
+	wg.Wait()
+
+	locations := map[string][]string{}
+	for i, pkg := range packages {
+		location := pkg["Package"]
+		if section := pkg["Section"]; section != "" {
+			location = section + "/" + location
+		}
+		for _, file := range listed[i] {
+			locations[file] = append(locations[file], location)
+		}
+	}
+
+	paths := make([]string, 0, len(locations))
+	for path := range locations {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	for _, path := range paths {
+		sort.Strings(locations[path])
+		fmt.Fprintf(&buf, "%s %s\n", path, strings.Join(locations[path], ","))
+	}
+	return buf.Bytes()
+}
+
+// packageFiles lists the files shipped by a package, fetching it from the source unless a previous render listed it.
+// It returns nil if the package can't be fetched or listed.
+func (r *Repo) packageFiles(ctx context.Context, pkg debian.Paragraph) []string {
+	digest := pkg["SHA256"]
+	r.contentsMu.Lock()
+	if cached, ok := r.contents[digest]; ok && digest != "" {
+		cached.used = time.Now()
+		r.contentsMu.Unlock()
+		return cached.files
+	}
+	r.contentsMu.Unlock()
+
+	filename := strings.TrimPrefix(pkg["Filename"], "pool/")
+	deb, err := r.src.Deb(ctx, filename)
+	if err != nil {
+		slog.Warn("error fetching package for contents", slog.String("filename", filename), slog.String("error", err.Error()))
+		return nil
+	} else if deb == nil {
+		slog.Debug("package not available for contents", slog.String("filename", filename))
+		return nil
+	}
+	files, err := debian.FilesFromDeb(bytes.NewReader(deb))
+	if err != nil {
+		slog.Warn("error listing files in package", slog.String("filename", filename), slog.String("error", err.Error()))
+		return nil
+	}
+
+	if digest != "" {
+		r.contentsMu.Lock()
+		r.contents[digest] = &packageContents{files: files, used: time.Now()}
+		r.contentsMu.Unlock()
+	}
+	return files
+}
+
+// pruneContents forgets the files of packages that no render listed since before.
+func (r *Repo) pruneContents(before time.Time) {
+	r.contentsMu.Lock()
+	defer r.contentsMu.Unlock()
+	for digest, cached := range r.contents {
+		if cached.used.Before(before) {
+			delete(r.contents, digest)
+		}
+	}
+}
+
+// detachSign writes an armored signature of message, using the same key as clearsign.Encode.
+func detachSign(out io.Writer, key *packet.PrivateKey, message []byte) error {
+	sig := &packet.Signature{
+		Version:           key.Version,
+		SigType:           packet.SigTypeBinary,
+		PubKeyAlgo:        key.PubKeyAlgo,
+		Hash:              crypto.SHA256,
+		CreationTime:      time.Now(),
+		IssuerKeyId:       &key.KeyId,
+		IssuerFingerprint: key.Fingerprint,
+	}
+	h, err := sig.PrepareSign(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := h.Write(message); err != nil {
+		return err
+	}
+	if err := sig.Sign(h, key, nil); err != nil {
+		return err
+	}
+
+	w, err := armor.Encode(out, "PGP SIGNATURE", nil)
+	if err != nil {
+		return err
+	}
+	if err := sig.Serialize(w); err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -1,14 +1,25 @@
 package dynamic_test
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"io"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/debcache/pkg/debian"
 	"github.com/thepwagner/debcache/pkg/dynamic"
 	"github.com/thepwagner/debcache/pkg/repo"
 )
@@ -54,7 +65,7 @@ func TestRepo(t *testing.T) {
 		rel, err := r.InRelease(ctx, dist)
 		require.NoError(t, err)
 
-		inRelease := string(rel)
+		inRelease := string(readBody(t, rel))
 		t.Log(inRelease)
 		assert.Contains(t, inRelease, "-----BEGIN PGP SIGNED MESSAGE-----\n")
 		assert.Contains(t, inRelease, "\n-----BEGIN PGP SIGNATURE-----\n")
@@ -65,6 +76,36 @@ func TestRepo(t *testing.T) {
 		assert.Contains(t, inRelease, "cc2e941ff9f66e98d23268a249eda3384e6d514a903746e77c8f260f4ca71fa6  49 main/binary-arm64/Packages")
 	})
 
+	t.Run("Release", func(t *testing.T) {
+		t.Parallel()
+		rel, err := r.Release(ctx, dist)
+		require.NoError(t, err)
+		release := readBody(t, rel)
+		assert.Contains(t, string(release), "Codename: bookworm\n")
+		assert.NotContains(t, string(release), "-----BEGIN PGP SIGNED MESSAGE-----")
+
+		sig, err := r.ReleaseGPG(ctx, dist)
+		require.NoError(t, err)
+		// The test key has expired, so verify the signature packet directly:
+		block, err := armor.Decode(bytes.NewReader(readBody(t, sig)))
+		require.NoError(t, err)
+		pkt, err := packet.Read(block.Body)
+		require.NoError(t, err)
+		signature, ok := pkt.(*packet.Signature)
+		require.True(t, ok)
+		h, err := signature.PrepareVerify()
+		require.NoError(t, err)
+		_, _ = h.Write(release)
+		require.NoError(t, testKey(t).PrimaryKey.VerifySignature(h, signature))
+
+		// InRelease signs the same content:
+		in, err := r.InRelease(ctx, dist)
+		require.NoError(t, err)
+		signed, _ := clearsign.Decode(readBody(t, in))
+		require.NotNil(t, signed)
+		assert.Equal(t, strings.TrimSpace(string(release)), strings.TrimSpace(string(signed.Plaintext)))
+	})
+
 	t.Run("caching rendered packages list", func(t *testing.T) {
 		t.Parallel()
 		_, err := r.InRelease(ctx, dist)
@@ -77,8 +118,9 @@ func TestRepo(t *testing.T) {
 		t.Parallel()
 
 		for _, arch := range []repo.Architecture{"amd64", "arm64"} {
-			pkgs, err := r.Packages(ctx, dist, "main", arch, repo.CompressionNone)
+			body, err := r.Packages(ctx, dist, "main", arch, repo.CompressionNone)
 			require.NoError(t, err)
+			pkgs := readBody(t, body)
 
 			packages := string(pkgs)
 			t.Log(packages)
@@ -94,6 +136,284 @@ func TestRepo(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("not found", func(t *testing.T) {
+		t.Parallel()
+		_, err := r.Packages(ctx, dist, "non-free", "arm64", repo.CompressionNone)
+		require.ErrorIs(t, err, repo.ErrNotFound)
+		_, err = r.ByHash(ctx, dist, "main", "amd64", "abc123")
+		require.ErrorIs(t, err, repo.ErrNotFound)
+		_, err = r.Translations(ctx, dist, "main", "en", repo.CompressionNone)
+		require.ErrorIs(t, err, repo.ErrNotFound)
+	})
+
+	t.Run("Pool rejects traversal", func(t *testing.T) {
+		t.Parallel()
+		_, err := r.Pool(ctx, "../../etc/passwd")
+		require.ErrorIs(t, err, repo.ErrBadRequest)
+	})
+}
+
+func TestRepo_Contents(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	const dist = "bookworm"
+	r := dynamic.NewRepo(testKey(t), dynamic.NewLocalSource(dynamic.LocalConfig{Directory: "testdata"}))
+
+	body, err := r.Contents(ctx, dist, "main", "amd64", repo.CompressionNone)
+	require.NoError(t, err)
+	contents := readBody(t, body)
+	assert.Equal(t, "usr/bin/hello utils/hello\nusr/bin/hi utils/hello\nusr/share/doc/hello/README utils/hello\n", string(contents))
+
+	// Contents are listed in InRelease, and available by hash:
+	in, err := r.InRelease(ctx, dist)
+	require.NoError(t, err)
+	digest := fmt.Sprintf("%x", sha256.Sum256(contents))
+	assert.Contains(t, string(readBody(t, in)), fmt.Sprintf("%s  %d main/Contents-amd64\n", digest, len(contents)))
+	byHash, err := r.ByHash(ctx, dist, "main", "", digest)
+	require.NoError(t, err)
+	assert.Equal(t, contents, readBody(t, byHash))
+
+	_, err = r.Contents(ctx, dist, "main", "arm64", repo.CompressionNone)
+	require.ErrorIs(t, err, repo.ErrNotFound)
+}
+
+func TestRepo_ContentsCached(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	const dist = "bookworm"
+	deb, err := os.ReadFile("testdata/hello_1.0.0_amd64.deb")
+	require.NoError(t, err)
+	src := &debSource{
+		TestSource: TestSource{pkgs: dynamic.PackageList{"main": {"amd64": {
+			{"Package": "hello", "Filename": "pool/main/h/hello.deb", "SHA256": "abc"},
+			{"Package": "broken", "Filename": "pool/main/b/broken.deb", "SHA256": "def"},
+		}}}},
+		debs: map[string][]byte{"main/h/hello.deb": deb},
+	}
+	r := dynamic.NewRepo(testKey(t), src)
+
+	// Packages that can't be fetched are left out, without failing the render:
+	for i := 0; i < 2; i++ {
+		require.NoError(t, r.Render(ctx, dist))
+		body, err := r.Contents(ctx, dist, "main", "amd64", repo.CompressionNone)
+		require.NoError(t, err)
+		assert.Equal(t, "usr/bin/hello hello\nusr/bin/hi hello\nusr/share/doc/hello/README hello\n", string(readBody(t, body)))
+	}
+	// Listed packages are not fetched again, the one that failed is retried:
+	assert.Equal(t, map[string]int{"main/h/hello.deb": 1, "main/b/broken.deb": 2}, src.fetched())
+}
+
+func TestRepo_RenderServesPrevious(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	const dist = "bookworm"
+	deb, err := os.ReadFile("testdata/hello_1.0.0_amd64.deb")
+	require.NoError(t, err)
+	src := &debSource{
+		TestSource: TestSource{pkgs: dynamic.PackageList{"main": {"amd64": {
+			{"Package": "hello", "Filename": "pool/main/h/hello.deb", "SHA256": "abc"},
+		}}}},
+		debs: map[string][]byte{"main/h/hello.deb": deb},
+	}
+	r := dynamic.NewRepo(testKey(t), src)
+	body, err := r.InRelease(ctx, dist)
+	require.NoError(t, err)
+	previous := readBody(t, body)
+
+	// A render that downloads a new package doesn't block reads, which are served the previous render:
+	src.pkgs = dynamic.PackageList{"main": {"amd64": {
+		{"Package": "hello", "Filename": "pool/main/h/hello.deb", "SHA256": "def"},
+	}}}
+	src.block = make(chan struct{})
+	rendered := make(chan error, 1)
+	go func() {
+		rendered <- r.Render(ctx, dist)
+	}()
+	assert.Eventually(t, func() bool {
+		return src.fetched()["main/h/hello.deb"] == 2
+	}, time.Second, 10*time.Millisecond)
+	body, err = r.InRelease(ctx, dist)
+	require.NoError(t, err)
+	assert.Equal(t, previous, readBody(t, body))
+
+	close(src.block)
+	require.NoError(t, <-rendered)
+	body, err = r.InRelease(ctx, dist)
+	require.NoError(t, err)
+	assert.NotEqual(t, previous, readBody(t, body))
+}
+
+func TestRepo_Sources(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	const dist = "bookworm"
+	r := dynamic.NewRepo(testKey(t), dynamic.NewLocalSource(dynamic.LocalConfig{Directory: "testdata"}))
+
+	body, err := r.Sources(ctx, dist, "main", repo.CompressionNone)
+	require.NoError(t, err)
+	sources := readBody(t, body)
+	assert.Contains(t, string(sources), "Package: hello\n")
+	assert.Contains(t, string(sources), "Directory: pool/main/p/pkg\n")
+
+	// Sources are listed in InRelease, and available by hash:
+	in, err := r.InRelease(ctx, dist)
+	require.NoError(t, err)
+	digest := fmt.Sprintf("%x", sha256.Sum256(sources))
+	assert.Contains(t, string(readBody(t, in)), fmt.Sprintf("%s  %d main/source/Sources\n", digest, len(sources)))
+	byHash, err := r.ByHash(ctx, dist, "main", repo.ArchitectureSource, digest)
+	require.NoError(t, err)
+	assert.Equal(t, sources, readBody(t, byHash))
+
+	// Referenced files are served from the pool:
+	for _, fn := range []string{"hello_1.0.0.dsc", "hello_1.0.0.tar.xz"} {
+		body, err := r.Pool(ctx, "main/p/pkg/"+fn)
+		require.NoError(t, err)
+		assert.NotEmpty(t, readBody(t, body))
+	}
+
+	_, err = r.Sources(ctx, dist, "contrib", repo.CompressionNone)
+	require.ErrorIs(t, err, repo.ErrNotFound)
+}
+
+func TestRepo_Distributions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	r := dynamic.NewRepo(testKey(t), TestSource{}, dynamic.Suite{Name: "bookworm"}, dynamic.Suite{Name: "trixie"})
+
+	for _, dist := range []repo.Distribution{"bookworm", "trixie"} {
+		body, err := r.Release(ctx, dist)
+		require.NoError(t, err)
+		assert.Contains(t, string(readBody(t, body)), fmt.Sprintf("Codename: %s\n", dist))
+	}
+
+	// Without suites, only the default suite is served:
+	r = dynamic.NewRepo(testKey(t), TestSource{})
+	body, err := r.Release(ctx, dynamic.DefaultSuite)
+	require.NoError(t, err)
+	assert.Contains(t, string(readBody(t, body)), fmt.Sprintf("Codename: %s\n", dynamic.DefaultSuite))
+	_, err = r.InRelease(ctx, "trixie")
+	require.ErrorIs(t, err, repo.ErrNotFound)
+}
+
+func TestRepo_Suites(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	stable, err := dynamic.SuiteFromConfig(dynamic.SuiteConfig{Name: "stable", Version: `^[0-9.]+$`})
+	require.NoError(t, err)
+	r := dynamic.NewRepo(testKey(t), TestSource{
+		pkgs: dynamic.PackageList{
+			"main": {
+				"amd64": {
+					{"Package": "test", "Version": "1.0.0", "Architecture": "amd64"},
+					{"Package": "test", "Version": "1.1.0~rc1", "Architecture": "amd64"},
+				},
+			},
+		},
+	}, dynamic.Suite{Name: "unstable"}, stable)
+
+	for dist, expected := range map[repo.Distribution][]string{
+		"unstable": {"1.0.0", "1.1.0~rc1"},
+		"stable":   {"1.0.0"},
+	} {
+		rel, err := r.Release(ctx, dist)
+		require.NoError(t, err)
+		assert.Contains(t, string(readBody(t, rel)), fmt.Sprintf("Suite: %s\n", dist))
+
+		body, err := r.Packages(ctx, dist, "main", "amd64", repo.CompressionNone)
+		require.NoError(t, err)
+		pkgs, err := debian.ParseControlFile(bytes.NewReader(readBody(t, body)))
+		require.NoError(t, err)
+		versions := make([]string, 0, len(pkgs))
+		for _, pkg := range pkgs {
+			versions = append(versions, pkg["Version"])
+		}
+		assert.Equal(t, expected, versions, dist)
+	}
+
+	_, err = r.InRelease(ctx, "bookworm")
+	require.ErrorIs(t, err, repo.ErrNotFound)
+	require.ErrorIs(t, r.Render(ctx, "bookworm"), repo.ErrNotFound)
+}
+
+func TestSuiteFromConfig(t *testing.T) {
+	t.Parallel()
+
+	_, err := dynamic.SuiteFromConfig(dynamic.SuiteConfig{})
+	require.Error(t, err)
+	_, err = dynamic.SuiteFromConfig(dynamic.SuiteConfig{Name: "stable", Version: "("})
+	require.Error(t, err)
+}
+
+func TestRepo_Render(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	const dist = "bookworm"
+	src := &countingSource{}
+	r := dynamic.NewRepo(testKey(t), src)
+
+	for i := 0; i < 2; i++ {
+		_, err := r.InRelease(ctx, dist)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), src.calls.Load())
+
+	// Forced renders bypass the max age:
+	require.NoError(t, r.Render(ctx, dist))
+	assert.Equal(t, int32(2), src.calls.Load())
+}
+
+type debSource struct {
+	TestSource
+	debs map[string][]byte
+	// block holds downloads until it is closed, if set.
+	block chan struct{}
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (d *debSource) Deb(_ context.Context, filename string) ([]byte, error) {
+	d.mu.Lock()
+	if d.calls == nil {
+		d.calls = map[string]int{}
+	}
+	d.calls[filename]++
+	d.mu.Unlock()
+
+	if d.block != nil {
+		<-d.block
+	}
+	if b, ok := d.debs[filename]; ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("%w: %s", repo.ErrUpstreamUnavailable, filename)
+}
+
+func (d *debSource) fetched() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return maps.Clone(d.calls)
+}
+
+type countingSource struct {
+	TestSource
+	calls atomic.Int32
+}
+
+func (c *countingSource) Packages(ctx context.Context) (dynamic.PackageList, time.Time, error) {
+	c.calls.Add(1)
+	return c.TestSource.Packages(ctx)
+}
+
+func readBody(tb testing.TB, body *repo.Body) []byte {
+	tb.Helper()
+	require.NotNil(tb, body)
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	require.NoError(tb, err)
+	return b
 }
 
 type TestSource struct {
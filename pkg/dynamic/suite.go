@@ -0,0 +1,81 @@
+package dynamic
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/thepwagner/debcache/pkg/debian"
+	"github.com/thepwagner/debcache/pkg/repo"
+)
+
+// Suite is a distribution served by a Repo, optionally with a subset of the source's packages.
+type Suite struct {
+	Name repo.Distribution
+	// Version, if set, must match the version of every package in the suite.
+	Version *regexp.Regexp
+	// Packages, if set, limits the suite to packages with these names.
+	Packages []string
+}
+
+type SuiteConfig struct {
+	Name string `yaml:"name"`
+	// Version is a regular expression, e.g. `^[0-9.]+$` to only include tagged releases.
+	Version  string   `yaml:"version"`
+	Packages []string `yaml:"packages"`
+}
+
+func SuiteFromConfig(cfg SuiteConfig) (Suite, error) {
+	if cfg.Name == "" {
+		return Suite{}, fmt.Errorf("suite name is required")
+	}
+	suite := Suite{
+		Name:     repo.Distribution(cfg.Name),
+		Packages: cfg.Packages,
+	}
+	if cfg.Version != "" {
+		re, err := regexp.Compile(cfg.Version)
+		if err != nil {
+			return Suite{}, fmt.Errorf("parsing version of suite %q: %w", cfg.Name, err)
+		}
+		suite.Version = re
+	}
+	return suite, nil
+}
+
+// includes reports whether a package or source package belongs in the suite.
+func (s Suite) includes(pkg debian.Paragraph) bool {
+	if len(s.Packages) > 0 && !slices.Contains(s.Packages, pkg["Package"]) {
+		return false
+	}
+	if s.Version != nil && !s.Version.MatchString(pkg["Version"]) {
+		return false
+	}
+	return true
+}
+
+func (s Suite) filterPackages(pkgs PackageList) PackageList {
+	ret := PackageList{}
+	for component, arches := range pkgs {
+		for arch, packages := range arches {
+			for _, pkg := range packages {
+				if s.includes(pkg) {
+					ret.Add(component, arch, pkg)
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func (s Suite) filterSources(srcs SourceList) SourceList {
+	ret := SourceList{}
+	for component, sources := range srcs {
+		for _, src := range sources {
+			if s.includes(src) {
+				ret.Add(component, src)
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,110 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Config customizes an HTTP client. The zero value behaves like http.DefaultClient.
+type Config struct {
+	// ConnectTimeout limits establishing a connection, including the TLS handshake.
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	// ResponseTimeout limits waiting for response headers after sending a request. The body may take longer.
+	ResponseTimeout time.Duration `yaml:"responseTimeout"`
+
+	// Retries is how many times idempotent requests are retried after a network error or server error.
+	Retries int `yaml:"retries"`
+	// RetryBackoff is the delay before the first retry, doubled for each retry after. Defaults to 500ms.
+	RetryBackoff time.Duration `yaml:"retryBackoff"`
+
+	// Proxy is the URL of an HTTP(S) proxy. Defaults to the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	Proxy string `yaml:"proxy"`
+
+	// CAFile is a PEM bundle of certificate authorities trusted in addition to the system's.
+	CAFile string `yaml:"caFile"`
+	// CertFile and KeyFile are a PEM certificate and key presented to servers that request client certificates.
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+const (
+	defaultRetryBackoff = 500 * time.Millisecond
+	maxRetryBackoff     = 30 * time.Second
+)
+
+// New returns a client configured by cfg.
+func New(cfg Config) (*http.Client, error) {
+	transport, err := newTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: Retry(transport, cfg.Retries, cfg.RetryBackoff)}, nil
+}
+
+func newTransport(cfg Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.ConnectTimeout > 0 {
+		dialer := &net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = cfg.ConnectTimeout
+	}
+	transport.ResponseHeaderTimeout = cfg.ResponseTimeout
+
+	if cfg.Proxy != "" {
+		proxy, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("parsing proxy URL: %w", err)
+		}
+		slog.Debug("using proxy", slog.String("proxy", proxy.Redacted()))
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if cfg.CAFile != "" || cfg.CertFile != "" || cfg.KeyFile != "" {
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return transport, nil
+}
+
+func newTLSConfig(cfg Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			slog.Warn("system certificates unavailable", slog.String("error", err.Error()))
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %q", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, fmt.Errorf("certFile and keyFile must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
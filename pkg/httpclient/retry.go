@@ -0,0 +1,74 @@
+package httpclient
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Retry retries idempotent requests after network errors and server errors, with exponential backoff.
+// If retries is zero, next is returned unchanged.
+func Retry(next http.RoundTripper, retries int, backoff time.Duration) http.RoundTripper {
+	if retries <= 0 {
+		return next
+	}
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	return &retryTransport{next: next, retries: retries, backoff: backoff}
+}
+
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+	backoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !idempotent(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx := req.Context()
+	backoff := t.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if attempt == t.retries || !retryable(resp, err) || ctx.Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		slog.Debug("retrying request",
+			slog.String("url", req.URL.Redacted()),
+			slog.Int("attempt", attempt+1),
+			slog.Duration("backoff", backoff),
+		)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+// idempotent reports whether a request can be safely sent again.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return req.Body == nil || req.Body == http.NoBody
+	default:
+		return false
+	}
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics for cache and upstream behaviour.
+// Most are labeled with the repo that is handling the request, see WithRepo.
+var (
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "debcache",
+		Subsystem: "cache",
+		Name:      "requests_total",
+		Help:      "Cache lookups, by result (hit or miss).",
+	}, []string{"repo", "namespace", "result"})
+
+	BytesServed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "debcache",
+		Subsystem: "http",
+		Name:      "response_bytes_total",
+		Help:      "Bytes written in responses to clients.",
+	}, []string{"repo"})
+
+	UpstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "debcache",
+		Subsystem: "upstream",
+		Name:      "request_duration_seconds",
+		Help:      "Time until upstream responded with headers.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"repo"})
+
+	UpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "debcache",
+		Subsystem: "upstream",
+		Name:      "errors_total",
+		Help:      "Upstream requests that failed, by status code (0 if there was no response).",
+	}, []string{"repo", "status"})
+
+	RenderDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "debcache",
+		Subsystem: "dynamic",
+		Name:      "render_duration_seconds",
+		Help:      "Time spent rendering dynamic repositories.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"repo"})
+
+	Renders = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "debcache",
+		Subsystem: "dynamic",
+		Name:      "renders_total",
+		Help:      "Dynamic repository renders, by result (rendered, unchanged or error).",
+	}, []string{"repo", "result"})
+
+	GitHubRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "debcache",
+		Subsystem: "github",
+		Name:      "requests_total",
+		Help:      "GitHub API calls, by status code.",
+	}, []string{"repo", "status"})
+
+	GitHubRateLimitRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "debcache",
+		Subsystem: "github",
+		Name:      "rate_limit_remaining",
+		Help:      "Remaining GitHub API requests in the current rate limit window.",
+	}, []string{"repo"})
+
+	storageBytes = prometheus.NewDesc(
+		"debcache_storage_bytes",
+		"Size of cached content.",
+		[]string{"repo"}, nil,
+	)
+	storages = &storageCollector{sizers: map[string]Sizer{}}
+)
+
+func init() {
+	prometheus.MustRegister(storages)
+}
+
+type repoKey struct{}
+
+// WithRepo labels metrics recorded with ctx by the repo name.
+func WithRepo(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, repoKey{}, name)
+}
+
+// Repo returns the repo name from WithRepo, or empty.
+func Repo(ctx context.Context) string {
+	name, _ := ctx.Value(repoKey{}).(string)
+	return name
+}
+
+// Sizer reports the size of cached content.
+type Sizer interface {
+	Size(ctx context.Context) (int64, error)
+}
+
+// RegisterStorage reports the size of a repo's storage when metrics are collected.
+// Registering the same repo again replaces the previous storage.
+func RegisterStorage(repo string, sizer Sizer) {
+	storages.mu.Lock()
+	defer storages.mu.Unlock()
+	storages.sizers[repo] = sizer
+}
+
+type storageCollector struct {
+	mu     sync.Mutex
+	sizers map[string]Sizer
+}
+
+func (c *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storageBytes
+}
+
+func (c *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for repo, sizer := range c.sizers {
+		size, err := sizer.Size(context.Background())
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(storageBytes, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(storageBytes, prometheus.GaugeValue, float64(size), repo)
+	}
+}
+
+// GitHubTransport counts GitHub API calls and tracks the rate limit from their responses.
+func GitHubTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		repo := Repo(req.Context())
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			GitHubRequests.WithLabelValues(repo, "0").Inc()
+			return nil, err
+		}
+		GitHubRequests.WithLabelValues(repo, strconv.Itoa(resp.StatusCode)).Inc()
+		if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+			GitHubRateLimitRemaining.WithLabelValues(repo).Set(float64(remaining))
+		}
+		return resp, nil
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
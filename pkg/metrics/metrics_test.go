@@ -0,0 +1,33 @@
+package metrics_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/debcache/pkg/metrics"
+)
+
+func TestGitHubTransport(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx := metrics.WithRepo(context.Background(), "github-transport")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	client := &http.Client{Transport: metrics.GitHubTransport(nil)}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	assert.InDelta(t, 1, testutil.ToFloat64(metrics.GitHubRequests.WithLabelValues("github-transport", "200")), 0)
+	assert.InDelta(t, 4999, testutil.ToFloat64(metrics.GitHubRateLimitRemaining.WithLabelValues("github-transport")), 0)
+}
@@ -0,0 +1,63 @@
+package repo
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/thepwagner/debcache/pkg/secret"
+)
+
+// UpstreamAuthConfig authenticates requests to every mirror of an upstream.
+// Secrets with an `env.` prefix are read from the environment, and with a `file.` prefix from a file.
+type UpstreamAuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Token is sent as a bearer token.
+	Token   string            `yaml:"token"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+type upstreamAuth struct {
+	username, password string
+	token              string
+	headers            http.Header
+}
+
+func newUpstreamAuth(cfg UpstreamAuthConfig) (upstreamAuth, error) {
+	if cfg.Token != "" && (cfg.Username != "" || cfg.Password != "") {
+		return upstreamAuth{}, fmt.Errorf("auth token and username/password are mutually exclusive")
+	}
+
+	var auth upstreamAuth
+	var err error
+	if auth.username, err = secret.Value(cfg.Username); err != nil {
+		return upstreamAuth{}, fmt.Errorf("auth username: %w", err)
+	}
+	if auth.password, err = secret.Value(cfg.Password); err != nil {
+		return upstreamAuth{}, fmt.Errorf("auth password: %w", err)
+	}
+	if auth.token, err = secret.Value(cfg.Token); err != nil {
+		return upstreamAuth{}, fmt.Errorf("auth token: %w", err)
+	}
+	auth.headers = make(http.Header, len(cfg.Headers))
+	for k, v := range cfg.Headers {
+		value, err := secret.Value(v)
+		if err != nil {
+			return upstreamAuth{}, fmt.Errorf("auth header %q: %w", k, err)
+		}
+		auth.headers.Set(k, value)
+	}
+	return auth, nil
+}
+
+func (a upstreamAuth) apply(req *http.Request) {
+	for k, v := range a.headers {
+		req.Header[k] = v
+	}
+	switch {
+	case a.token != "":
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	case a.username != "" || a.password != "":
+		req.SetBasicAuth(a.username, a.password)
+	}
+}
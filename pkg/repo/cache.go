@@ -2,16 +2,51 @@ package repo
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/thepwagner/debcache/pkg/cache"
+	"github.com/thepwagner/debcache/pkg/metrics"
 )
 
 // Cache wraps a Repo with a cache.
 type Cache struct {
 	Source  Repo
 	Storage cache.Storage
+	// StaleIfError is how long after it expired a value is still served when the source fails. Zero disables it.
+	// Storage that evicts expired values, like cache.LRUStorage, has nothing stale to serve.
+	StaleIfError time.Duration
+	// Offline serves cached values, expired or not, and never contacts the source.
+	Offline bool
+	// SoftTTL is the age after which cached indexes are refreshed in the background, while the cached value is served.
+	// It should be shorter than the storage's TTL. Zero disables it.
+	SoftTTL time.Duration
+	// RefreshRecent is how long after an index was last requested it is refreshed in the background,
+	// when a SoftTTL refresh finds a new InRelease for its dist. Zero disables it.
+	RefreshRecent time.Duration
+
+	// Content stores pool files by their SHA256 digest, so caches sharing its cache.ContentStore store each file once.
+	// Files listed by a cached Packages index are linked from another cache's copy, instead of fetched again.
+	Content *cache.ContentStorage
+
+	inflight *inflight
+	recent   *recentIndexes
+	digests  *poolDigests
+}
+
+type CacheConfig struct {
+	StaleIfError  time.Duration       `yaml:"staleIfError"`
+	Offline       bool                `yaml:"offline"`
+	SoftTTL       time.Duration       `yaml:"softTTL"`
+	RefreshRecent time.Duration       `yaml:"refreshRecent"`
+	Content       cache.ContentConfig `yaml:"content"`
 }
 
 var _ Repo = (*Cache)(nil)
@@ -21,124 +56,474 @@ const (
 	packages     = cache.Namespace("packages")
 	byHash       = cache.Namespace("by-hash")
 	pool         = cache.Namespace("pool")
+	sourcePool   = cache.Namespace("source-pool")
 	translations = cache.Namespace("translations")
+	contents     = cache.Namespace("contents")
+	sources      = cache.Namespace("sources")
 )
 
 func NewCache(src Repo, storage cache.Storage) *Cache {
 	return &Cache{
-		Source:  src,
-		Storage: storage,
+		Source:   src,
+		Storage:  storage,
+		inflight: newInflight(),
+		recent:   newRecentIndexes(),
+		digests:  newPoolDigests(),
 	}
 }
 
-func (c Cache) InRelease(ctx context.Context, dist Distribution) ([]byte, error) {
+func (c Cache) InRelease(ctx context.Context, dist Distribution) (*Body, error) {
 	key := releases.Key(dist.String())
-	v, ok := c.Storage.Get(ctx, key)
-	slog.Debug("cached InRelease",
-		slog.String("request_id", middleware.GetReqID(ctx)),
-		slog.Any("dist", dist),
-		slog.Bool("cache_hit", ok),
-	)
-	if ok {
-		return v, nil
-	}
+	return c.get(ctx, dist, key, func(ctx context.Context) (*Body, error) {
+		return c.Source.InRelease(ctx, dist)
+	}, "cached InRelease", slog.Any("dist", dist))
+}
 
-	v, err := c.Source.InRelease(ctx, dist)
-	if err != nil {
-		return nil, err
-	}
-	c.Storage.Add(ctx, key, v)
-	return v, nil
+func (c Cache) Release(ctx context.Context, dist Distribution) (*Body, error) {
+	key := releases.Key(dist.String(), "Release")
+	return c.get(ctx, dist, key, func(ctx context.Context) (*Body, error) {
+		return c.Source.Release(ctx, dist)
+	}, "cached Release", slog.Any("dist", dist))
+}
+
+func (c Cache) ReleaseGPG(ctx context.Context, dist Distribution) (*Body, error) {
+	key := releases.Key(dist.String(), "Release.gpg")
+	return c.get(ctx, dist, key, func(ctx context.Context) (*Body, error) {
+		return c.Source.ReleaseGPG(ctx, dist)
+	}, "cached ReleaseGPG", slog.Any("dist", dist))
 }
 
-func (c Cache) Packages(ctx context.Context, dist Distribution, component Component, arch Architecture, compression Compression) ([]byte, error) {
+func (c Cache) Packages(ctx context.Context, dist Distribution, component Component, arch Architecture, compression Compression) (*Body, error) {
 	key := packages.Key(dist.String(), component.String(), arch.String(), compression.String())
-	v, ok := c.Storage.Get(ctx, key)
-	slog.Debug("cached Packages",
-		slog.String("request_id", middleware.GetReqID(ctx)),
+	fetch := func(ctx context.Context) (*Body, error) {
+		return c.Source.Packages(ctx, dist, component, arch, compression)
+	}
+	c.track(dist, key, fetch)
+	return c.get(ctx, dist, key, fetch, "cached Packages",
 		slog.Any("dist", dist),
 		slog.Any("component", component),
 		slog.Any("arch", arch),
 		slog.String("compression", string(compression)),
-		slog.Bool("cache_hit", ok),
 	)
-	if ok {
-		return v, nil
-	}
-
-	v, err := c.Source.Packages(ctx, dist, component, arch, compression)
-	if err != nil {
-		return nil, err
-	}
-	c.Storage.Add(ctx, key, v)
-	return v, nil
 }
-func (c Cache) Translations(ctx context.Context, dist Distribution, component Component, lang Language, compression Compression) ([]byte, error) {
+
+func (c Cache) Translations(ctx context.Context, dist Distribution, component Component, lang Language, compression Compression) (*Body, error) {
 	key := translations.Key(dist.String(), component.String(), lang.String(), compression.String())
-	v, ok := c.Storage.Get(ctx, key)
-	slog.Debug("cached Translations",
-		slog.String("request_id", middleware.GetReqID(ctx)),
+	fetch := func(ctx context.Context) (*Body, error) {
+		return c.Source.Translations(ctx, dist, component, lang, compression)
+	}
+	c.track(dist, key, fetch)
+	return c.get(ctx, dist, key, fetch, "cached Translations",
 		slog.Any("dist", dist),
 		slog.Any("component", component),
 		slog.Any("lang", lang),
 		slog.String("compression", string(compression)),
-		slog.Bool("cache_hit", ok),
 	)
-	if ok {
-		return v, nil
+}
+
+func (c Cache) Sources(ctx context.Context, dist Distribution, component Component, compression Compression) (*Body, error) {
+	key := sources.Key(dist.String(), component.String(), compression.String())
+	fetch := func(ctx context.Context) (*Body, error) {
+		return c.Source.Sources(ctx, dist, component, compression)
 	}
+	c.track(dist, key, fetch)
+	return c.get(ctx, dist, key, fetch, "cached Sources",
+		slog.Any("dist", dist),
+		slog.Any("component", component),
+		slog.String("compression", string(compression)),
+	)
+}
 
-	v, err := c.Source.Translations(ctx, dist, component, lang, compression)
-	if err != nil {
-		return nil, err
+func (c Cache) Contents(ctx context.Context, dist Distribution, component Component, arch Architecture, compression Compression) (*Body, error) {
+	key := contents.Key(dist.String(), component.String(), arch.String(), compression.String())
+	fetch := func(ctx context.Context) (*Body, error) {
+		return c.Source.Contents(ctx, dist, component, arch, compression)
 	}
-	c.Storage.Add(ctx, key, v)
-	return v, nil
+	c.track(dist, key, fetch)
+	return c.get(ctx, dist, key, fetch, "cached Contents",
+		slog.Any("dist", dist),
+		slog.Any("component", component),
+		slog.Any("arch", arch),
+		slog.String("compression", string(compression)),
+	)
 }
 
-func (c Cache) ByHash(ctx context.Context, dist Distribution, component Component, arch Architecture, digest string) ([]byte, error) {
+func (c Cache) ByHash(ctx context.Context, dist Distribution, component Component, arch Architecture, digest string) (*Body, error) {
 	key := byHash.Key(dist.String(), component.String(), arch.String(), digest)
-	v, ok := c.Storage.Get(ctx, key)
-	slog.Debug("cached ByHash",
-		slog.String("request_id", middleware.GetReqID(ctx)),
+	return c.get(ctx, dist, key, func(ctx context.Context) (*Body, error) {
+		return c.Source.ByHash(ctx, dist, component, arch, digest)
+	}, "cached ByHash",
 		slog.Any("dist", dist),
 		slog.Any("component", component),
 		slog.Any("arch", arch),
 		slog.String("digest", digest),
-		slog.Bool("cache_hit", ok),
 	)
+}
+
+func (c Cache) Pool(ctx context.Context, filename string) (*Body, error) {
+	if err := CheckPoolFilename(filename); err != nil {
+		return nil, err
+	}
+	key := pool.Key(filename)
+	if isSourceFile(filename) {
+		key = sourcePool.Key(filename)
+	}
+	if c.Content != nil && !c.Offline {
+		c.linkPool(ctx, key, filename)
+	}
+	return c.get(ctx, "", key, func(ctx context.Context) (*Body, error) {
+		return c.Source.Pool(ctx, filename)
+	}, "cached Pool", slog.String("filename", filename))
+}
+
+// PurgeDist deletes the cached releases and indexes of a distribution, keeping pool files and other distributions.
+// It returns how many values were deleted.
+func (c Cache) PurgeDist(ctx context.Context, dist Distribution) (int, error) {
+	var purged int
+	for _, ns := range []cache.Namespace{releases, packages, byHash, translations, contents, sources} {
+		prefix := ns.Key(dist.String())
+		keys, err := c.Storage.Keys(ctx, prefix)
+		if err != nil {
+			return purged, err
+		}
+		for _, key := range keys {
+			// Other distributions can share the prefix, e.g. bookworm-security:
+			if key != prefix && !strings.HasPrefix(string(key), string(prefix)+" ") {
+				continue
+			}
+			if err := c.Storage.Delete(ctx, key); err != nil {
+				return purged, err
+			}
+			c.digests.drop(func(k cache.Key) bool { return k == key })
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// Purge deletes the cached values with a key prefix from every storage, returning how many were deleted.
+func (c Cache) Purge(ctx context.Context, prefix cache.Key) (int, error) {
+	defer c.digests.drop(func(key cache.Key) bool { return strings.HasPrefix(string(key), string(prefix)) })
+	var purged int
+	for _, storage := range c.Storages() {
+		n, err := cache.Purge(ctx, storage, prefix)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// isSourceFile reports whether a pool file belongs to a source package, e.g. a .dsc or .orig.tar.xz.
+func isSourceFile(filename string) bool {
+	base := path.Base(filename)
+	return strings.HasSuffix(base, ".dsc") || strings.HasSuffix(base, ".diff.gz") || strings.Contains(base, ".tar.")
+}
+
+func (c Cache) SigningKeyPEM() ([]byte, error) {
+	return c.Source.SigningKeyPEM()
+}
+
+// get serves key from the cache, or streams from the source while filling the cache.
+// Concurrent misses for the same key wait for a single fetch from the source.
+func (c Cache) get(ctx context.Context, dist Distribution, key cache.Key, fetch func(context.Context) (*Body, error), msg string, attrs ...any) (*Body, error) {
+	if c.Offline {
+		return c.offline(ctx, key)
+	}
+	for {
+		entry, ok := c.storage(key).Open(ctx, key)
+		slog.Debug(msg, append(attrs,
+			slog.String("request_id", middleware.GetReqID(ctx)),
+			slog.Bool("cache_hit", ok),
+		)...)
+		if ok {
+			countLookup(ctx, key, true)
+			c.revalidate(ctx, dist, key, entry, fetch)
+			return entryBody(entry), nil
+		}
+		if c.inflight == nil {
+			countLookup(ctx, key, false)
+			return c.fill(ctx, key, fetch, nil)
+		}
+
+		f, leader := c.inflight.join(key)
+		if leader {
+			countLookup(ctx, key, false)
+			return c.fill(ctx, key, fetch, func(err error) {
+				f.err = err
+				f.cancelled = ctx.Err() != nil || errors.Is(err, errAbandoned)
+				c.inflight.finish(key, f)
+			})
+		}
+
+		slog.Debug("waiting for inflight fetch", slog.String("request_id", middleware.GetReqID(ctx)), slog.Any("key", key))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-f.done:
+		}
+
+		switch {
+		case f.cancelled:
+			// The leader went away, so try again:
+			continue
+		case f.err != nil:
+			if body, ok := c.staleIfError(ctx, key, nil, f.err); ok {
+				return body, nil
+			}
+			return nil, f.err
+		}
+
+		// The leader filled the cache, unless the storage rejected the value:
+		if body, ok := c.open(ctx, key); ok {
+			countLookup(ctx, key, true)
+			return body, nil
+		}
+		countLookup(ctx, key, false)
+		return c.fill(ctx, key, fetch, nil)
+	}
+}
+
+// countLookup records whether a request was served from the cache, or had to fetch from the source.
+func countLookup(ctx context.Context, key cache.Key, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	metrics.CacheRequests.WithLabelValues(metrics.Repo(ctx), string(key.Namespace()), result).Inc()
+}
+
+func (c Cache) open(ctx context.Context, key cache.Key) (*Body, bool) {
+	entry, ok := c.storage(key).Open(ctx, key)
+	if !ok {
+		return nil, false
+	}
+	return entryBody(entry), true
+}
+
+// entryBody serves a cache.Entry. Stored content is identified by the origin's validators if known, otherwise by its
+// digest and modification time. fill serves the same validators before the value is stored.
+func entryBody(entry *cache.Entry) *Body {
+	body := &Body{
+		ReadCloser: entry.ReadCloser,
+		Size:       entry.Size,
+		ModTime:    entry.Metadata.LastModified,
+		ETag:       entry.Metadata.ETag,
+	}
+	if body.ModTime.IsZero() {
+		body.ModTime = entry.ModTime
+	}
+	if body.ETag == "" && entry.Metadata.SHA256 != "" {
+		body.ETag = DigestETag(entry.Metadata.SHA256)
+	}
+	return body
+}
+
+// fill fetches from the source, and stores the Body in the cache as it is read.
+// Errors and empty values are never stored. If set, done is called once the fetch is complete.
+// An expired value is revalidated with the source, and served again if the source reports it has not been modified.
+func (c Cache) fill(ctx context.Context, key cache.Key, fetch func(context.Context) (*Body, error), done func(error)) (*Body, error) {
+	// Always fetch the whole file, so it can be stored:
+	fetchCtx := WithByteRange(ctx, ByteRange{})
+	if isHead(ctx) {
+		// The value is stored after the response:
+		fetchCtx = context.WithoutCancel(fetchCtx)
+	}
+	stale, ok := c.storage(key).Stale(ctx, key)
 	if ok {
-		return v, nil
+		validators := Validators{ETag: stale.Metadata.ETag, LastModified: stale.Metadata.LastModified}
+		if !validators.IsZero() {
+			fetchCtx = WithValidators(fetchCtx, validators)
+		}
 	}
 
-	v, err := c.Source.ByHash(ctx, dist, component, arch, digest)
+	body, err := fetch(fetchCtx)
+	if stale != nil {
+		if errors.Is(err, ErrNotModified) {
+			slog.Debug("revalidated cached value", slog.String("request_id", middleware.GetReqID(ctx)), slog.Any("key", key))
+			c.storage(key).Touch(ctx, key)
+			if done != nil {
+				done(nil)
+			}
+			return entryBody(stale), nil
+		}
+		if err == nil {
+			_ = stale.Close()
+		}
+	}
 	if err != nil {
+		if done != nil {
+			done(err)
+		}
+		if body, ok := c.staleIfError(ctx, key, stale, err); ok {
+			return body, nil
+		}
 		return nil, err
 	}
-	c.Storage.Add(ctx, key, v)
-	return v, nil
+
+	var w cache.Writer
+	expected := c.expectedSHA256(key)
+	// Stale values from another cache would be stored as fresh:
+	if body.Size != 0 && body.Partial == nil && !body.Stale {
+		w, err = c.storage(key).Create(ctx, key, cache.Metadata{ETag: body.ETag, LastModified: body.ModTime, SHA256: expected})
+		if err != nil {
+			slog.Error("cache.Storage.Create", slog.String("error", err.Error()))
+			w = nil
+		}
+	}
+	tee := &teeBody{src: body.ReadCloser, w: w, done: done}
+	if w != nil && c.Content != nil && listsPool(key) {
+		// Pool files listed by the new index can be linked by digest:
+		tee.stored = func() { c.indexPackage(context.WithoutCancel(ctx), key) }
+	}
+	// Match the validator of the stored value, which is only digested once it is read:
+	etag := body.ETag
+	if etag == "" && expected != "" && body.Partial == nil {
+		etag = DigestETag(expected)
+	}
+	var rc io.ReadCloser = tee
+	if w != nil && isHead(ctx) {
+		// The Body won't be read, so store the value in the background instead:
+		go func() {
+			_, _ = io.Copy(io.Discard, tee)
+			_ = tee.Close()
+		}()
+		rc = http.NoBody
+	}
+	return &Body{
+		ReadCloser: rc,
+		Size:       body.Size,
+		ModTime:    body.ModTime,
+		ETag:       etag,
+		Partial:    body.Partial,
+		Stale:      body.Stale,
+	}, nil
 }
 
-func (c Cache) Pool(ctx context.Context, filename string) ([]byte, error) {
-	key := pool.Key(filename)
-	v, ok := c.Storage.Get(ctx, key)
-	slog.Debug("cached Pool",
+// expectedSHA256 returns the digest a value must have to be stored, if it is known.
+func (c Cache) expectedSHA256(key cache.Key) string {
+	_, name, _ := strings.Cut(string(key), ":::")
+	switch key.Namespace() {
+	case byHash:
+		return name[strings.LastIndex(name, " ")+1:]
+	case pool, sourcePool:
+		if c.Content != nil {
+			return c.poolDigest(name)
+		}
+	}
+	return ""
+}
+
+// staleIfError serves an expired value in place of an error from the source, if it expired recently enough.
+// If stale is nil the expired value is opened from storage, otherwise staleIfError closes it unless it is served.
+func (c Cache) staleIfError(ctx context.Context, key cache.Key, stale *cache.Entry, err error) (*Body, bool) {
+	if stale == nil && c.StaleIfError > 0 {
+		stale, _ = c.storage(key).Stale(ctx, key)
+	}
+	if stale == nil {
+		return nil, false
+	}
+	expired := stale.Expires
+	if expired.IsZero() {
+		expired = stale.ModTime
+	}
+	// Missing files are gone, not unavailable:
+	if c.StaleIfError <= 0 || errors.Is(err, ErrNotFound) || ctx.Err() != nil || time.Since(expired) > c.StaleIfError {
+		_ = stale.Close()
+		return nil, false
+	}
+
+	slog.Warn("serving stale value",
 		slog.String("request_id", middleware.GetReqID(ctx)),
-		slog.String("filename", filename),
-		slog.Bool("cache_hit", ok),
+		slog.Any("key", key),
+		slog.Duration("expired", time.Since(expired)),
+		slog.String("error", err.Error()),
 	)
-	if ok {
-		return v, nil
+	body := entryBody(stale)
+	body.Stale = true
+	return body, true
+}
+
+// offline serves key from the cache, even if it has expired.
+func (c Cache) offline(ctx context.Context, key cache.Key) (*Body, error) {
+	if body, ok := c.open(ctx, key); ok {
+		countLookup(ctx, key, true)
+		return body, nil
 	}
+	countLookup(ctx, key, false)
+	stale, ok := c.storage(key).Stale(ctx, key)
+	if !ok {
+		return nil, fmt.Errorf("%w: offline, and %s is not cached", ErrUpstreamUnavailable, key)
+	}
+	body := entryBody(stale)
+	body.Stale = true
+	return body, nil
+}
 
-	v, err := c.Source.Pool(ctx, filename)
-	if err != nil {
-		return nil, err
+// teeBody writes to the cache while the source is read. The value is only committed if the source is read to EOF.
+type teeBody struct {
+	src io.ReadCloser
+	// w is nil if the value is not being cached.
+	w cache.Writer
+	// written is the number of bytes written to w.
+	written int64
+	// done is called once, when the source is completely read or abandoned.
+	done func(error)
+	// stored is called once the value is committed, if set.
+	stored func()
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.src.Read(p)
+	if n > 0 && t.w != nil {
+		if _, werr := t.w.Write(p[:n]); errors.Is(werr, cache.ErrTooLarge) {
+			// The value is still served, but not cached:
+			t.discard()
+		} else if werr != nil {
+			slog.Error("cache.Writer.Write", slog.String("error", werr.Error()))
+			t.discard()
+		} else {
+			t.written += int64(n)
+		}
 	}
-	c.Storage.Add(ctx, key, v)
-	return v, nil
+
+	if errors.Is(err, io.EOF) {
+		t.finish(nil)
+	} else if err != nil {
+		t.finish(err)
+	}
+	return n, err
 }
 
-func (c Cache) SigningKeyPEM() ([]byte, error) {
-	return c.Source.SigningKeyPEM()
+func (t *teeBody) Close() error {
+	// Closing before EOF means the value is incomplete:
+	t.finish(errAbandoned)
+	return t.src.Close()
+}
+
+func (t *teeBody) finish(err error) {
+	if t.w != nil {
+		if err != nil || t.written == 0 {
+			t.discard()
+		} else {
+			if cerr := t.w.Commit(); cerr != nil {
+				slog.Error("cache.Writer.Commit", slog.String("error", cerr.Error()))
+			} else if t.stored != nil {
+				t.stored()
+			}
+			t.w = nil
+		}
+	}
+	if t.done != nil {
+		t.done(err)
+		t.done = nil
+	}
+}
+
+func (t *teeBody) discard() {
+	if err := t.w.Discard(); err != nil {
+		slog.Error("cache.Writer.Discard", slog.String("error", err.Error()))
+	}
+	t.w = nil
 }
@@ -2,9 +2,21 @@ package repo_test
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/thepwagner/debcache/pkg/cache"
 	"github.com/thepwagner/debcache/pkg/repo"
@@ -19,7 +31,20 @@ func TestCached_InRelease(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		b, err := cached.InRelease(ctx, "test")
 		require.NoError(t, err)
-		require.Equal(t, []byte("1"), b)
+		require.Equal(t, []byte("1"), readBody(t, b))
+	}
+}
+
+func TestCached_Release(t *testing.T) {
+	t.Parallel()
+	srv := countingServer(t, "/dists/test/Release")
+	cached := repo.NewCache(repo.NewUpstream(srv), testCacheStorage())
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		b, err := cached.Release(ctx, "test")
+		require.NoError(t, err)
+		require.Equal(t, []byte("1"), readBody(t, b))
 	}
 }
 
@@ -32,20 +57,62 @@ func TestCached_Packages(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		b, err := cached.Packages(ctx, "test", "component", "arch", repo.CompressionNone)
 		require.NoError(t, err)
-		require.Equal(t, []byte("1"), b)
+		require.Equal(t, []byte("1"), readBody(t, b))
+	}
+}
+
+func TestCached_Sources(t *testing.T) {
+	t.Parallel()
+	srv := countingServer(t, "/dists/test/component/source/Sources.xz")
+	cached := repo.NewCache(repo.NewUpstream(srv), testCacheStorage())
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		b, err := cached.Sources(ctx, "test", "component", repo.CompressionXZ)
+		require.NoError(t, err)
+		require.Equal(t, []byte("1"), readBody(t, b))
+	}
+}
+
+func TestCached_Contents(t *testing.T) {
+	t.Parallel()
+	srv := countingServer(t, "/dists/test/component/Contents-arch.gz")
+	cached := repo.NewCache(repo.NewUpstream(srv), testCacheStorage())
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		b, err := cached.Contents(ctx, "test", "component", "arch", repo.CompressionGZIP)
+		require.NoError(t, err)
+		require.Equal(t, []byte("1"), readBody(t, b))
 	}
 }
 
 func TestCached_ByHash(t *testing.T) {
 	t.Parallel()
-	srv := countingServer(t, "/dists/test/component/binary-arch/by-hash/SHA256/abc123")
+	// The digest of the first response, "1":
+	digest := "6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"
+	srv := countingServer(t, "/dists/test/component/binary-arch/by-hash/SHA256/"+digest)
 	cached := repo.NewCache(repo.NewUpstream(srv), testCacheStorage())
 
 	ctx := context.Background()
 	for i := 0; i < 3; i++ {
+		b, err := cached.ByHash(ctx, "test", "component", "arch", digest)
+		require.NoError(t, err)
+		require.Equal(t, []byte("1"), readBody(t, b))
+	}
+}
+
+func TestCached_ByHashMismatch(t *testing.T) {
+	t.Parallel()
+	srv := countingServer(t, "/dists/test/component/binary-arch/by-hash/SHA256/abc123")
+	cached := repo.NewCache(repo.NewUpstream(srv), testCacheStorage())
+
+	// Content that doesn't match its digest is never stored:
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
 		b, err := cached.ByHash(ctx, "test", "component", "arch", "abc123")
 		require.NoError(t, err)
-		require.Equal(t, []byte("1"), b)
+		require.Equal(t, []byte(strconv.Itoa(i)), readBody(t, b))
 	}
 }
 
@@ -55,13 +122,520 @@ func TestCached_Pool(t *testing.T) {
 	cached := repo.NewCache(repo.NewUpstream(srv), testCacheStorage())
 
 	ctx := context.Background()
+	var etags []string
 	for i := 0; i < 3; i++ {
 		b, err := cached.Pool(ctx, "component/p/pkg/pkg_1.0_amd64.deb")
 		require.NoError(t, err)
-		require.Equal(t, []byte("1"), b)
+		etags = append(etags, b.ETag)
+		require.Equal(t, []byte("1"), readBody(t, b))
+	}
+	// Without a validator from the origin, the stored value is identified by its digest:
+	assert.Equal(t, []string{"", repo.DigestETag("6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b"), repo.DigestETag("6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b")}, etags)
+}
+
+func TestCached_PartialRead(t *testing.T) {
+	t.Parallel()
+	srv := countingServer(t, "/pool/component/p/pkg/pkg_1.0_amd64.deb")
+	cached := repo.NewCache(repo.NewUpstream(srv), cache.NewFileStorage(cache.FileConfig{Path: t.TempDir()}))
+
+	// Closing without reading the body does not fill the cache:
+	ctx := context.Background()
+	b, err := cached.Pool(ctx, "component/p/pkg/pkg_1.0_amd64.deb")
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+
+	for i := 0; i < 3; i++ {
+		b, err := cached.Pool(ctx, "component/p/pkg/pkg_1.0_amd64.deb")
+		require.NoError(t, err)
+		require.Equal(t, []byte("2"), readBody(t, b))
+	}
+}
+
+func TestCached_Revalidate(t *testing.T) {
+	t.Parallel()
+
+	var requests, revalidated int64
+	lastModified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt64(&revalidated, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		_, _ = w.Write([]byte("release"))
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	storage := cache.NewFileStorage(cache.FileConfig{Path: dir, TTL: time.Hour})
+	cached := repo.NewCache(repo.NewUpstream(*u), storage)
+
+	ctx := context.Background()
+	b, err := cached.InRelease(ctx, "test")
+	require.NoError(t, err)
+	assert.Equal(t, `"v1"`, b.ETag)
+	assert.Equal(t, []byte("release"), readBody(t, b))
+
+	ageFiles(t, dir, 2*time.Hour)
+	b, err = cached.InRelease(ctx, "test")
+	require.NoError(t, err)
+	assert.True(t, lastModified.Equal(b.ModTime))
+	assert.Equal(t, `"v1"`, b.ETag)
+	assert.Equal(t, []byte("release"), readBody(t, b))
+
+	// Revalidation refreshed the entry, which keeps the validator it was first served with:
+	b, err = cached.InRelease(ctx, "test")
+	require.NoError(t, err)
+	assert.Equal(t, `"v1"`, b.ETag)
+	assert.Equal(t, []byte("release"), readBody(t, b))
+
+	assert.Equal(t, int64(2), atomic.LoadInt64(&requests))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&revalidated))
+}
+
+func TestCached_DoesNotStoreFailures(t *testing.T) {
+	t.Parallel()
+
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if r.URL.Path == "/pool/missing.deb" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	cached := repo.NewCache(repo.NewUpstream(*u), testCacheStorage())
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := cached.Pool(ctx, "missing.deb")
+		require.ErrorIs(t, err, repo.ErrNotFound)
+
+		b, err := cached.Pool(ctx, "empty.deb")
+		require.NoError(t, err)
+		assert.Empty(t, readBody(t, b))
+	}
+	assert.Equal(t, int64(6), atomic.LoadInt64(&requests))
+}
+
+func TestCached_Coalescing(t *testing.T) {
+	t.Parallel()
+
+	t.Run("shared result", func(t *testing.T) {
+		t.Parallel()
+		srv, requests, release := blockingServer(t, http.StatusOK)
+		cached := repo.NewCache(repo.NewUpstream(srv), testCacheStorage())
+
+		results, errs := concurrentPool(t, cached, release)
+		for i := range results {
+			require.NoError(t, errs[i])
+			assert.Equal(t, []byte("1"), results[i])
+		}
+		assert.Equal(t, int64(1), atomic.LoadInt64(requests))
+	})
+
+	t.Run("shared error", func(t *testing.T) {
+		t.Parallel()
+		srv, requests, release := blockingServer(t, http.StatusInternalServerError)
+		cached := repo.NewCache(repo.NewUpstream(srv), testCacheStorage())
+
+		_, errs := concurrentPool(t, cached, release)
+		for _, err := range errs {
+			assert.Error(t, err)
+		}
+		assert.Equal(t, int64(1), atomic.LoadInt64(requests))
+	})
+}
+
+// blockingServer counts requests, and responds once per message on the returned channel.
+func blockingServer(tb testing.TB, status int) (url.URL, *int64, chan<- struct{}) {
+	tb.Helper()
+
+	var counter int64
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		v := atomic.AddInt64(&counter, 1)
+		<-release
+		w.WriteHeader(status)
+		_, _ = fmt.Fprintf(w, "%d", v)
+	}))
+	tb.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	return *u, &counter, release
+}
+
+func concurrentPool(tb testing.TB, cached *repo.Cache, release chan<- struct{}) ([][]byte, []error) {
+	tb.Helper()
+
+	const concurrency = 10
+	results := make([][]byte, concurrency)
+	errs := make([]error, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b, err := cached.Pool(context.Background(), "component/p/pkg/pkg_1.0_amd64.deb")
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer b.Close()
+			results[i], errs[i] = io.ReadAll(b)
+		}(i)
+	}
+
+	// Give every request a chance to join the flight before upstream responds:
+	time.Sleep(50 * time.Millisecond)
+	release <- struct{}{}
+	wg.Wait()
+	return results, errs
+}
+
+func TestCached_CoalescingLeaderCancelled(t *testing.T) {
+	t.Parallel()
+
+	srv := countingServer(t, "/pool/component/p/pkg/pkg_1.0_amd64.deb")
+	cached := repo.NewCache(repo.NewUpstream(srv), testCacheStorage())
+
+	// The leader starts the fetch but walks away without reading:
+	ctx, cancel := context.WithCancel(context.Background())
+	leader, err := cached.Pool(ctx, "component/p/pkg/pkg_1.0_amd64.deb")
+	require.NoError(t, err)
+
+	followed := make(chan []byte)
+	go func() {
+		b, err := cached.Pool(context.Background(), "component/p/pkg/pkg_1.0_amd64.deb")
+		assert.NoError(t, err)
+		followed <- readBody(t, b)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	require.NoError(t, leader.Close())
+
+	// The follower takes over the fetch:
+	assert.Equal(t, []byte("2"), <-followed)
+}
+
+func TestCached_SourcePool(t *testing.T) {
+	t.Parallel()
+	const filename = "component/h/hello/hello_1.0.orig.tar.xz"
+	srv := countingServer(t, "/pool/"+filename)
+	storage := testCacheStorage()
+	cached := repo.NewCache(repo.NewUpstream(srv), storage)
+
+	ctx := context.Background()
+	b, err := cached.Pool(ctx, filename)
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), readBody(t, b))
+
+	// Source files are cached apart from binary packages:
+	_, ok := storage.Open(ctx, cache.Namespace("pool").Key(filename))
+	assert.False(t, ok)
+	entry, ok := storage.Open(ctx, cache.Namespace("source-pool").Key(filename))
+	require.True(t, ok)
+	_ = entry.Close()
+}
+
+func TestCached_StaleIfError(t *testing.T) {
+	t.Parallel()
+
+	var status atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s := status.Load(); s != 0 {
+			w.WriteHeader(int(s))
+			return
+		}
+		_, _ = w.Write([]byte("release"))
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	storage := cache.NewFileStorage(cache.FileConfig{Path: dir, TTL: time.Hour})
+	cached := repo.NewCache(repo.NewUpstream(*u), storage)
+	ctx := context.Background()
+
+	b, err := cached.InRelease(ctx, "test")
+	require.NoError(t, err)
+	require.Equal(t, []byte("release"), readBody(t, b))
+	// The value expired 30 minutes ago:
+	ageFiles(t, dir, 90*time.Minute)
+	status.Store(http.StatusServiceUnavailable)
+
+	// Disabled by default:
+	_, err = cached.InRelease(ctx, "test")
+	require.ErrorIs(t, err, repo.ErrUpstreamUnavailable)
+
+	// Staleness is measured from when the value expired, not when it was stored:
+	cached.StaleIfError = 45 * time.Minute
+	b, err = cached.InRelease(ctx, "test")
+	require.NoError(t, err)
+	assert.True(t, b.Stale)
+	assert.Equal(t, []byte("release"), readBody(t, b))
+
+	// Files that are gone are not served:
+	status.Store(http.StatusNotFound)
+	_, err = cached.InRelease(ctx, "test")
+	require.ErrorIs(t, err, repo.ErrNotFound)
+
+	// Nor are values that expired too long ago:
+	status.Store(http.StatusServiceUnavailable)
+	cached.StaleIfError = 15 * time.Minute
+	_, err = cached.InRelease(ctx, "test")
+	require.ErrorIs(t, err, repo.ErrUpstreamUnavailable)
+}
+
+func TestCached_Offline(t *testing.T) {
+	t.Parallel()
+	srv := countingServer(t, "/dists/test/InRelease")
+	dir := t.TempDir()
+	storage := cache.NewFileStorage(cache.FileConfig{Path: dir, TTL: time.Hour})
+	cached := repo.NewCache(repo.NewUpstream(srv), storage)
+	cached.Offline = true
+	ctx := context.Background()
+
+	_, err := cached.InRelease(ctx, "test")
+	require.ErrorIs(t, err, repo.ErrUpstreamUnavailable)
+
+	storage.Add(ctx, cache.Namespace("releases").Key("test"), []byte("cached"))
+	b, err := cached.InRelease(ctx, "test")
+	require.NoError(t, err)
+	assert.False(t, b.Stale)
+	assert.Equal(t, []byte("cached"), readBody(t, b))
+
+	// Expired values are served too:
+	ageFiles(t, dir, 2*time.Hour)
+	b, err = cached.InRelease(ctx, "test")
+	require.NoError(t, err)
+	assert.True(t, b.Stale)
+	assert.Equal(t, []byte("cached"), readBody(t, b))
+
+	// The source was never contacted:
+	cached.Offline = false
+	b, err = cached.InRelease(ctx, "test")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("1"), readBody(t, b))
+}
+
+func TestCached_SoftTTL(t *testing.T) {
+	t.Parallel()
+	m := newTestMirror(t, map[string]string{
+		"/dists/test/InRelease":                  "release 1",
+		"/dists/test/main/binary-amd64/Packages": "packages 1",
+		"/pool/main/f/foo.deb":                   "foo",
+	})
+	cached := repo.NewCache(repo.NewUpstream(m.url), testCacheStorage())
+	cached.SoftTTL = 10 * time.Millisecond
+	cached.RefreshRecent = time.Hour
+	ctx := context.Background()
+
+	for _, get := range []func() (*repo.Body, error){
+		func() (*repo.Body, error) { return cached.InRelease(ctx, "test") },
+		func() (*repo.Body, error) { return cached.Packages(ctx, "test", "main", "amd64", repo.CompressionNone) },
+		func() (*repo.Body, error) { return cached.Pool(ctx, "main/f/foo.deb") },
+	} {
+		b, err := get()
+		require.NoError(t, err)
+		readBody(t, b)
 	}
+	require.Equal(t, int32(3), m.requests.Load())
+	time.Sleep(20 * time.Millisecond)
+
+	// Pool files never change, so are not refreshed:
+	b, err := cached.Pool(ctx, "main/f/foo.deb")
+	require.NoError(t, err)
+	readBody(t, b)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, int32(3), m.requests.Load())
+
+	m.files.Store(&map[string]string{
+		"/dists/test/InRelease":                  "release 2",
+		"/dists/test/main/binary-amd64/Packages": "packages 2",
+		"/pool/main/f/foo.deb":                   "foo",
+	})
+
+	// The cached value is served while it is refreshed:
+	b, err = cached.InRelease(ctx, "test")
+	require.NoError(t, err)
+	assert.False(t, b.Stale)
+	assert.Equal(t, []byte("release 1"), readBody(t, b))
+
+	// Recently requested indexes are refreshed with the InRelease that describes them:
+	assert.Eventually(t, func() bool { return m.requests.Load() == 5 }, time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		b, err := cached.Packages(ctx, "test", "main", "amd64", repo.CompressionNone)
+		return err == nil && string(readBody(t, b)) == "packages 2"
+	}, time.Second, time.Millisecond)
+	b, err = cached.InRelease(ctx, "test")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("release 2"), readBody(t, b))
+}
+
+func TestCached_SoftTTLIndexes(t *testing.T) {
+	t.Parallel()
+	m := newTestMirror(t, map[string]string{
+		"/dists/test/InRelease":                  "release 1",
+		"/dists/test/main/binary-amd64/Packages": "packages 1",
+	})
+	cached := repo.NewCache(repo.NewUpstream(m.url), testCacheStorage())
+	cached.SoftTTL = 50 * time.Millisecond
+	ctx := context.Background()
+	packages := func() string {
+		b, err := cached.Packages(ctx, "test", "main", "amd64", repo.CompressionNone)
+		require.NoError(t, err)
+		return string(readBody(t, b))
+	}
+
+	b, err := cached.InRelease(ctx, "test")
+	require.NoError(t, err)
+	readBody(t, b)
+	assert.Equal(t, "packages 1", packages())
+	time.Sleep(100 * time.Millisecond)
+
+	// An old index refreshes the InRelease, but isn't refreshed ahead of it:
+	m.files.Store(&map[string]string{
+		"/dists/test/InRelease":                  "release 1",
+		"/dists/test/main/binary-amd64/Packages": "packages 2",
+	})
+	assert.Equal(t, "packages 1", packages())
+	assert.Eventually(t, func() bool { return m.requests.Load() == 3 }, time.Second, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, int32(3), m.requests.Load())
+	assert.Equal(t, "packages 1", packages())
+
+	// Once the InRelease changes, the index is refreshed with it:
+	m.files.Store(&map[string]string{
+		"/dists/test/InRelease":                  "release 2",
+		"/dists/test/main/binary-amd64/Packages": "packages 2",
+	})
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "packages 1", packages())
+	assert.Eventually(t, func() bool { return packages() == "packages 2" }, time.Second, time.Millisecond)
+	b, err = cached.InRelease(ctx, "test")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("release 2"), readBody(t, b))
+	assert.Equal(t, int32(5), m.requests.Load())
+}
+
+// ageFiles moves the modification time of every file under dir back by age, so stored values expire without waiting.
+func ageFiles(tb testing.TB, dir string, age time.Duration) {
+	tb.Helper()
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mtime := info.ModTime().Add(-age)
+		return os.Chtimes(p, mtime, mtime)
+	})
+	require.NoError(tb, err)
 }
 
 func testCacheStorage() cache.Storage {
 	return cache.NewLRUStorage(cache.LRUConfig{Size: 100, TTL: time.Minute})
 }
+
+func TestCached_ContentStore(t *testing.T) {
+	t.Parallel()
+	const digest = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae" // "foo"
+	files := map[string]string{
+		"/dists/test/main/binary-amd64/Packages": "Package: foo\nFilename: pool/main/f/foo.deb\nSHA256: " + digest + "\n",
+		"/pool/main/f/foo.deb":                   "foo",
+	}
+	a, b := newTestMirror(t, files), newTestMirror(t, files)
+	store := cache.NewContentStore(cache.ContentConfig{Path: t.TempDir()})
+	cacheA := repo.NewCache(repo.NewUpstream(a.url), testCacheStorage())
+	cacheA.Content = store.Storage("a", time.Hour)
+	cacheB := repo.NewCache(repo.NewUpstream(b.url), testCacheStorage())
+	cacheB.Content = store.Storage("b", time.Hour)
+	ctx := context.Background()
+
+	for _, c := range []*repo.Cache{cacheA, cacheB} {
+		body, err := c.Packages(ctx, "test", "main", "amd64", repo.CompressionNone)
+		require.NoError(t, err)
+		readBody(t, body)
+		body, err = c.Pool(ctx, "main/f/foo.deb")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("foo"), readBody(t, body))
+	}
+	// The second cache links the file the first one stored:
+	assert.Equal(t, int32(2), a.requests.Load())
+	assert.Equal(t, int32(1), b.requests.Load())
+
+	// Removing one cache's reference keeps the file for the other:
+	_, err := cache.Purge(ctx, cacheA.Content, "")
+	require.NoError(t, err)
+	body, err := cacheB.Pool(ctx, "main/f/foo.deb")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("foo"), readBody(t, body))
+	assert.Equal(t, int32(1), b.requests.Load())
+
+	// Files listed by a deleted index are no longer linked:
+	c := newTestMirror(t, files)
+	cacheC := repo.NewCache(repo.NewUpstream(c.url), testCacheStorage())
+	cacheC.Content = store.Storage("c", time.Hour)
+	body, err = cacheC.Packages(ctx, "test", "main", "amd64", repo.CompressionNone)
+	require.NoError(t, err)
+	readBody(t, body)
+	_, err = cacheC.PurgeDist(ctx, "test")
+	require.NoError(t, err)
+	body, err = cacheC.Pool(ctx, "main/f/foo.deb")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("foo"), readBody(t, body))
+	assert.Equal(t, int32(2), c.requests.Load())
+}
+
+func TestCached_PurgeDist(t *testing.T) {
+	t.Parallel()
+	storage := testCacheStorage()
+	cached := repo.NewCache(repo.NewUpstream(url.URL{}), storage)
+	ctx := context.Background()
+	purged := []cache.Key{
+		cache.Namespace("releases").Key("bookworm"),
+		cache.Namespace("releases").Key("bookworm", "Release"),
+		cache.Namespace("packages").Key("bookworm", "main", "amd64", ""),
+		cache.Namespace("by-hash").Key("bookworm", "main", "amd64", "abc123"),
+	}
+	kept := []cache.Key{
+		cache.Namespace("releases").Key("bookworm-security"),
+		cache.Namespace("packages").Key("trixie", "main", "amd64", ""),
+		cache.Namespace("pool").Key("main/f/foo.deb"),
+	}
+	for _, key := range append(purged, kept...) {
+		storage.Add(ctx, key, []byte("value"))
+	}
+
+	n, err := cached.PurgeDist(ctx, "bookworm")
+	require.NoError(t, err)
+	assert.Equal(t, len(purged), n)
+	keys, err := storage.Keys(ctx, "")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, kept, keys)
+}
+
+func TestCached_TooLarge(t *testing.T) {
+	t.Parallel()
+	m := newTestMirror(t, map[string]string{"/pool/main/f/foo.deb": "foo"})
+	cached := repo.NewCache(repo.NewUpstream(m.url), cache.NewLRUStorage(cache.LRUConfig{MaxItemSize: 2}))
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		b, err := cached.Pool(ctx, "main/f/foo.deb")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("foo"), readBody(t, b))
+	}
+	// Values too large to cache are served from the source:
+	assert.Equal(t, int32(2), m.requests.Load())
+}
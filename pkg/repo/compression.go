@@ -1,9 +1,12 @@
 package repo
 
 import (
+	"bufio"
 	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
 	"fmt"
+	"io"
 
 	"github.com/ulikunitz/xz"
 )
@@ -84,3 +87,19 @@ func (c Compression) Compress(data []byte) ([]byte, error) {
 		return nil, fmt.Errorf("unknown compression %q", c)
 	}
 }
+
+// Decompress detects the compression of r from its magic bytes, and returns the uncompressed content.
+func Decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return xz.NewReader(br)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(br), nil
+	default:
+		return br, nil
+	}
+}
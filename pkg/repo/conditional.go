@@ -0,0 +1,78 @@
+package repo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Validators identify a version of a file, for conditional requests.
+type Validators struct {
+	ETag         string
+	LastModified time.Time
+}
+
+// IsZero reports whether there is nothing to validate with.
+func (v Validators) IsZero() bool {
+	return v.ETag == "" && v.LastModified.IsZero()
+}
+
+type validatorsKey struct{}
+
+// WithValidators asks a Repo to only return a file if it differs from the version identified by v.
+// Repos that support conditional requests return ErrNotModified if the file has not changed.
+func WithValidators(ctx context.Context, v Validators) context.Context {
+	return context.WithValue(ctx, validatorsKey{}, v)
+}
+
+// ValidatorsFromContext returns the Validators set by WithValidators.
+func ValidatorsFromContext(ctx context.Context) (Validators, bool) {
+	v, ok := ctx.Value(validatorsKey{}).(Validators)
+	return v, ok && !v.IsZero()
+}
+
+// DigestETag formats a hex encoded SHA256 digest as a strong ETag.
+func DigestETag(digest string) string {
+	return `"` + digest + `"`
+}
+
+func contentETag(b []byte) string {
+	digest := sha256.Sum256(b)
+	return DigestETag(hex.EncodeToString(digest[:]))
+}
+
+type headKey struct{}
+
+// WithHead tells a Repo the Body will be closed without being read, as for a HEAD request.
+// Caches finish storing a value they fetch for it, instead of abandoning it.
+func WithHead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, headKey{}, true)
+}
+
+func isHead(ctx context.Context) bool {
+	head, _ := ctx.Value(headKey{}).(bool)
+	return head
+}
+
+// ByteRange is a request for part of a file.
+type ByteRange struct {
+	// Range is the requested ranges, formatted as a HTTP Range header.
+	Range string
+	// IfRange identifies the version the client has part of, formatted as a HTTP If-Range header.
+	IfRange string
+}
+
+type byteRangeKey struct{}
+
+// WithByteRange asks a Repo to only return part of a file.
+// Repos that support range requests return a Body with Partial set, others return the whole file.
+func WithByteRange(ctx context.Context, r ByteRange) context.Context {
+	return context.WithValue(ctx, byteRangeKey{}, r)
+}
+
+// ByteRangeFromContext returns the ByteRange set by WithByteRange.
+func ByteRangeFromContext(ctx context.Context) (ByteRange, bool) {
+	r, ok := ctx.Value(byteRangeKey{}).(ByteRange)
+	return r, ok && r.Range != ""
+}
@@ -0,0 +1,231 @@
+package repo
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thepwagner/debcache/pkg/cache"
+)
+
+// poolDigests maps pool filenames to the SHA256 digests listed by cached Packages indexes.
+// Indexes are read when they are stored, so looking up a digest never waits for I/O.
+type poolDigests struct {
+	mu      sync.Mutex
+	digests map[string]string
+	// listed counts the indexes that list each pool file, which is forgotten once none do.
+	listed map[string]int
+	// indexed holds each index that was read, so it is only read again once it changes.
+	indexed map[cache.Key]indexedPool
+	// scanned is when the cached indexes were last listed, reading those cached before the process started and
+	// dropping those deleted or evicted since.
+	scanned  time.Time
+	scanning bool
+}
+
+// indexedPool is an index that was read, by its digest, and the pool files it lists.
+type indexedPool struct {
+	digest string
+	files  []string
+}
+
+// poolDigestsScanInterval is how often the cached indexes are listed.
+const poolDigestsScanInterval = 5 * time.Minute
+
+func newPoolDigests() *poolDigests {
+	return &poolDigests{
+		digests: map[string]string{},
+		listed:  map[string]int{},
+		indexed: map[cache.Key]indexedPool{},
+	}
+}
+
+// set replaces the pool files listed by an index. It must be called with p.mu held.
+func (p *poolDigests) set(key cache.Key, digest string, files map[string]string) {
+	p.forget(key)
+	idx := indexedPool{digest: digest, files: make([]string, 0, len(files))}
+	for filename, d := range files {
+		p.digests[filename] = d
+		p.listed[filename]++
+		idx.files = append(idx.files, filename)
+	}
+	p.indexed[key] = idx
+}
+
+// forget drops the pool files listed by an index. It must be called with p.mu held.
+func (p *poolDigests) forget(key cache.Key) {
+	for _, filename := range p.indexed[key].files {
+		p.listed[filename]--
+		if p.listed[filename] <= 0 {
+			delete(p.listed, filename)
+			delete(p.digests, filename)
+		}
+	}
+	delete(p.indexed, key)
+}
+
+// drop forgets the indexes that match, after they were deleted.
+func (p *poolDigests) drop(match func(cache.Key) bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key := range p.indexed {
+		if match(key) {
+			p.forget(key)
+		}
+	}
+}
+
+// startScan reports whether the cached indexes are due to be listed, and if so marks a scan as running.
+func (p *poolDigests) startScan(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.scanning || now.Sub(p.scanned) < poolDigestsScanInterval {
+		return false
+	}
+	p.scanning = true
+	return true
+}
+
+// storage returns where key is cached. Pool files are stored by content, if configured.
+func (c Cache) storage(key cache.Key) cache.Storage {
+	if c.Content != nil && (key.Namespace() == pool || key.Namespace() == sourcePool) {
+		return c.Content
+	}
+	return c.Storage
+}
+
+// Storages lists where this cache stores values.
+func (c Cache) Storages() []cache.Storage {
+	if c.Content != nil {
+		return []cache.Storage{c.Storage, c.Content}
+	}
+	return []cache.Storage{c.Storage}
+}
+
+// linkPool references a pool file that another cache already stored by content, so it is not fetched again.
+func (c Cache) linkPool(ctx context.Context, key cache.Key, filename string) {
+	if digest := c.poolDigest(filename); digest != "" {
+		c.Content.Link(ctx, key, digest)
+	}
+}
+
+// poolDigest returns the SHA256 digest of a pool file listed by a cached Packages index, empty if unknown.
+func (c Cache) poolDigest(filename string) string {
+	if c.digests == nil {
+		return ""
+	}
+	if c.digests.startScan(time.Now()) {
+		go c.indexPackages(context.Background())
+	}
+	c.digests.mu.Lock()
+	defer c.digests.mu.Unlock()
+	return c.digests.digests[filename]
+}
+
+// indexPackages reads the digests of pool files from every cached Packages index, including those fetched by hash.
+// Indexes that are no longer cached are dropped.
+func (c Cache) indexPackages(ctx context.Context) {
+	defer func() {
+		c.digests.mu.Lock()
+		defer c.digests.mu.Unlock()
+		c.digests.scanning = false
+		c.digests.scanned = time.Now()
+	}()
+
+	cached := map[cache.Key]bool{}
+	for _, prefix := range []cache.Key{packages.Key(), byHash.Key()} {
+		keys, err := c.Storage.Keys(ctx, prefix)
+		if err != nil {
+			slog.Warn("error listing cached indexes", slog.String("error", err.Error()))
+			return
+		}
+		for _, key := range keys {
+			if listsPool(key) {
+				cached[key] = true
+				c.indexPackage(ctx, key)
+			}
+		}
+	}
+
+	c.digests.mu.Lock()
+	defer c.digests.mu.Unlock()
+	for key := range c.digests.indexed {
+		if !cached[key] {
+			c.digests.forget(key)
+		}
+	}
+}
+
+// indexPackage reads the digests of pool files from a cached Packages index, unless it was already read.
+func (c Cache) indexPackage(ctx context.Context, key cache.Key) {
+	entry, ok := c.Storage.Stale(ctx, key)
+	if !ok {
+		c.digests.drop(func(k cache.Key) bool { return k == key })
+		return
+	}
+	defer entry.Close()
+
+	digest := entry.Metadata.SHA256
+	c.digests.mu.Lock()
+	indexed := digest != "" && c.digests.indexed[key].digest == digest
+	c.digests.mu.Unlock()
+	if indexed {
+		return
+	}
+
+	digests, err := readPoolDigests(entry)
+	if err != nil {
+		slog.Warn("error reading cached index", slog.Any("key", key), slog.String("error", err.Error()))
+	}
+	c.digests.mu.Lock()
+	defer c.digests.mu.Unlock()
+	c.digests.set(key, digest, digests)
+}
+
+// listsPool reports whether key is an index that lists the digests of pool files.
+func listsPool(key cache.Key) bool {
+	return key.Namespace() == packages || key.Namespace() == byHash && binaryByHash(key)
+}
+
+// binaryByHash reports whether a by-hash key is in an architecture's binary directory, where Packages are.
+func binaryByHash(key cache.Key) bool {
+	fields := strings.Split(strings.TrimPrefix(string(key), string(byHash.Key())), " ")
+	return len(fields) == 4 && fields[2] != "" && fields[2] != ArchitectureSource.String()
+}
+
+// readPoolDigests returns the Filename and SHA256 of each paragraph in a Packages index.
+// Other indexes that end up in binary by-hash directories, like Release, have neither.
+func readPoolDigests(entry *cache.Entry) (map[string]string, error) {
+	digests := map[string]string{}
+	r, err := Decompress(entry)
+	if err != nil {
+		return digests, err
+	}
+	var filename, digest string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 512*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if filename != "" && digest != "" {
+				digests[filename] = digest
+			}
+			filename, digest = "", ""
+		case strings.HasPrefix(line, "Filename:"):
+			filename = strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(line, "Filename:")), "pool/")
+		case strings.HasPrefix(line, "SHA256:"):
+			digest = strings.TrimSpace(strings.TrimPrefix(line, "SHA256:"))
+		}
+	}
+	if filename != "" && digest != "" {
+		digests[filename] = digest
+	}
+	return digests, scanner.Err()
+}
@@ -0,0 +1,39 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound is returned when the requested file does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrUpstreamUnavailable is returned when a file could not be fetched from an upstream.
+	ErrUpstreamUnavailable = errors.New("upstream unavailable")
+	// ErrVerificationFailed is returned when a file failed signature or checksum verification.
+	ErrVerificationFailed = errors.New("verification failed")
+	// ErrBadRequest is returned when the request itself is invalid.
+	ErrBadRequest = errors.New("bad request")
+	// ErrNotModified is returned for conditional requests (see WithValidators) when the file has not changed.
+	ErrNotModified = errors.New("not modified")
+)
+
+// UpstreamError is returned when an upstream failed to serve a file.
+// It matches ErrUpstreamUnavailable.
+type UpstreamError struct {
+	URL string
+	// StatusCode is the upstream's response status, or 0 if no response was received.
+	StatusCode int
+	Err        error
+}
+
+func (e *UpstreamError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("upstream %s unavailable: %v", e.URL, e.Err)
+	}
+	return fmt.Sprintf("unexpected status from upstream %s: %d", e.URL, e.StatusCode)
+}
+
+func (e *UpstreamError) Unwrap() error { return e.Err }
+
+func (e *UpstreamError) Is(target error) bool { return target == ErrUpstreamUnavailable }
@@ -0,0 +1,51 @@
+package repo
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/thepwagner/debcache/pkg/cache"
+)
+
+// errAbandoned is reported when a Body is closed before it was read to the end.
+var errAbandoned = errors.New("body closed before EOF")
+
+// inflight tracks concurrent cache misses, so only one request per key fetches from the source.
+type inflight struct {
+	mu      sync.Mutex
+	flights map[cache.Key]*flight
+}
+
+// flight is a fetch from the source that other requests can wait on.
+type flight struct {
+	done chan struct{}
+
+	// err is the error that ended the fetch, if any.
+	err error
+	// cancelled is set if the leading request went away before the fetch completed.
+	cancelled bool
+}
+
+func newInflight() *inflight {
+	return &inflight{flights: map[cache.Key]*flight{}}
+}
+
+// join returns the current flight for key. If there is none, a new flight is started and the caller must finish it.
+func (i *inflight) join(key cache.Key) (*flight, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if f, ok := i.flights[key]; ok {
+		return f, false
+	}
+	f := &flight{done: make(chan struct{})}
+	i.flights[key] = f
+	return f, true
+}
+
+// finish removes the flight for key and releases everyone waiting on it.
+func (i *inflight) finish(key cache.Key, f *flight) {
+	i.mu.Lock()
+	delete(i.flights, key)
+	i.mu.Unlock()
+	close(f.done)
+}
@@ -0,0 +1,53 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// ReadKeyring reads an armored or binary OpenPGP keyring, like those in /usr/share/keyrings.
+func ReadKeyring(in io.Reader) (openpgp.EntityList, error) {
+	br := bufio.NewReader(in)
+	if prefix, _ := br.Peek(len("-----BEGIN")); string(prefix) == "-----BEGIN" {
+		return openpgp.ReadArmoredKeyRing(br)
+	}
+	return openpgp.ReadKeyRing(br)
+}
+
+// ReadKeyringFile reads an armored or binary OpenPGP keyring from a file.
+func ReadKeyringFile(path string) (openpgp.EntityList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keyring, err := ReadKeyring(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading keyring %q: %w", path, err)
+	}
+	return keyring, nil
+}
+
+// ArmorKeyring returns the public keys of a keyring in PEM format.
+func ArmorKeyring(keyring openpgp.EntityList) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range keyring {
+		if err := e.Serialize(w); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
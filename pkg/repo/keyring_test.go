@@ -0,0 +1,50 @@
+package repo_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/debcache/pkg/repo"
+)
+
+func TestReadKeyringFile(t *testing.T) {
+	t.Parallel()
+
+	armored, err := repo.ReadKeyringFile("../dynamic/testdata/key.asc")
+	require.NoError(t, err)
+	require.Len(t, armored, 1)
+
+	var buf bytes.Buffer
+	require.NoError(t, armored[0].Serialize(&buf))
+	binaryPath := filepath.Join(t.TempDir(), "keyring.gpg")
+	require.NoError(t, os.WriteFile(binaryPath, buf.Bytes(), 0o600))
+
+	binary, err := repo.ReadKeyringFile(binaryPath)
+	require.NoError(t, err)
+	require.Len(t, binary, 1)
+	assert.Equal(t, armored[0].PrimaryKey.Fingerprint, binary[0].PrimaryKey.Fingerprint)
+
+	_, err = repo.ReadKeyringFile(filepath.Join(t.TempDir(), "missing.gpg"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestUpstream_SigningKeyPEM(t *testing.T) {
+	t.Parallel()
+
+	u, err := repo.UpstreamFromConfig(repo.UpstreamConfig{URL: "https://deb.debian.org/debian"})
+	require.NoError(t, err)
+	pem, err := u.SigningKeyPEM()
+	require.NoError(t, err)
+	assert.Empty(t, pem)
+
+	u, err = repo.UpstreamFromConfig(repo.UpstreamConfig{URL: "https://deb.debian.org/debian", Keyring: "../dynamic/testdata/key.asc"})
+	require.NoError(t, err)
+	pem, err = u.SigningKeyPEM()
+	require.NoError(t, err)
+	assert.Contains(t, string(pem), "-----BEGIN PGP PUBLIC KEY BLOCK-----")
+	assert.NotContains(t, string(pem), "PRIVATE")
+}
@@ -0,0 +1,214 @@
+package repo
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand/v2"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Mirror is one of the URLs an Upstream is served from.
+type Mirror struct {
+	URL url.URL
+	// Weight spreads requests across mirrors in proportion to their weights.
+	// Without weights, mirrors are tried in order.
+	Weight int
+}
+
+type MirrorConfig struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"`
+}
+
+const (
+	// mirrorBackoff is how long a mirror is avoided after failing, doubled for each consecutive failure.
+	mirrorBackoff    = 10 * time.Second
+	mirrorMaxBackoff = 5 * time.Minute
+)
+
+// mirror tracks the health of a Mirror.
+type mirror struct {
+	Mirror
+
+	mu             sync.Mutex
+	failures       int
+	unhealthyUntil time.Time
+	// latency is a moving average of the time to receive response headers.
+	latency time.Duration
+	// releases are the digests of the last InRelease served by the mirror, by distribution.
+	releases map[Distribution]string
+}
+
+func (m *mirror) succeeded(latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures = 0
+	m.unhealthyUntil = time.Time{}
+	if m.latency == 0 {
+		m.latency = latency
+	} else {
+		m.latency = (4*m.latency + latency) / 5
+	}
+}
+
+func (m *mirror) failed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures++
+	backoff := mirrorMaxBackoff
+	if m.failures < 10 {
+		backoff = min(mirrorBackoff<<(m.failures-1), mirrorMaxBackoff)
+	}
+	m.unhealthyUntil = time.Now().Add(backoff)
+}
+
+func (m *mirror) health() (bool, time.Time, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return time.Now().After(m.unhealthyUntil), m.unhealthyUntil, m.latency
+}
+
+func (m *mirror) release(dist Distribution) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.releases[dist]
+}
+
+func (m *mirror) setRelease(dist Distribution, digest string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.releases[dist] = digest
+}
+
+// releasePin is the mirror that served a distribution's InRelease.
+// Files described by the InRelease are fetched from the same mirror, or one serving an identical InRelease.
+type releasePin struct {
+	mirror *mirror
+	digest string
+}
+
+// mirrorSet chooses between the mirrors of an Upstream.
+type mirrorSet struct {
+	mirrors []*mirror
+	// preferLatency tries the fastest healthy mirror first.
+	preferLatency bool
+
+	mu     sync.RWMutex
+	pinned map[Distribution]releasePin
+}
+
+func newMirrorSet(mirrors []Mirror, preferLatency bool) *mirrorSet {
+	s := &mirrorSet{preferLatency: preferLatency, pinned: map[Distribution]releasePin{}}
+	for _, m := range mirrors {
+		s.mirrors = append(s.mirrors, &mirror{Mirror: m, releases: map[Distribution]string{}})
+	}
+	return s
+}
+
+// candidates returns the mirrors to try, in order. Unhealthy mirrors are only tried after healthy ones.
+// If preferred is healthy it is tried first.
+func (s *mirrorSet) candidates(preferred *mirror) []*mirror {
+	type candidate struct {
+		*mirror
+		until   time.Time
+		latency time.Duration
+	}
+	var healthy, unhealthy []candidate
+	for _, m := range s.mirrors {
+		ok, until, latency := m.health()
+		if ok {
+			healthy = append(healthy, candidate{mirror: m, latency: latency})
+		} else {
+			unhealthy = append(unhealthy, candidate{mirror: m, until: until})
+		}
+	}
+
+	switch {
+	case s.preferLatency:
+		// Mirrors without a measurement sort first, so they are measured:
+		slices.SortStableFunc(healthy, func(a, b candidate) int {
+			return cmp.Compare(a.latency, b.latency)
+		})
+	case s.weighted():
+		healthy = weightedShuffle(healthy, func(c candidate) int { return c.Weight })
+	}
+	slices.SortStableFunc(unhealthy, func(a, b candidate) int {
+		return a.until.Compare(b.until)
+	})
+
+	ret := make([]*mirror, 0, len(s.mirrors))
+	for _, c := range healthy {
+		if c.mirror == preferred {
+			ret = append([]*mirror{c.mirror}, ret...)
+		} else {
+			ret = append(ret, c.mirror)
+		}
+	}
+	for _, c := range unhealthy {
+		ret = append(ret, c.mirror)
+	}
+	return ret
+}
+
+func (s *mirrorSet) weighted() bool {
+	for _, m := range s.mirrors {
+		if m.Weight > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// weightedShuffle orders items randomly, with heavier items more likely to be first.
+// Items without weight are kept in order at the end.
+func weightedShuffle[T any](items []T, weight func(T) int) []T {
+	var weighted, unweighted []T
+	var total int
+	for _, item := range items {
+		if w := weight(item); w > 0 {
+			weighted = append(weighted, item)
+			total += w
+		} else {
+			unweighted = append(unweighted, item)
+		}
+	}
+
+	ret := make([]T, 0, len(items))
+	for len(weighted) > 0 {
+		n := rand.IntN(total)
+		for i, item := range weighted {
+			if n -= weight(item); n < 0 {
+				ret = append(ret, item)
+				total -= weight(item)
+				weighted = slices.Delete(weighted, i, i+1)
+				break
+			}
+		}
+	}
+	return append(ret, unweighted...)
+}
+
+func (s *mirrorSet) pin(dist Distribution) releasePin {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pinned[dist]
+}
+
+// served records the InRelease a mirror served, and pins the distribution to it.
+func (s *mirrorSet) served(dist Distribution, m *mirror, inRelease []byte) {
+	digest := releaseDigest(inRelease)
+	m.setRelease(dist, digest)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pinned[dist] = releasePin{mirror: m, digest: digest}
+}
+
+func releaseDigest(inRelease []byte) string {
+	digest := sha256.Sum256(inRelease)
+	return hex.EncodeToString(digest[:])
+}
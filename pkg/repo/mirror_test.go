@@ -0,0 +1,195 @@
+package repo_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/debcache/pkg/repo"
+)
+
+// testMirror serves files, counting requests. Files are looked up on each request so tests can change them.
+type testMirror struct {
+	url      url.URL
+	requests atomic.Int32
+	status   atomic.Int32
+	delay    time.Duration
+	files    atomic.Pointer[map[string]string]
+}
+
+func newTestMirror(tb testing.TB, files map[string]string) *testMirror {
+	tb.Helper()
+	m := &testMirror{}
+	m.files.Store(&files)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.requests.Add(1)
+		time.Sleep(m.delay)
+		if status := m.status.Load(); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+		b, ok := (*m.files.Load())[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(b))
+	}))
+	tb.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	require.NoError(tb, err)
+	m.url = *u
+	return m
+}
+
+func TestUpstream_MirrorFailover(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	files := map[string]string{"/pool/main/f/foo.deb": "foo"}
+
+	t.Run("server error", func(t *testing.T) {
+		t.Parallel()
+		a, b := newTestMirror(t, files), newTestMirror(t, files)
+		a.status.Store(http.StatusServiceUnavailable)
+		u := repo.NewMirroredUpstream(false, repo.Mirror{URL: a.url}, repo.Mirror{URL: b.url})
+
+		for i := 0; i < 3; i++ {
+			body, err := u.Pool(ctx, "main/f/foo.deb")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("foo"), readBody(t, body))
+		}
+		// The failed mirror is avoided until it recovers:
+		assert.Equal(t, int32(1), a.requests.Load())
+		assert.Equal(t, int32(3), b.requests.Load())
+	})
+
+	t.Run("connection error", func(t *testing.T) {
+		t.Parallel()
+		closed := httptest.NewServer(http.NotFoundHandler())
+		closedURL, err := url.Parse(closed.URL)
+		require.NoError(t, err)
+		closed.Close()
+		b := newTestMirror(t, files)
+		u := repo.NewMirroredUpstream(false, repo.Mirror{URL: *closedURL}, repo.Mirror{URL: b.url})
+
+		body, err := u.Pool(ctx, "main/f/foo.deb")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("foo"), readBody(t, body))
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		t.Parallel()
+		a, b := newTestMirror(t, files), newTestMirror(t, files)
+		u := repo.NewMirroredUpstream(false, repo.Mirror{URL: a.url}, repo.Mirror{URL: b.url})
+
+		_, err := u.Pool(ctx, "main/b/bar.deb")
+		assert.ErrorIs(t, err, repo.ErrNotFound)
+		assert.Equal(t, int32(0), b.requests.Load())
+	})
+
+	t.Run("all unavailable", func(t *testing.T) {
+		t.Parallel()
+		a, b := newTestMirror(t, files), newTestMirror(t, files)
+		a.status.Store(http.StatusInternalServerError)
+		b.status.Store(http.StatusBadGateway)
+		u := repo.NewMirroredUpstream(false, repo.Mirror{URL: a.url}, repo.Mirror{URL: b.url})
+
+		_, err := u.Pool(ctx, "main/f/foo.deb")
+		assert.ErrorIs(t, err, repo.ErrUpstreamUnavailable)
+	})
+}
+
+func TestUpstream_MirrorSelection(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	files := map[string]string{"/pool/main/f/foo.deb": "foo"}
+
+	t.Run("weighted", func(t *testing.T) {
+		t.Parallel()
+		a, b := newTestMirror(t, files), newTestMirror(t, files)
+		// Mirrors without weight are only used as a fallback:
+		u := repo.NewMirroredUpstream(false, repo.Mirror{URL: a.url}, repo.Mirror{URL: b.url, Weight: 1})
+
+		for i := 0; i < 3; i++ {
+			body, err := u.Pool(ctx, "main/f/foo.deb")
+			require.NoError(t, err)
+			readBody(t, body)
+		}
+		assert.Equal(t, int32(0), a.requests.Load())
+		assert.Equal(t, int32(3), b.requests.Load())
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		t.Parallel()
+		a, b := newTestMirror(t, files), newTestMirror(t, files)
+		a.delay = 50 * time.Millisecond
+		u := repo.NewMirroredUpstream(true, repo.Mirror{URL: a.url}, repo.Mirror{URL: b.url})
+
+		for i := 0; i < 4; i++ {
+			body, err := u.Pool(ctx, "main/f/foo.deb")
+			require.NoError(t, err)
+			readBody(t, body)
+		}
+		// Each mirror is measured, then the fastest is preferred:
+		assert.Equal(t, int32(1), a.requests.Load())
+		assert.Equal(t, int32(3), b.requests.Load())
+	})
+}
+
+func TestUpstream_MirrorConsistency(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	a := newTestMirror(t, map[string]string{
+		"/dists/test/InRelease":                  "release 2",
+		"/dists/test/main/binary-amd64/Packages": "packages 2",
+	})
+	b := newTestMirror(t, map[string]string{
+		"/dists/test/InRelease":                  "release 1",
+		"/dists/test/main/binary-amd64/Packages": "packages 1",
+	})
+	u := repo.NewMirroredUpstream(false, repo.Mirror{URL: a.url}, repo.Mirror{URL: b.url})
+
+	body, err := u.InRelease(ctx, "test")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("release 2"), readBody(t, body))
+
+	// The other mirror has not synced the release clients were given:
+	a.status.Store(http.StatusServiceUnavailable)
+	_, err = u.Packages(ctx, "test", "main", "amd64", repo.CompressionNone)
+	assert.ErrorIs(t, err, repo.ErrUpstreamUnavailable)
+
+	// Until it catches up:
+	b.files.Store(&map[string]string{
+		"/dists/test/InRelease":                  "release 2",
+		"/dists/test/main/binary-amd64/Packages": "packages 2",
+	})
+	body, err = u.Packages(ctx, "test", "main", "amd64", repo.CompressionNone)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("packages 2"), readBody(t, body))
+}
+
+func TestUpstreamFromConfig_Mirrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := repo.UpstreamFromConfig(repo.UpstreamConfig{})
+	require.Error(t, err)
+
+	a, b := newTestMirror(t, nil), newTestMirror(t, map[string]string{"/pool/main/f/foo.deb": "foo"})
+	a.status.Store(http.StatusServiceUnavailable)
+	u, err := repo.UpstreamFromConfig(repo.UpstreamConfig{
+		URL:     a.url.String(),
+		Mirrors: []repo.MirrorConfig{{URL: b.url.String()}},
+	})
+	require.NoError(t, err)
+
+	body, err := u.Pool(context.Background(), "main/f/foo.deb")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("foo"), readBody(t, body))
+}
@@ -0,0 +1,166 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/thepwagner/debcache/pkg/cache"
+)
+
+// refreshTimeout limits a background refresh, which is detached from the request that triggered it.
+const refreshTimeout = 5 * time.Minute
+
+// refreshable reports whether a key's content changes upstream. Pool files and by-hash indexes never change.
+func refreshable(key cache.Key) bool {
+	switch key.Namespace() {
+	case releases, packages, translations, sources, contents:
+		return true
+	default:
+		return false
+	}
+}
+
+// revalidate refreshes a cached value in the background once it is older than SoftTTL, while the cached value is served.
+// Indexes must match the InRelease clients are served, so they are only refreshed after their dist's InRelease changed.
+func (c Cache) revalidate(ctx context.Context, dist Distribution, key cache.Key, entry *cache.Entry, fetch func(context.Context) (*Body, error)) {
+	if c.SoftTTL <= 0 || c.inflight == nil || !refreshable(key) || entry.ModTime.IsZero() || time.Since(entry.ModTime) < c.SoftTTL {
+		return
+	}
+	release := releases.Key(dist.String())
+	if key == release {
+		c.refreshRelease(ctx, dist, entry.Metadata.SHA256)
+		return
+	}
+
+	// Wait for the next change to the InRelease, which is due for a refresh if it is as old as the index:
+	c.recent.add(dist, key, fetch, true)
+	digest := ""
+	if rel, ok := c.storage(release).Stale(ctx, release); ok {
+		_ = rel.Close()
+		if time.Since(rel.ModTime) < c.SoftTTL {
+			return
+		}
+		digest = rel.Metadata.SHA256
+	}
+	c.refreshRelease(ctx, dist, digest)
+}
+
+// refreshRelease refreshes the InRelease of dist in the background, then the indexes it describes if it no longer has
+// the given digest.
+func (c Cache) refreshRelease(ctx context.Context, dist Distribution, digest string) {
+	key := releases.Key(dist.String())
+	f, leader := c.inflight.join(key)
+	if !leader {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), refreshTimeout)
+		defer cancel()
+		c.refresh(ctx, key, func(ctx context.Context) (*Body, error) {
+			return c.Source.InRelease(ctx, dist)
+		}, f)
+
+		// Clients that see the new InRelease will ask for the indexes it describes:
+		if c.changed(ctx, key, digest) {
+			c.refreshIndexes(ctx, dist)
+		}
+	}()
+}
+
+// refresh fetches key from the source into the cache, as the leader of flight f.
+func (c Cache) refresh(ctx context.Context, key cache.Key, fetch func(context.Context) (*Body, error), f *flight) {
+	slog.Debug("refreshing cached value", slog.Any("key", key))
+	body, err := c.fill(ctx, key, fetch, func(err error) {
+		f.err = err
+		f.cancelled = ctx.Err() != nil || errors.Is(err, errAbandoned)
+		c.inflight.finish(key, f)
+	})
+	if err == nil {
+		_, err = io.Copy(io.Discard, body)
+		_ = body.Close()
+	}
+	if err != nil {
+		slog.Warn("error refreshing cached value", slog.Any("key", key), slog.String("error", err.Error()))
+	}
+}
+
+// changed reports whether the cached value of key no longer has the given digest.
+func (c Cache) changed(ctx context.Context, key cache.Key, digest string) bool {
+	entry, ok := c.storage(key).Open(ctx, key)
+	if !ok {
+		return false
+	}
+	_ = entry.Close()
+	return digest == "" || entry.Metadata.SHA256 != digest
+}
+
+// refreshIndexes refreshes the indexes of dist that were requested within RefreshRecent, or are waiting for a refresh.
+func (c Cache) refreshIndexes(ctx context.Context, dist Distribution) {
+	for key, fetch := range c.recent.get(dist, time.Now().Add(-c.RefreshRecent)) {
+		f, leader := c.inflight.join(key)
+		if !leader {
+			continue
+		}
+		c.refresh(ctx, key, fetch, f)
+	}
+}
+
+// track records a request for an index, so it can be refreshed with its dist's InRelease.
+func (c Cache) track(dist Distribution, key cache.Key, fetch func(context.Context) (*Body, error)) {
+	if c.RefreshRecent <= 0 || c.recent == nil {
+		return
+	}
+	c.recent.add(dist, key, fetch, false)
+}
+
+// recentIndexes tracks the indexes requested from each dist.
+type recentIndexes struct {
+	mu    sync.Mutex
+	dists map[Distribution]map[cache.Key]recentIndex
+}
+
+type recentIndex struct {
+	fetch     func(context.Context) (*Body, error)
+	requested time.Time
+	// stale is set if the index is waiting to be refreshed with its dist's InRelease.
+	stale bool
+}
+
+func newRecentIndexes() *recentIndexes {
+	return &recentIndexes{dists: map[Distribution]map[cache.Key]recentIndex{}}
+}
+
+func (r *recentIndexes) add(dist Distribution, key cache.Key, fetch func(context.Context) (*Body, error), stale bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	indexes, ok := r.dists[dist]
+	if !ok {
+		indexes = map[cache.Key]recentIndex{}
+		r.dists[dist] = indexes
+	}
+	stale = stale || indexes[key].stale
+	indexes[key] = recentIndex{fetch: fetch, requested: time.Now(), stale: stale}
+}
+
+// get returns the indexes of dist requested since the given time or waiting for a refresh, and forgets the others.
+func (r *recentIndexes) get(dist Distribution, since time.Time) map[cache.Key]func(context.Context) (*Body, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := map[cache.Key]func(context.Context) (*Body, error){}
+	for key, index := range r.dists[dist] {
+		if index.stale || !index.requested.Before(since) {
+			ret[key] = index.fetch
+		}
+		if index.stale || index.requested.Before(since) {
+			delete(r.dists[dist], key)
+		}
+	}
+	if len(r.dists[dist]) == 0 {
+		delete(r.dists, dist)
+	}
+	return ret
+}
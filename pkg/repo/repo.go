@@ -1,7 +1,12 @@
 package repo
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
 )
 
 // Distribution is a Debian distribution (e.g. "bookworm").
@@ -16,25 +21,92 @@ type Architecture string
 // Language is a Debian translation (e.g. "en").
 type Language string
 
+// ArchitectureSource addresses source package metadata, e.g. with ByHash.
+const ArchitectureSource Architecture = "source"
+
 func (d Distribution) String() string { return string(d) }
 func (c Component) String() string    { return string(c) }
 func (a Architecture) String() string { return string(a) }
 func (l Language) String() string     { return string(l) }
 
 // Repo is a source for Debian packages.
+// Each method returns ErrNotFound if the requested file does not exist, callers must Close the returned Body.
 type Repo interface {
 	// InRelease fetches a signed description of the repository and its contents
-	InRelease(ctx context.Context, dist Distribution) ([]byte, error)
+	InRelease(ctx context.Context, dist Distribution) (*Body, error)
+	// Release fetches an unsigned description of the repository and its contents.
+	Release(ctx context.Context, dist Distribution) (*Body, error)
+	// ReleaseGPG fetches the detached signature of Release.
+	ReleaseGPG(ctx context.Context, dist Distribution) (*Body, error)
 
-	Packages(ctx context.Context, dist Distribution, component Component, arch Architecture, compression Compression) ([]byte, error)
-	Translations(ctx context.Context, dist Distribution, component Component, lang Language, compression Compression) ([]byte, error)
+	Packages(ctx context.Context, dist Distribution, component Component, arch Architecture, compression Compression) (*Body, error)
+	Translations(ctx context.Context, dist Distribution, component Component, lang Language, compression Compression) (*Body, error)
+	// Sources fetches the index of source packages.
+	Sources(ctx context.Context, dist Distribution, component Component, compression Compression) (*Body, error)
+	// Contents fetches the index of files shipped by an architecture's packages.
+	Contents(ctx context.Context, dist Distribution, component Component, arch Architecture, compression Compression) (*Body, error)
 
 	// ByHash fetches metadata (e.g. an architecture's package list) by its hash.
-	ByHash(ctx context.Context, dist Distribution, component Component, arch Architecture, digest string) ([]byte, error)
+	// Metadata indexed per component (e.g. Contents) is fetched with an empty arch.
+	ByHash(ctx context.Context, dist Distribution, component Component, arch Architecture, digest string) (*Body, error)
 
-	// Pool fetches a package from the pool.
-	Pool(ctx context.Context, filename string) ([]byte, error)
+	// Pool fetches a package, or a source package's files, from the pool.
+	Pool(ctx context.Context, filename string) (*Body, error)
 
 	// SigningKeyPEM returns the signing key in PEM format.
 	SigningKeyPEM() ([]byte, error)
 }
+
+// CheckPoolFilename returns ErrBadRequest unless filename is a relative path to a file in the pool.
+// Empty names, "." and ".." segments, and absolute paths are rejected.
+func CheckPoolFilename(filename string) error {
+	if filename == "." || !fs.ValidPath(filename) {
+		return fmt.Errorf("%w: invalid filename %q", ErrBadRequest, filename)
+	}
+	return nil
+}
+
+// Body is the streamed content of a file served by a Repo.
+type Body struct {
+	io.ReadCloser
+	// Size is the length of the content in bytes, or -1 if unknown.
+	Size int64
+	// ModTime is when the content was last modified, zero if unknown.
+	ModTime time.Time
+	// ETag is a validator for the content, empty if unknown.
+	ETag string
+	// Partial is set if the Body only contains the ranges requested with WithByteRange.
+	Partial *Partial
+	// Stale is set if the content expired, and was served because the source was unavailable.
+	Stale bool
+}
+
+// Partial describes a Body that contains part of a file.
+type Partial struct {
+	// ContentRange is the range of a single part, formatted as a HTTP Content-Range header.
+	ContentRange string
+	// ContentType is the media type of a multipart Body.
+	ContentType string
+}
+
+// NewBody serves an in-memory file as a Body. The Body is seekable.
+func NewBody(b []byte, modTime time.Time) *Body {
+	return &Body{
+		ReadCloser: nopCloser{bytes.NewReader(b)},
+		Size:       int64(len(b)),
+		ModTime:    modTime,
+		ETag:       contentETag(b),
+	}
+}
+
+// Validators returns the Validators for this version of the content.
+func (b *Body) Validators() Validators {
+	return Validators{ETag: b.ETag, LastModified: b.ModTime}
+}
+
+// nopCloser is an io.ReadCloser that keeps the io.Seeker of a bytes.Reader.
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
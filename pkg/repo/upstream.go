@@ -1,88 +1,382 @@
 package repo
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/thepwagner/debcache/pkg/httpclient"
+	"github.com/thepwagner/debcache/pkg/metrics"
 )
 
-// Upstream is a remote repository.
+// Upstream is a remote repository, served by one or more mirrors.
 type Upstream struct {
-	URL    url.URL
-	client *http.Client
+	// Keyring holds the keys that sign the upstream, e.g. /usr/share/keyrings/debian-archive-keyring.gpg.
+	// If set, InRelease, Release and the index files they list are verified.
+	Keyring  openpgp.EntityList
+	client   *http.Client
+	auth     upstreamAuth
+	mirrors  *mirrorSet
+	releases *releaseIndexes
 }
 
 type UpstreamConfig struct {
 	URL string `yaml:"url"`
+	// Mirrors are tried after URL, if it is unavailable.
+	Mirrors []MirrorConfig `yaml:"mirrors"`
+	// PreferLatency tries the fastest healthy mirror first, instead of following order or weights.
+	PreferLatency bool `yaml:"preferLatency"`
+	// Keyring is the path to an armored or binary keyring that signs the upstream, enabling verification.
+	Keyring string `yaml:"keyring"`
+	// HTTP configures the client used to fetch from mirrors.
+	HTTP httpclient.Config `yaml:"http"`
+	// Auth authenticates requests to private repositories.
+	Auth UpstreamAuthConfig `yaml:"auth"`
 }
 
 var _ Repo = (*Upstream)(nil)
 
 func UpstreamFromConfig(cfg UpstreamConfig) (*Upstream, error) {
-	u, err := url.Parse(cfg.URL)
+	mirrorConfigs := cfg.Mirrors
+	if cfg.URL != "" {
+		mirrorConfigs = append([]MirrorConfig{{URL: cfg.URL}}, mirrorConfigs...)
+	}
+	if len(mirrorConfigs) == 0 {
+		return nil, fmt.Errorf("upstream url or mirrors are required")
+	}
+
+	mirrors := make([]Mirror, 0, len(mirrorConfigs))
+	for _, mirrorCfg := range mirrorConfigs {
+		u, err := url.Parse(mirrorCfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing upstream URL: %w", err)
+		}
+		slog.Debug("upstream repo", slog.String("url", u.Redacted()), slog.Int("weight", mirrorCfg.Weight))
+		mirrors = append(mirrors, Mirror{URL: *u, Weight: mirrorCfg.Weight})
+	}
+
+	client, err := httpclient.New(cfg.HTTP)
+	if err != nil {
+		return nil, fmt.Errorf("error creating upstream client: %w", err)
+	}
+	auth, err := newUpstreamAuth(cfg.Auth)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing upstream URL: %w", err)
+		return nil, err
 	}
-	slog.Debug("upstream repo", slog.String("url", u.String()))
-	return NewUpstream(*u), nil
+	upstream := NewMirroredUpstream(cfg.PreferLatency, mirrors...)
+	upstream.client = client
+	upstream.auth = auth
+	if cfg.Keyring != "" {
+		if upstream.Keyring, err = ReadKeyringFile(cfg.Keyring); err != nil {
+			return nil, err
+		}
+	}
+	return upstream, nil
 }
 
 func NewUpstream(baseURL url.URL) *Upstream {
+	return NewMirroredUpstream(false, Mirror{URL: baseURL})
+}
+
+// NewMirroredUpstream returns an Upstream that fails over between mirrors.
+// If preferLatency is set, the fastest healthy mirror is tried first.
+func NewMirroredUpstream(preferLatency bool, mirrors ...Mirror) *Upstream {
 	return &Upstream{
-		URL:    baseURL,
-		client: http.DefaultClient,
+		client:   http.DefaultClient,
+		mirrors:  newMirrorSet(mirrors, preferLatency),
+		releases: newReleaseIndexes(),
+	}
+}
+
+// URLs returns the URLs of the upstream's mirrors, in configured order.
+func (u Upstream) URLs() []url.URL {
+	urls := make([]url.URL, 0, len(u.mirrors.mirrors))
+	for _, m := range u.mirrors.mirrors {
+		urls = append(urls, m.URL)
+	}
+	return urls
+}
+
+func (u Upstream) InRelease(ctx context.Context, dist Distribution) (*Body, error) {
+	return u.fetchInRelease(ctx, dist)
+}
+
+func (u Upstream) Release(ctx context.Context, dist Distribution) (*Body, error) {
+	if len(u.Keyring) > 0 {
+		return u.getRelease(ctx, dist, "Release")
 	}
+	return u.getDist(ctx, dist, "Release")
 }
 
-func (u Upstream) InRelease(ctx context.Context, dist Distribution) ([]byte, error) {
-	return u.get(ctx, "dists", dist.String(), "InRelease")
+func (u Upstream) ReleaseGPG(ctx context.Context, dist Distribution) (*Body, error) {
+	if len(u.Keyring) > 0 {
+		return u.getRelease(ctx, dist, "Release.gpg")
+	}
+	return u.getDist(ctx, dist, "Release.gpg")
+}
+
+func (u Upstream) Packages(ctx context.Context, dist Distribution, component Component, arch Architecture, compression Compression) (*Body, error) {
+	return u.getIndex(ctx, dist, component.String(), fmt.Sprintf("binary-%s", arch), "Packages"+compression.Extension())
 }
 
-func (u Upstream) Packages(ctx context.Context, dist Distribution, component Component, arch Architecture, compression Compression) ([]byte, error) {
-	return u.get(ctx, "dists", dist.String(), component.String(), fmt.Sprintf("binary-%s", arch), "Packages"+compression.Extension())
+func (u Upstream) Translations(ctx context.Context, dist Distribution, component Component, lang Language, compression Compression) (*Body, error) {
+	return u.getIndex(ctx, dist, component.String(), "i18n", fmt.Sprintf("Translation-%s%s", lang, compression.Extension()))
 }
 
-func (u Upstream) Translations(ctx context.Context, dist Distribution, component Component, lang Language, compression Compression) ([]byte, error) {
-	return u.get(ctx, "dists", dist.String(), component.String(), "i18n", fmt.Sprintf("Translation-%s%s", lang, compression.Extension()))
+func (u Upstream) Sources(ctx context.Context, dist Distribution, component Component, compression Compression) (*Body, error) {
+	return u.getIndex(ctx, dist, component.String(), "source", "Sources"+compression.Extension())
 }
 
-func (u Upstream) ByHash(ctx context.Context, dist Distribution, component Component, arch Architecture, digest string) ([]byte, error) {
-	return u.get(ctx, "dists", dist.String(), component.String(), fmt.Sprintf("binary-%s", arch), "by-hash", "SHA256", digest)
+func (u Upstream) Contents(ctx context.Context, dist Distribution, component Component, arch Architecture, compression Compression) (*Body, error) {
+	return u.getIndex(ctx, dist, component.String(), fmt.Sprintf("Contents-%s%s", arch, compression.Extension()))
 }
 
-func (u Upstream) Pool(ctx context.Context, filename string) ([]byte, error) {
+func (u Upstream) ByHash(ctx context.Context, dist Distribution, component Component, arch Architecture, digest string) (*Body, error) {
+	dir := []string{"dists", dist.String(), component.String()}
+	switch arch {
+	case "":
+	case ArchitectureSource:
+		dir = append(dir, arch.String())
+	default:
+		dir = append(dir, fmt.Sprintf("binary-%s", arch))
+	}
+	if len(u.Keyring) > 0 {
+		// The digest can't be verified from part of the file:
+		ctx = WithByteRange(ctx, ByteRange{})
+	}
+	body, err := u.get(ctx, append(dir, "by-hash", "SHA256", digest)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Keyring) > 0 {
+		if err := u.verifyByHash(ctx, dist, digest, body); err != nil {
+			_ = body.Close()
+			return nil, err
+		}
+	}
+	// Content is addressed by its digest, which makes a better validator than the origin's:
+	body.ETag = DigestETag(digest)
+	return body, nil
+}
+
+func (u Upstream) Pool(ctx context.Context, filename string) (*Body, error) {
+	if err := CheckPoolFilename(filename); err != nil {
+		return nil, err
+	}
 	return u.get(ctx, "pool", filename)
 }
 
-func (u Upstream) get(ctx context.Context, path ...string) ([]byte, error) {
-	reqURL := u.URL.JoinPath(path...).String()
+// get fetches a file from the first available mirror.
+func (u Upstream) get(ctx context.Context, path ...string) (*Body, error) {
+	body, err := u.getFrom(ctx, u.mirrors.candidates(nil), nil, path...)
+	return body, err
+}
+
+// getDist fetches a file described by a distribution's InRelease.
+// Mirrors that serve a different InRelease than the one clients were given are skipped, since they are at a different sync state.
+func (u Upstream) getDist(ctx context.Context, dist Distribution, file ...string) (*Body, error) {
+	pin := u.mirrors.pin(dist)
+	inSync := func(m *mirror) error {
+		if pin.digest == "" || m == pin.mirror {
+			return nil
+		}
+		return u.inSync(ctx, m, dist, pin.digest)
+	}
+	return u.getFrom(ctx, u.mirrors.candidates(pin.mirror), inSync, append([]string{"dists", dist.String()}, file...)...)
+}
+
+// getFrom tries each mirror in turn, failing over while mirrors are unavailable.
+func (u Upstream) getFrom(ctx context.Context, mirrors []*mirror, check func(*mirror) error, path ...string) (*Body, error) {
+	var lastErr error
+	for _, m := range mirrors {
+		if check != nil {
+			if err := check(m); err != nil {
+				lastErr = err
+				continue
+			}
+		}
+		body, err := u.getMirror(ctx, m, path...)
+		if err != nil && failover(ctx, err) {
+			lastErr = err
+			continue
+		}
+		return body, err
+	}
+	return nil, lastErr
+}
+
+// failover reports whether an error means another mirror should be tried.
+func failover(ctx context.Context, err error) bool {
+	var upstreamErr *UpstreamError
+	if ctx.Err() != nil || !errors.As(err, &upstreamErr) {
+		return false
+	}
+	return upstreamErr.StatusCode == 0 || upstreamErr.StatusCode >= http.StatusInternalServerError
+}
+
+// fetchInRelease fetches the InRelease of a distribution, and pins the distribution to the mirror that served it.
+// If the upstream has a keyring, mirrors serving an InRelease that fails verification are skipped.
+func (u Upstream) fetchInRelease(ctx context.Context, dist Distribution) (*Body, error) {
+	// The InRelease is read completely, to compare between mirrors and verify the signature:
+	ctx = WithByteRange(ctx, ByteRange{})
+	var lastErr error
+	for _, m := range u.mirrors.candidates(nil) {
+		body, err := u.getMirror(ctx, m, "dists", dist.String(), "InRelease")
+		if err != nil {
+			if failover(ctx, err) {
+				lastErr = err
+				continue
+			}
+			return nil, err
+		}
+		b, err := io.ReadAll(body)
+		_ = body.Close()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			m.failed()
+			lastErr = &UpstreamError{URL: m.URL.JoinPath("dists", dist.String(), "InRelease").String(), Err: err}
+			continue
+		}
+
+		if len(u.Keyring) > 0 {
+			idx, err := u.parseReleaseIndex(b)
+			if err != nil {
+				slog.Warn("upstream InRelease failed verification", slog.String("url", m.URL.String()), slog.String("error", err.Error()))
+				m.failed()
+				lastErr = err
+				continue
+			}
+			u.releases.set(dist, idx)
+		}
+		u.mirrors.served(dist, m, b)
+
+		ret := NewBody(b, body.ModTime)
+		if body.ETag != "" {
+			ret.ETag = body.ETag
+		}
+		return ret, nil
+	}
+	return nil, lastErr
+}
+
+// inSync checks that a mirror serves the InRelease with the given digest.
+func (u Upstream) inSync(ctx context.Context, m *mirror, dist Distribution, digest string) error {
+	if m.release(dist) == digest {
+		return nil
+	}
+	reqURL := m.URL.JoinPath("dists", dist.String(), "InRelease").String()
+	ctx = WithValidators(WithByteRange(ctx, ByteRange{}), Validators{})
+	body, err := u.getMirror(ctx, m, "dists", dist.String(), "InRelease")
+	if err != nil {
+		var upstreamErr *UpstreamError
+		if errors.As(err, &upstreamErr) {
+			return err
+		}
+		return &UpstreamError{URL: reqURL, Err: fmt.Errorf("checking sync state: %v", err)}
+	}
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return &UpstreamError{URL: reqURL, Err: err}
+	}
+	actual := releaseDigest(b)
+	m.setRelease(dist, actual)
+	if actual != digest {
+		return &UpstreamError{URL: reqURL, Err: errMirrorOutOfSync}
+	}
+	return nil
+}
+
+var errMirrorOutOfSync = errors.New("mirror is at a different sync state")
+
+// getMirror fetches a file from a mirror, and tracks the mirror's health.
+func (u Upstream) getMirror(ctx context.Context, m *mirror, path ...string) (*Body, error) {
+	reqURL := m.URL.JoinPath(path...).String()
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("creating request: %w", err)
 	}
 	req.Header.Set("User-Agent", "debcache/1.0")
+	u.auth.apply(req)
+	if v, ok := ValidatorsFromContext(ctx); ok {
+		if v.ETag != "" {
+			req.Header.Set("If-None-Match", v.ETag)
+		}
+		if !v.LastModified.IsZero() {
+			req.Header.Set("If-Modified-Since", v.LastModified.UTC().Format(http.TimeFormat))
+		}
+	}
+	if r, ok := ByteRangeFromContext(ctx); ok {
+		req.Header.Set("Range", r.Range)
+		if r.IfRange != "" {
+			req.Header.Set("If-Range", r.IfRange)
+		}
+	}
 
+	repoName := metrics.Repo(ctx)
+	start := time.Now()
 	resp, err := u.client.Do(req)
+	latency := time.Since(start)
+	metrics.UpstreamDuration.WithLabelValues(repoName).Observe(latency.Seconds())
 	if err != nil {
-		return nil, fmt.Errorf("performing request: %w", err)
+		if ctx.Err() == nil {
+			m.failed()
+		}
+		metrics.UpstreamErrors.WithLabelValues(repoName, "0").Inc()
+		return nil, &UpstreamError{URL: reqURL, Err: err}
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		m.failed()
+	} else {
+		m.succeeded(latency)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status from upstream %s: %s", reqURL, resp.Status)
+	var partial *Partial
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPartialContent:
+		partial = &Partial{ContentRange: resp.Header.Get("Content-Range")}
+		if contentType := resp.Header.Get("Content-Type"); strings.HasPrefix(contentType, "multipart/") {
+			partial.ContentType = contentType
+		}
+	case http.StatusNotModified:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrNotModified, reqURL)
+	case http.StatusNotFound, http.StatusGone:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, reqURL)
+	default:
+		_ = resp.Body.Close()
+		metrics.UpstreamErrors.WithLabelValues(repoName, strconv.Itoa(resp.StatusCode)).Inc()
+		return nil, &UpstreamError{URL: reqURL, StatusCode: resp.StatusCode}
 	}
 
-	var buf bytes.Buffer
-	if _, err := io.Copy(&buf, resp.Body); err != nil {
-		return nil, fmt.Errorf("upstream read error: %w", err)
+	// The caller is responsible for closing the response body:
+	body := &Body{
+		ReadCloser: resp.Body,
+		Size:       resp.ContentLength,
+		ETag:       resp.Header.Get("ETag"),
+		Partial:    partial,
+	}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		body.ModTime = lastModified
 	}
-	return buf.Bytes(), nil
+	return body, nil
 }
 
 func (u Upstream) SigningKeyPEM() ([]byte, error) {
-	return nil, nil
+	if len(u.Keyring) == 0 {
+		return nil, nil
+	}
+	return ArmorKeyring(u.Keyring)
 }
@@ -2,15 +2,19 @@ package repo_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/debcache/pkg/httpclient"
 	"github.com/thepwagner/debcache/pkg/repo"
 )
 
@@ -21,7 +25,27 @@ func TestUpstream_InRelease(t *testing.T) {
 
 	res, err := u.InRelease(context.Background(), "test")
 	require.NoError(t, err)
-	require.Equal(t, []byte("1"), res)
+	require.Equal(t, []byte("1"), readBody(t, res))
+}
+
+func TestUpstream_Release(t *testing.T) {
+	t.Parallel()
+	srv := countingServer(t, "/dists/test/Release")
+	u := repo.NewUpstream(srv)
+
+	res, err := u.Release(context.Background(), "test")
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), readBody(t, res))
+}
+
+func TestUpstream_ReleaseGPG(t *testing.T) {
+	t.Parallel()
+	srv := countingServer(t, "/dists/test/Release.gpg")
+	u := repo.NewUpstream(srv)
+
+	res, err := u.ReleaseGPG(context.Background(), "test")
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), readBody(t, res))
 }
 
 func TestUpstream_Packages(t *testing.T) {
@@ -31,7 +55,7 @@ func TestUpstream_Packages(t *testing.T) {
 
 	res, err := u.Packages(context.Background(), "test", "component", "arch", repo.CompressionNone)
 	require.NoError(t, err)
-	require.Equal(t, []byte("1"), res)
+	require.Equal(t, []byte("1"), readBody(t, res))
 }
 
 func TestUpstream_Translations(t *testing.T) {
@@ -41,7 +65,27 @@ func TestUpstream_Translations(t *testing.T) {
 
 	res, err := u.Translations(context.Background(), "test", "component", "de", repo.CompressionBZIP)
 	require.NoError(t, err)
-	require.Equal(t, []byte("1"), res) // das ist gut
+	require.Equal(t, []byte("1"), readBody(t, res)) // das ist gut
+}
+
+func TestUpstream_Sources(t *testing.T) {
+	t.Parallel()
+	srv := countingServer(t, "/dists/test/component/source/Sources.xz")
+	u := repo.NewUpstream(srv)
+
+	res, err := u.Sources(context.Background(), "test", "component", repo.CompressionXZ)
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), readBody(t, res))
+}
+
+func TestUpstream_Contents(t *testing.T) {
+	t.Parallel()
+	srv := countingServer(t, "/dists/test/component/Contents-arch.gz")
+	u := repo.NewUpstream(srv)
+
+	res, err := u.Contents(context.Background(), "test", "component", "arch", repo.CompressionGZIP)
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), readBody(t, res))
 }
 
 func TestUpstream_ByHash(t *testing.T) {
@@ -51,7 +95,27 @@ func TestUpstream_ByHash(t *testing.T) {
 
 	res, err := u.ByHash(context.Background(), "test", "component", "arch", "abc123")
 	require.NoError(t, err)
-	require.Equal(t, []byte("1"), res)
+	require.Equal(t, []byte("1"), readBody(t, res))
+}
+
+func TestUpstream_ByHashComponent(t *testing.T) {
+	t.Parallel()
+	srv := countingServer(t, "/dists/test/component/by-hash/SHA256/abc123")
+	u := repo.NewUpstream(srv)
+
+	res, err := u.ByHash(context.Background(), "test", "component", "", "abc123")
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), readBody(t, res))
+}
+
+func TestUpstream_ByHashSource(t *testing.T) {
+	t.Parallel()
+	srv := countingServer(t, "/dists/test/component/source/by-hash/SHA256/abc123")
+	u := repo.NewUpstream(srv)
+
+	res, err := u.ByHash(context.Background(), "test", "component", repo.ArchitectureSource, "abc123")
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), readBody(t, res))
 }
 
 func TestUpstream_Pool(t *testing.T) {
@@ -61,7 +125,26 @@ func TestUpstream_Pool(t *testing.T) {
 
 	res, err := u.Pool(context.Background(), "component/p/pkg/pkg_1.0_amd64.deb")
 	require.NoError(t, err)
-	require.Equal(t, []byte("1"), res)
+	require.Equal(t, []byte("1"), readBody(t, res))
+}
+
+func TestUpstream_PoolInvalidFilename(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request: %s", r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	upstream := repo.NewUpstream(*u)
+	cached := repo.NewCache(upstream, testCacheStorage())
+
+	for _, filename := range []string{"", ".", "..", "../dists/bookworm/InRelease", "main/../../etc/passwd", "/etc/passwd", "main/f/"} {
+		_, err := upstream.Pool(context.Background(), filename)
+		assert.ErrorIs(t, err, repo.ErrBadRequest, filename)
+		_, err = cached.Pool(context.Background(), filename)
+		assert.ErrorIs(t, err, repo.ErrBadRequest, filename)
+	}
 }
 
 func countingServer(tb testing.TB, path string) url.URL {
@@ -77,3 +160,157 @@ func countingServer(tb testing.TB, path string) url.URL {
 	u, _ := url.Parse(srv.URL)
 	return *u
 }
+
+func readBody(tb testing.TB, body *repo.Body) []byte {
+	tb.Helper()
+	require.NotNil(tb, body)
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	require.NoError(tb, err)
+	return b
+}
+
+func TestUpstream_Conditional(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"abc"` || r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"abc"`)
+		_, _ = w.Write([]byte("release"))
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	upstream := repo.NewUpstream(*u)
+
+	ctx := context.Background()
+	res, err := upstream.InRelease(ctx, "test")
+	require.NoError(t, err)
+	assert.Equal(t, `"abc"`, res.ETag)
+	assert.Equal(t, []byte("release"), readBody(t, res))
+
+	_, err = upstream.InRelease(repo.WithValidators(ctx, res.Validators()), "test")
+	require.ErrorIs(t, err, repo.ErrNotModified)
+
+	_, err = upstream.InRelease(repo.WithValidators(ctx, repo.Validators{LastModified: time.Now()}), "test")
+	require.ErrorIs(t, err, repo.ErrNotModified)
+}
+
+func TestUpstream_Errors(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		status     int
+		expected   error
+		statusCode int
+	}{
+		"not found":   {status: http.StatusNotFound, expected: repo.ErrNotFound},
+		"gone":        {status: http.StatusGone, expected: repo.ErrNotFound},
+		"error":       {status: http.StatusInternalServerError, expected: repo.ErrUpstreamUnavailable, statusCode: http.StatusInternalServerError},
+		"unavailable": {status: http.StatusServiceUnavailable, expected: repo.ErrUpstreamUnavailable, statusCode: http.StatusServiceUnavailable},
+	}
+
+	for label, tc := range cases {
+		tc := tc
+		t.Run(label, func(t *testing.T) {
+			t.Parallel()
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(tc.status)
+			}))
+			t.Cleanup(srv.Close)
+			u, err := url.Parse(srv.URL)
+			require.NoError(t, err)
+
+			_, err = repo.NewUpstream(*u).InRelease(context.Background(), "test")
+			require.ErrorIs(t, err, tc.expected)
+
+			var upstreamErr *repo.UpstreamError
+			if tc.statusCode != 0 {
+				require.ErrorAs(t, err, &upstreamErr)
+				assert.Equal(t, tc.statusCode, upstreamErr.StatusCode)
+			} else {
+				assert.False(t, errors.As(err, &upstreamErr))
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		t.Parallel()
+		srv := httptest.NewServer(http.NotFoundHandler())
+		u, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+		srv.Close()
+
+		_, err = repo.NewUpstream(*u).InRelease(context.Background(), "test")
+		require.ErrorIs(t, err, repo.ErrUpstreamUnavailable)
+		var upstreamErr *repo.UpstreamError
+		require.ErrorAs(t, err, &upstreamErr)
+		assert.Equal(t, 0, upstreamErr.StatusCode)
+	})
+}
+
+func TestUpstreamFromConfig_HTTP(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("foo"))
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := repo.UpstreamFromConfig(repo.UpstreamConfig{
+		URL:  srv.URL,
+		HTTP: httpclient.Config{Retries: 1, RetryBackoff: time.Millisecond},
+	})
+	require.NoError(t, err)
+	body, err := u.Pool(context.Background(), "main/f/foo.deb")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("foo"), readBody(t, body))
+	assert.Equal(t, int32(2), requests.Load())
+
+	_, err = repo.UpstreamFromConfig(repo.UpstreamConfig{
+		URL:  srv.URL,
+		HTTP: httpclient.Config{CAFile: "testdata/missing.pem"},
+	})
+	assert.Error(t, err)
+}
+
+func TestUpstreamFromConfig_Auth(t *testing.T) {
+	t.Setenv("DEBCACHE_TEST_UPSTREAM_TOKEN", "s3cret")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s|%s", r.Header.Get("Authorization"), r.Header.Get("X-Api-Key"))
+	}))
+	t.Cleanup(srv.Close)
+
+	cases := map[string]struct {
+		auth     repo.UpstreamAuthConfig
+		expected string
+	}{
+		"none":   {expected: "|"},
+		"basic":  {auth: repo.UpstreamAuthConfig{Username: "user", Password: "pass"}, expected: "Basic dXNlcjpwYXNz|"},
+		"bearer": {auth: repo.UpstreamAuthConfig{Token: "env.DEBCACHE_TEST_UPSTREAM_TOKEN"}, expected: "Bearer s3cret|"},
+		"headers": {
+			auth:     repo.UpstreamAuthConfig{Headers: map[string]string{"x-api-key": "env.DEBCACHE_TEST_UPSTREAM_TOKEN"}},
+			expected: "|s3cret",
+		},
+	}
+	for name, tc := range cases {
+		u, err := repo.UpstreamFromConfig(repo.UpstreamConfig{URL: srv.URL, Auth: tc.auth})
+		require.NoError(t, err, name)
+		body, err := u.Pool(context.Background(), "main/f/foo.deb")
+		require.NoError(t, err, name)
+		assert.Equal(t, tc.expected, string(readBody(t, body)), name)
+	}
+
+	_, err := repo.UpstreamFromConfig(repo.UpstreamConfig{URL: srv.URL, Auth: repo.UpstreamAuthConfig{Username: "user", Token: "token"}})
+	assert.Error(t, err)
+	_, err = repo.UpstreamFromConfig(repo.UpstreamConfig{URL: srv.URL, Auth: repo.UpstreamAuthConfig{Token: "file.testdata/missing"}})
+	assert.Error(t, err)
+}
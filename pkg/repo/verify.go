@@ -0,0 +1,299 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/thepwagner/debcache/pkg/debian"
+)
+
+// releaseIndex is the files listed by a verified InRelease.
+type releaseIndex struct {
+	// files maps paths relative to the distribution to their digest and size.
+	files map[string]releaseFile
+	// digests maps SHA256 digests to sizes, for by-hash files.
+	digests map[string]int64
+}
+
+type releaseFile struct {
+	digest string
+	size   int64
+}
+
+// releaseIndexes holds the last verified InRelease of each distribution.
+// The previous InRelease is kept as well, since clients and mirrors may lag behind.
+type releaseIndexes struct {
+	mu       sync.RWMutex
+	current  map[Distribution]*releaseIndex
+	previous map[Distribution]*releaseIndex
+}
+
+func newReleaseIndexes() *releaseIndexes {
+	return &releaseIndexes{
+		current:  map[Distribution]*releaseIndex{},
+		previous: map[Distribution]*releaseIndex{},
+	}
+}
+
+func (r *releaseIndexes) get(dist Distribution) (*releaseIndex, *releaseIndex) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current[dist], r.previous[dist]
+}
+
+func (r *releaseIndexes) indexes(dist Distribution) []*releaseIndex {
+	cur, prev := r.get(dist)
+	var ret []*releaseIndex
+	for _, idx := range []*releaseIndex{cur, prev} {
+		if idx != nil {
+			ret = append(ret, idx)
+		}
+	}
+	return ret
+}
+
+func (r *releaseIndexes) set(dist Distribution, idx *releaseIndex) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cur, ok := r.current[dist]; ok {
+		r.previous[dist] = cur
+	}
+	r.current[dist] = idx
+}
+
+// parseReleaseIndex verifies a clearsigned InRelease against the keyring, and returns the files it lists.
+func (u Upstream) parseReleaseIndex(inRelease []byte) (*releaseIndex, error) {
+	block, _ := clearsign.Decode(inRelease)
+	if block == nil {
+		return nil, fmt.Errorf("%w: InRelease is not clearsigned", ErrVerificationFailed)
+	}
+	if _, err := block.VerifySignature(u.Keyring, nil); err != nil {
+		return nil, fmt.Errorf("%w: InRelease signature: %w", ErrVerificationFailed, err)
+	}
+
+	graphs, err := debian.ParseControlFile(bytes.NewReader(block.Plaintext))
+	if err != nil {
+		return nil, fmt.Errorf("%w: parsing InRelease: %w", ErrVerificationFailed, err)
+	}
+	if len(graphs) == 0 {
+		return nil, fmt.Errorf("%w: InRelease is empty", ErrVerificationFailed)
+	}
+
+	idx := &releaseIndex{files: map[string]releaseFile{}, digests: map[string]int64{}}
+	for _, line := range strings.Split(graphs[0]["SHA256"], "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: parsing size of %q: %w", ErrVerificationFailed, fields[2], err)
+		}
+		idx.files[fields[2]] = releaseFile{digest: fields[0], size: size}
+		idx.digests[fields[0]] = size
+	}
+	return idx, nil
+}
+
+// refreshRelease fetches and verifies the InRelease of a distribution, for verifying the files it lists.
+func (u Upstream) refreshRelease(ctx context.Context, dist Distribution) error {
+	// Don't pass along conditions meant for a different file:
+	ctx = WithValidators(ctx, Validators{})
+	body, err := u.fetchInRelease(ctx, dist)
+	if err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+// releaseFile returns the digest and size of a file listed by the InRelease, fetching InRelease if necessary.
+func (u Upstream) releaseFile(ctx context.Context, dist Distribution, name string) (releaseFile, bool, error) {
+	cur, _ := u.releases.get(dist)
+	if cur == nil {
+		if err := u.refreshRelease(ctx, dist); err != nil {
+			return releaseFile{}, false, err
+		}
+		cur, _ = u.releases.get(dist)
+	}
+	f, ok := cur.files[name]
+	return f, ok, nil
+}
+
+// getIndex fetches an index file of a distribution, which is verified against the InRelease if the upstream has a keyring.
+func (u Upstream) getIndex(ctx context.Context, dist Distribution, file ...string) (*Body, error) {
+	if len(u.Keyring) == 0 {
+		return u.getDist(ctx, dist, file...)
+	}
+
+	name := path.Join(file...)
+	expected, ok, err := u.releaseFile(ctx, dist, name)
+	if err != nil {
+		return nil, err
+	}
+	// The digest can't be verified from part of the file:
+	ctx = WithByteRange(ctx, ByteRange{})
+	body, err := u.getDist(ctx, dist, file...)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok || (body.Size >= 0 && body.Size != expected.size) {
+		// The upstream may have been updated since InRelease was verified:
+		if err := u.refreshRelease(ctx, dist); err != nil {
+			_ = body.Close()
+			return nil, err
+		}
+		expected, ok, _ = u.releaseFile(ctx, dist, name)
+	}
+	if !ok {
+		_ = body.Close()
+		return nil, fmt.Errorf("%w: %s is not listed in InRelease", ErrVerificationFailed, name)
+	}
+	if body.Size >= 0 && body.Size != expected.size {
+		_ = body.Close()
+		return nil, fmt.Errorf("%w: %s has size %d, expected %d", ErrVerificationFailed, name, body.Size, expected.size)
+	}
+	if err := verifyBody(body, path.Join("dists", dist.String(), name), expected.digest, expected.size); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// getRelease fetches Release or Release.gpg, along with the other, and returns it once the detached signature is verified.
+func (u Upstream) getRelease(ctx context.Context, dist Distribution, name string) (*Body, error) {
+	// Both files are read completely, to verify the signature:
+	ctx = WithByteRange(ctx, ByteRange{})
+	body, b, err := u.readDist(ctx, dist, name)
+	if err != nil {
+		return nil, err
+	}
+	other := "Release.gpg"
+	if name == other {
+		other = "Release"
+	}
+	// Don't pass along conditions meant for a different file:
+	_, otherBytes, err := u.readDist(WithValidators(ctx, Validators{}), dist, other)
+	if err != nil {
+		return nil, err
+	}
+
+	release, sig := b, otherBytes
+	if name != "Release" {
+		release, sig = otherBytes, b
+	}
+	check := openpgp.CheckDetachedSignature
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN")) {
+		check = openpgp.CheckArmoredDetachedSignature
+	}
+	if _, err := check(u.Keyring, bytes.NewReader(release), bytes.NewReader(sig), nil); err != nil {
+		return nil, fmt.Errorf("%w: Release signature: %w", ErrVerificationFailed, err)
+	}
+
+	ret := NewBody(b, body.ModTime)
+	if body.ETag != "" {
+		ret.ETag = body.ETag
+	}
+	return ret, nil
+}
+
+// readDist reads a file described by a distribution's InRelease.
+func (u Upstream) readDist(ctx context.Context, dist Distribution, name string) (*Body, []byte, error) {
+	body, err := u.getDist(ctx, dist, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, nil, &UpstreamError{URL: path.Join("dists", dist.String(), name), Err: err}
+	}
+	return body, b, nil
+}
+
+// verifyByHash checks a by-hash body against the digests listed by the InRelease.
+func (u Upstream) verifyByHash(ctx context.Context, dist Distribution, digest string, body *Body) error {
+	size, ok := u.digestSize(dist, digest)
+	if !ok {
+		if err := u.refreshRelease(ctx, dist); err != nil {
+			return err
+		}
+		if size, ok = u.digestSize(dist, digest); !ok {
+			return fmt.Errorf("%w: %s is not listed in InRelease", ErrVerificationFailed, digest)
+		}
+	}
+	return verifyBody(body, digest, digest, size)
+}
+
+// digestSize returns the size of a by-hash file listed by the InRelease.
+func (u Upstream) digestSize(dist Distribution, digest string) (int64, bool) {
+	for _, idx := range u.releases.indexes(dist) {
+		if size, ok := idx.digests[digest]; ok {
+			return size, true
+		}
+	}
+	return 0, false
+}
+
+// bufferedIndexSize is the largest index that is read and verified before it is served.
+const bufferedIndexSize = 64 << 20
+
+// verifyBody checks a body against its SHA256 digest. Bodies up to bufferedIndexSize are checked before they are
+// returned, so a mismatch is an error instead of a response that fails once it started. Larger bodies are checked
+// as they are read.
+func verifyBody(body *Body, name, digest string, size int64) error {
+	verifying := newVerifyingReader(body.ReadCloser, name, digest)
+	if size > bufferedIndexSize {
+		body.ReadCloser = verifying
+		return nil
+	}
+
+	b, err := io.ReadAll(verifying)
+	_ = body.Close()
+	if errors.Is(err, ErrVerificationFailed) {
+		return err
+	} else if err != nil {
+		return &UpstreamError{URL: name, Err: err}
+	}
+	body.ReadCloser = nopCloser{bytes.NewReader(b)}
+	body.Size = int64(len(b))
+	return nil
+}
+
+// verifyingReader returns ErrVerificationFailed instead of io.EOF if the content does not match the digest.
+// repo.Cache only stores values that are read to EOF, so mismatched content is never cached.
+// A response that is already being served when the mismatch is found is aborted.
+type verifyingReader struct {
+	io.ReadCloser
+	name   string
+	digest string
+	hash   hash.Hash
+}
+
+func newVerifyingReader(rc io.ReadCloser, name, digest string) *verifyingReader {
+	return &verifyingReader{ReadCloser: rc, name: name, digest: digest, hash: sha256.New()}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.hash.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		if actual := hex.EncodeToString(v.hash.Sum(nil)); actual != v.digest {
+			slog.Warn("upstream digest mismatch", slog.String("file", v.name), slog.String("expected", v.digest), slog.String("actual", actual))
+			return n, fmt.Errorf("%w: %s has SHA256 %s, expected %s", ErrVerificationFailed, v.name, actual, v.digest)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,166 @@
+package repo_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/debcache/pkg/cache"
+	"github.com/thepwagner/debcache/pkg/repo"
+)
+
+func TestUpstream_Verify(t *testing.T) {
+	t.Parallel()
+
+	signer, err := openpgp.NewEntity("debcache", "", "test@example.com", nil)
+	require.NoError(t, err)
+	other, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	require.NoError(t, err)
+
+	packages := []byte("packages")
+	packagesDigest := sha256Hex(packages)
+	release := fmt.Sprintf("Suite: test\nSHA256:\n %s %d main/binary-amd64/Packages\n %s %d main/binary-amd64/Packages.xz\n",
+		packagesDigest, len(packages), packagesDigest, len(packages))
+	files := map[string][]byte{
+		"/dists/test/InRelease":                                          clearsignRelease(t, signer, release),
+		"/dists/forged/InRelease":                                        clearsignRelease(t, other, release),
+		"/dists/test/Release":                                            []byte(release),
+		"/dists/test/Release.gpg":                                        detachSignRelease(t, signer, release),
+		"/dists/forged/Release":                                          []byte(release),
+		"/dists/forged/Release.gpg":                                      detachSignRelease(t, other, release),
+		"/dists/test/main/binary-amd64/Packages":                         packages,
+		"/dists/test/main/binary-amd64/Packages.xz":                      []byte("poisoned"),
+		"/dists/test/main/i18n/Translation-en":                           []byte("translation"),
+		"/dists/test/main/binary-amd64/by-hash/SHA256/" + packagesDigest: packages,
+		"/dists/test/main/binary-amd64/by-hash/SHA256/" + sha256Hex([]byte("unlisted")): []byte("unlisted"),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(b)
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	newUpstream := func() *repo.Upstream {
+		upstream := repo.NewUpstream(*u)
+		upstream.Keyring = openpgp.EntityList{signer}
+		return upstream
+	}
+	ctx := context.Background()
+
+	t.Run("InRelease", func(t *testing.T) {
+		t.Parallel()
+		body, err := newUpstream().InRelease(ctx, "test")
+		require.NoError(t, err)
+		assert.Equal(t, files["/dists/test/InRelease"], readBody(t, body))
+	})
+
+	t.Run("forged InRelease", func(t *testing.T) {
+		t.Parallel()
+		_, err := newUpstream().InRelease(ctx, "forged")
+		assert.ErrorIs(t, err, repo.ErrVerificationFailed)
+	})
+
+	t.Run("Release", func(t *testing.T) {
+		t.Parallel()
+		body, err := newUpstream().Release(ctx, "test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte(release), readBody(t, body))
+		body, err = newUpstream().ReleaseGPG(ctx, "test")
+		require.NoError(t, err)
+		assert.Equal(t, files["/dists/test/Release.gpg"], readBody(t, body))
+	})
+
+	t.Run("forged Release", func(t *testing.T) {
+		t.Parallel()
+		storage := testCacheStorage()
+		cached := repo.NewCache(newUpstream(), storage)
+
+		_, err := cached.Release(ctx, "forged")
+		assert.ErrorIs(t, err, repo.ErrVerificationFailed)
+		_, err = cached.ReleaseGPG(ctx, "forged")
+		assert.ErrorIs(t, err, repo.ErrVerificationFailed)
+
+		keys, err := storage.Keys(ctx, cache.Key(""))
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+
+	t.Run("Packages", func(t *testing.T) {
+		t.Parallel()
+		body, err := newUpstream().Packages(ctx, "test", "main", "amd64", repo.CompressionNone)
+		require.NoError(t, err)
+		assert.Equal(t, packages, readBody(t, body))
+	})
+
+	t.Run("poisoned Packages", func(t *testing.T) {
+		t.Parallel()
+		storage := testCacheStorage()
+		cached := repo.NewCache(newUpstream(), storage)
+
+		// Indexes are verified before they are served:
+		_, err := cached.Packages(ctx, "test", "main", "amd64", repo.CompressionXZ)
+		assert.ErrorIs(t, err, repo.ErrVerificationFailed)
+
+		keys, err := storage.Keys(ctx, cache.Key(""))
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+
+	t.Run("unlisted Translation", func(t *testing.T) {
+		t.Parallel()
+		_, err := newUpstream().Translations(ctx, "test", "main", "en", repo.CompressionNone)
+		assert.ErrorIs(t, err, repo.ErrVerificationFailed)
+	})
+
+	t.Run("ByHash", func(t *testing.T) {
+		t.Parallel()
+		body, err := newUpstream().ByHash(ctx, "test", "main", "amd64", packagesDigest)
+		require.NoError(t, err)
+		assert.Equal(t, packages, readBody(t, body))
+	})
+
+	t.Run("unlisted ByHash", func(t *testing.T) {
+		t.Parallel()
+		_, err := newUpstream().ByHash(ctx, "test", "main", "amd64", sha256Hex([]byte("unlisted")))
+		assert.ErrorIs(t, err, repo.ErrVerificationFailed)
+	})
+}
+
+func clearsignRelease(tb testing.TB, signer *openpgp.Entity, release string) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, signer.PrivateKey, nil)
+	require.NoError(tb, err)
+	_, err = w.Write([]byte(release))
+	require.NoError(tb, err)
+	require.NoError(tb, w.Close())
+	return buf.Bytes()
+}
+
+func detachSignRelease(tb testing.TB, signer *openpgp.Entity, release string) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	require.NoError(tb, openpgp.ArmoredDetachSign(&buf, signer, bytes.NewReader([]byte(release)), nil))
+	return buf.Bytes()
+}
+
+func sha256Hex(b []byte) string {
+	digest := sha256.Sum256(b)
+	return hex.EncodeToString(digest[:])
+}
@@ -0,0 +1,90 @@
+package secret
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Value resolves a configured secret. Values with an `env.` prefix are read from the environment,
+// values with a `file.` prefix are read from a file, and anything else is used as is.
+func Value(s string) (string, error) {
+	if name, ok := strings.CutPrefix(s, "env."); ok {
+		return os.Getenv(name), nil
+	}
+	if path, ok := strings.CutPrefix(s, "file."); ok {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading secret: %w", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	return s, nil
+}
+
+// IsReference reports whether a configured secret refers to the environment or a file, rather than being the secret itself.
+func IsReference(s string) bool {
+	return strings.HasPrefix(s, "env.") || strings.HasPrefix(s, "file.")
+}
+
+// sensitiveKeys are configuration keys that hold secrets, in lowercase. Keys are matched case-insensitively.
+var sensitiveKeys = map[string]struct{}{
+	"username":   {},
+	"password":   {},
+	"token":      {},
+	"headers":    {},
+	"signingkey": {},
+}
+
+const redacted = "REDACTED"
+
+// Redact returns a copy of a decoded configuration that is safe to log.
+// Secrets are replaced unless they refer to the environment or a file, and passwords are removed from URLs.
+func Redact(config map[string]any) map[string]any {
+	ret := make(map[string]any, len(config))
+	for k, v := range config {
+		if _, ok := sensitiveKeys[strings.ToLower(k)]; ok {
+			ret[k] = redactSecret(v)
+		} else {
+			ret[k] = redactValue(v)
+		}
+	}
+	return ret
+}
+
+func redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		return Redact(v)
+	case []any:
+		ret := make([]any, len(v))
+		for i, item := range v {
+			ret[i] = redactValue(item)
+		}
+		return ret
+	case string:
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			return u.Redacted()
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func redactSecret(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		ret := make(map[string]any, len(v))
+		for k, item := range v {
+			ret[k] = redactSecret(item)
+		}
+		return ret
+	case string:
+		if IsReference(v) {
+			return v
+		}
+	}
+	return redacted
+}
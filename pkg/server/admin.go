@@ -0,0 +1,189 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/thepwagner/debcache/pkg/cache"
+	"github.com/thepwagner/debcache/pkg/dynamic"
+	"github.com/thepwagner/debcache/pkg/repo"
+	"github.com/thepwagner/debcache/pkg/secret"
+)
+
+// AdminConfig enables the admin API.
+type AdminConfig struct {
+	// Addr is a separate listener for the admin API. If empty, the admin API is served under /admin/ by the main listener.
+	Addr string `yaml:"addr"`
+	// Token is required as a bearer token by every request, the admin API is disabled without one.
+	// Tokens with an `env.` prefix are read from the environment, and with a `file.` prefix from a file.
+	Token string `yaml:"token"`
+}
+
+type adminRepo struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type purgeResult struct {
+	Purged int `json:"purged"`
+}
+
+// Admin returns the admin API, or nil if it is disabled.
+func (h Handler) Admin() http.Handler {
+	return h.admin
+}
+
+// adminRouter builds the admin API, or returns nil if it is disabled.
+func (h Handler) adminRouter(cfg AdminConfig) http.Handler {
+	token, err := secret.Value(cfg.Token)
+	if err != nil {
+		slog.Error("admin API disabled", slog.String("error", err.Error()))
+		return nil
+	}
+	if token == "" {
+		return nil
+	}
+
+	mux := chi.NewRouter()
+	if cfg.Addr != "" {
+		// Otherwise the main listener's middleware applies:
+		mux.Use(middleware.RequestID)
+		mux.Use(middleware.RealIP)
+		mux.Use(Logger)
+	}
+	mux.Use(bearerAuth(token))
+	mux.Get("/repos", h.adminRepos)
+	mux.Post("/repos/{repo}/purge", h.adminPurge)
+	mux.Post("/repos/{repo}/render", h.adminRender)
+	return mux
+}
+
+func bearerAuth(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (h Handler) adminRepos(w http.ResponseWriter, _ *http.Request) {
+	repos := make([]adminRepo, 0, len(h.repos))
+	for name := range h.repos {
+		repos = append(repos, adminRepo{Name: name, Type: h.types[name]})
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].Name < repos[j].Name
+	})
+	writeJSON(w, repos)
+}
+
+// adminPurge deletes cached values from every cache in the repo.
+// The namespace and prefix query parameters narrow the values deleted, by default everything is purged.
+func (h Handler) adminPurge(w http.ResponseWriter, r *http.Request) {
+	repoName := chi.URLParam(r, "repo")
+	rep, ok := h.repos[repoName]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	prefix := cache.Key(r.URL.Query().Get("prefix"))
+	if ns := r.URL.Query().Get("namespace"); ns != "" {
+		prefix = cache.Namespace(ns).Key(string(prefix))
+	}
+
+	var res purgeResult
+	for _, c := range caches(rep) {
+		n, err := c.Purge(r.Context(), prefix)
+		res.Purged += n
+		if err != nil {
+			writeError(w, r, "cache.Purge", err)
+			return
+		}
+	}
+	slog.Info("purged cache",
+		slog.String("request_id", middleware.GetReqID(r.Context())),
+		slog.String("repo", repoName),
+		slog.String("prefix", string(prefix)),
+		slog.Int("purged", res.Purged),
+	)
+	writeJSON(w, res)
+}
+
+// adminRender re-renders a distribution of a dynamic repo, and purges it from the caches in front of it.
+func (h Handler) adminRender(w http.ResponseWriter, r *http.Request) {
+	repoName := chi.URLParam(r, "repo")
+	rep, ok := h.repos[repoName]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	wrapping := caches(rep)
+	dyn, ok := unwrap(rep).(*dynamic.Repo)
+	if !ok {
+		writeError(w, r, "repo.Render", fmt.Errorf("%w: %q is not a dynamic repo", repo.ErrBadRequest, repoName))
+		return
+	}
+	dist := repo.Distribution(r.URL.Query().Get("dist"))
+	if dist == "" {
+		writeError(w, r, "repo.Render", fmt.Errorf("%w: dist is required", repo.ErrBadRequest))
+		return
+	}
+
+	if err := dyn.Render(r.Context(), dist); err != nil {
+		writeError(w, r, "repo.Render", err)
+		return
+	}
+	var res purgeResult
+	for _, c := range wrapping {
+		n, err := c.PurgeDist(r.Context(), dist)
+		res.Purged += n
+		if err != nil {
+			writeError(w, r, "cache.Purge", err)
+			return
+		}
+	}
+	slog.Info("rendered repo",
+		slog.String("request_id", middleware.GetReqID(r.Context())),
+		slog.String("repo", repoName),
+		slog.Any("dist", dist),
+		slog.Int("purged", res.Purged),
+	)
+	writeJSON(w, res)
+}
+
+// caches lists the caches wrapping a repo, outermost first.
+func caches(rep repo.Repo) []*repo.Cache {
+	var ret []*repo.Cache
+	for c, ok := rep.(*repo.Cache); ok; c, ok = c.Source.(*repo.Cache) {
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// unwrap returns the repo behind any caches.
+func unwrap(rep repo.Repo) repo.Repo {
+	for c, ok := rep.(*repo.Cache); ok; c, ok = rep.(*repo.Cache) {
+		rep = c.Source
+	}
+	return rep
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
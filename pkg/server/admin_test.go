@@ -0,0 +1,121 @@
+package server_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/debcache/pkg/server"
+)
+
+func TestHandler_Admin(t *testing.T) {
+	t.Parallel()
+
+	// Subtests run in parallel, so each gets a repo:
+	local := server.RepoConfig{Type: "memory-cache", Config: map[string]any{
+		"source": map[string]any{
+			"type":           "dynamic",
+			"signingKeyPath": "../dynamic/testdata/key.asc",
+			"files":          map[string]any{"dir": "../debian/testdata"},
+		},
+	}}
+	h, err := server.NewHandler(context.Background(), &server.Config{
+		Admin: server.AdminConfig{Token: "hunter2"},
+		Repos: map[string]server.RepoConfig{
+			"purged":   local,
+			"rendered": local,
+			"debian":   {Type: "upstream", Config: map[string]any{"url": "http://127.0.0.1:0"}},
+		},
+	})
+	require.NoError(t, err)
+
+	admin := func(tb testing.TB, method, path string) *httptest.ResponseRecorder {
+		tb.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer hunter2")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	fill := func(tb testing.TB, repo string) {
+		tb.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+repo+"/dists/bookworm/InRelease", nil))
+		require.Equal(tb, http.StatusOK, rec.Code)
+	}
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		t.Parallel()
+		for _, auth := range []string{"", "Bearer nope", "hunter2"} {
+			req := httptest.NewRequest(http.MethodGet, "/admin/repos", nil)
+			req.Header.Set("Authorization", auth)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		}
+	})
+
+	t.Run("list repos", func(t *testing.T) {
+		t.Parallel()
+		rec := admin(t, http.MethodGet, "/admin/repos")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `[{"name":"debian","type":"upstream"},{"name":"purged","type":"memory-cache"},{"name":"rendered","type":"memory-cache"}]`, rec.Body.String())
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		t.Parallel()
+		fill(t, "purged")
+		rec := admin(t, http.MethodPost, "/admin/repos/purged/purge?namespace=releases&prefix=bookworm")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"purged":1}`, rec.Body.String())
+
+		rec = admin(t, http.MethodPost, "/admin/repos/missing/purge")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("render", func(t *testing.T) {
+		t.Parallel()
+		fill(t, "rendered")
+		rec := admin(t, http.MethodPost, "/admin/repos/rendered/render?dist=bookworm")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"purged":1}`, rec.Body.String())
+
+		rec = admin(t, http.MethodPost, "/admin/repos/rendered/render")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		rec = admin(t, http.MethodPost, "/admin/repos/debian/render?dist=bookworm")
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func TestHandler_AdminReservedName(t *testing.T) {
+	t.Parallel()
+
+	repos := map[string]server.RepoConfig{
+		"admin": {Type: "upstream", Config: map[string]any{"url": "http://127.0.0.1:0"}},
+	}
+	_, err := server.NewHandler(context.Background(), &server.Config{
+		Admin: server.AdminConfig{Token: "hunter2"},
+		Repos: repos,
+	})
+	require.ErrorContains(t, err, "reserved")
+
+	// Allowed when the admin API has its own listener:
+	h, err := server.NewHandler(context.Background(), &server.Config{
+		Admin: server.AdminConfig{Token: "hunter2", Addr: "127.0.0.1:0"},
+		Repos: repos,
+	})
+	require.NoError(t, err)
+	assert.NotNil(t, h.Admin())
+}
+
+func TestHandler_AdminDisabled(t *testing.T) {
+	t.Parallel()
+
+	h := testHandler(t, map[string]server.RepoConfig{})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/repos", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -7,20 +7,29 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 
 	"github.com/thepwagner/debcache/pkg/cache"
 	"github.com/thepwagner/debcache/pkg/dynamic"
+	"github.com/thepwagner/debcache/pkg/metrics"
 	"github.com/thepwagner/debcache/pkg/repo"
+	"github.com/thepwagner/debcache/pkg/secret"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	Addr  string                `yaml:"addr"`
 	Repos map[string]RepoConfig `yaml:"repos"`
+	Admin AdminConfig           `yaml:"admin"`
+	// Offline serves every cache repo from its cache, without contacting sources.
+	Offline bool `yaml:"offline"`
 }
 
 type RepoConfig struct {
 	Type   string         `yaml:"type"`
+	Apt    AptConfig      `yaml:"apt"`
 	Config map[string]any `yaml:",inline"`
 }
 
@@ -45,6 +54,9 @@ func loadConfig() (*Config, error) {
 		slog.Info("no config file found, using defaults")
 	}
 
+	if offline, err := strconv.ParseBool(os.Getenv("DEBCACHE_OFFLINE")); err == nil {
+		cfg.Offline = offline
+	}
 	if cfg.Addr == "" {
 		cfg.Addr = ":8080"
 	}
@@ -63,7 +75,7 @@ func loadConfig() (*Config, error) {
 }
 
 func BuildRepo(ctx context.Context, name string, cfg RepoConfig) (repo.Repo, error) {
-	slog.Debug("building repo", slog.String("repo", name), slog.String("type", cfg.Type), slog.Any("config", cfg.Config))
+	slog.Debug("building repo", slog.String("repo", name), slog.String("type", cfg.Type), slog.Any("config", secret.Redact(cfg.Config)))
 
 	switch cfg.Type {
 	case "dynamic":
@@ -82,7 +94,10 @@ func BuildRepo(ctx context.Context, name string, cfg RepoConfig) (repo.Repo, err
 		if err != nil {
 			return nil, fmt.Errorf("error decoding file-cache config: %w", err)
 		}
-		return repo.NewCache(src, cache.NewFileStorage(*cacheCfg)), nil
+		storage := cache.NewFileStorage(*cacheCfg)
+		go storage.RunGC(ctx)
+		metrics.RegisterStorage(name, storage)
+		return newCache(ctx, name, src, storage, cfg.Config)
 
 	case "memory-cache":
 		src, err := newCacheSource(ctx, fmt.Sprintf("memory-cache.%s", name), cfg.Config["source"])
@@ -93,7 +108,23 @@ func BuildRepo(ctx context.Context, name string, cfg RepoConfig) (repo.Repo, err
 		if err != nil {
 			return nil, fmt.Errorf("error decoding memory-cache config: %w", err)
 		}
-		return repo.NewCache(src, cache.NewLRUStorage(*cacheCfg)), nil
+		storage := cache.NewLRUStorage(*cacheCfg)
+		metrics.RegisterStorage(name, storage)
+		return newCache(ctx, name, src, storage, cfg.Config)
+
+	case "tiered-cache":
+		src, err := newCacheSource(ctx, fmt.Sprintf("tiered-cache.%s", name), cfg.Config["source"])
+		if err != nil {
+			return nil, fmt.Errorf("error building tiered-cache source: %w", err)
+		}
+		cacheCfg, err := decodeSource[cache.TieredConfig](cfg.Config)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding tiered-cache config: %w", err)
+		}
+		storage := cache.NewTieredStorage(*cacheCfg)
+		go storage.RunGC(ctx)
+		metrics.RegisterStorage(name, storage)
+		return newCache(ctx, name, src, storage, cfg.Config)
 
 	case "upstream":
 		cacheCfg, err := decodeSource[repo.UpstreamConfig](cfg.Config)
@@ -106,6 +137,42 @@ func BuildRepo(ctx context.Context, name string, cfg RepoConfig) (repo.Repo, err
 	return nil, fmt.Errorf("unknown repo type %q", cfg.Type)
 }
 
+// newCache wraps a source with storage, configured by the cache repo's config.
+func newCache(ctx context.Context, name string, src repo.Repo, storage cache.Storage, config map[string]any) (*repo.Cache, error) {
+	cacheCfg, err := decodeSource[repo.CacheConfig](config)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding cache config: %w", err)
+	}
+	c := repo.NewCache(src, storage)
+	c.StaleIfError = cacheCfg.StaleIfError
+	c.Offline = cacheCfg.Offline
+	c.SoftTTL = cacheCfg.SoftTTL
+	c.RefreshRecent = cacheCfg.RefreshRecent
+	if cacheCfg.Content.Path != "" {
+		c.Content = contentStore(cacheCfg.Content).Storage(name, cacheCfg.Content.TTL)
+		go c.Content.RunGC(ctx)
+	}
+	return c, nil
+}
+
+// contentStores are shared by every cache configured with the same path, so each file is stored once.
+var contentStores = struct {
+	mu     sync.Mutex
+	stores map[string]*cache.ContentStore
+}{stores: map[string]*cache.ContentStore{}}
+
+func contentStore(cfg cache.ContentConfig) *cache.ContentStore {
+	contentStores.mu.Lock()
+	defer contentStores.mu.Unlock()
+	path := filepath.Clean(cfg.Path)
+	store, ok := contentStores.stores[path]
+	if !ok {
+		store = cache.NewContentStore(cfg)
+		contentStores.stores[path] = store
+	}
+	return store
+}
+
 func decodeSource[T any](src any) (*T, error) {
 	// mapstructure doesn't work here: so cycle through YAML
 	var buf bytes.Buffer
@@ -41,5 +41,26 @@ repos:
 
 	upstream, ok := fileCache.Source.(*repo.Upstream)
 	require.True(t, ok)
-	assert.Equal(t, "http://deb.debian.org/debian", upstream.URL.String())
+	urls := upstream.URLs()
+	require.Len(t, urls, 1)
+	assert.Equal(t, "http://deb.debian.org/debian", urls[0].String())
+}
+
+func TestConfig_TieredCache(t *testing.T) {
+	t.Parallel()
+	cfg := server.RepoConfig{Type: "tiered-cache", Config: map[string]any{
+		"path":   t.TempDir(),
+		"memory": map[string]any{"maxBytes": "64MiB"},
+		"tiers":  map[string]any{"translations": "memory", "pool": "disk"},
+		"source": map[string]any{"type": "upstream", "url": "http://deb.debian.org/debian"},
+	}}
+	debian, err := server.BuildRepo(context.Background(), "debian", cfg)
+	require.NoError(t, err)
+	tieredCache, ok := debian.(*repo.Cache)
+	require.True(t, ok)
+	assert.IsType(t, &cache.TieredStorage{}, tieredCache.Storage)
+
+	cfg.Config["tiers"] = map[string]any{"pool": "cloud"}
+	_, err = server.BuildRepo(context.Background(), "debian", cfg)
+	assert.Error(t, err)
 }
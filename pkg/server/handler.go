@@ -5,11 +5,11 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
-	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/thepwagner/debcache/pkg/debian"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/thepwagner/debcache/pkg/metrics"
 	"github.com/thepwagner/debcache/pkg/repo"
 )
 
@@ -17,36 +17,79 @@ type Handler struct {
 	mux *chi.Mux
 
 	repos map[string]repo.Repo
+	types map[string]string
+	apt   map[string]AptConfig
+	admin http.Handler
 }
 
 func NewHandler(ctx context.Context, cfg *Config) (*Handler, error) {
 	h := &Handler{
 		mux:   chi.NewRouter(),
 		repos: map[string]repo.Repo{},
+		types: map[string]string{},
+		apt:   map[string]AptConfig{},
 	}
 	h.mux.Use(middleware.RequestID)
 	h.mux.Use(middleware.RealIP)
 	h.mux.Use(Logger)
-	h.mux.Get("/{repo}/repo.source", h.RepoSource)
-
-	h.mux.Get("/{repo}/dists/{dist}/InRelease", h.InRelease)
-
-	h.mux.Get("/{repo}/dists/{dist}/{component}/binary-{architecture}/Packages", h.Packages)
-	h.mux.Get("/{repo}/dists/{dist}/{component}/binary-{architecture}/Packages{compression:(.[gx]z|)}", h.Packages)
-	h.mux.Get("/{repo}/dists/{dist}/{component}/binary-{architecture}/by-hash/{digestAlgo}/{digest}", h.ByHash)
-
-	h.mux.Get("/{repo}/dists/{dist}/{component}/i18n/Translation-{lang:[^.]+}", h.Translations)
-	h.mux.Get("/{repo}/dists/{dist}/{component}/i18n/Translation-{lang:[^.]+}.{compression}", h.Translations)
-	h.mux.Get("/{repo}/dists/{dist}/{component}/i18n/by-hash/{digestAlgo}/{digest}", h.ByHash)
-
-	h.mux.Get("/{repo}/pool/*", h.Pool)
+	h.mux.Use(middleware.GetHead)
+	h.mux.Use(byteRanges)
+	h.mux.Use(headRequests)
+	h.mux.Handle("/metrics", promhttp.Handler())
+	h.mux.Route("/{repo}", func(r chi.Router) {
+		r.Use(h.repoMetrics)
+		r.Get("/repo.source", h.RepoSource)
+		r.Get("/apt.conf", h.AptConf)
+		r.Get("/key.asc", h.KeyASC)
+		r.Get("/key.gpg", h.KeyGPG)
+
+		r.Get("/dists/{dist}/InRelease", h.InRelease)
+		r.Get("/dists/{dist}/Release", h.Release)
+		r.Get("/dists/{dist}/Release.gpg", h.ReleaseGPG)
+
+		r.Get("/dists/{dist}/{component}/binary-{architecture}/Packages", h.Packages)
+		r.Get("/dists/{dist}/{component}/binary-{architecture}/Packages{compression:(.[gx]z|)}", h.Packages)
+		r.Get("/dists/{dist}/{component}/binary-{architecture}/by-hash/{digestAlgo}/{digest}", h.ByHash)
+
+		r.Get("/dists/{dist}/{component}/i18n/Translation-{lang:[^.]+}", h.Translations)
+		r.Get("/dists/{dist}/{component}/i18n/Translation-{lang:[^.]+}.{compression}", h.Translations)
+		r.Get("/dists/{dist}/{component}/i18n/by-hash/{digestAlgo}/{digest}", h.ByHash)
+
+		r.Get("/dists/{dist}/{component}/source/Sources", h.Sources)
+		r.Get("/dists/{dist}/{component}/source/Sources{compression:(.[gx]z|)}", h.Sources)
+		r.Get("/dists/{dist}/{component}/{architecture:source}/by-hash/{digestAlgo}/{digest}", h.ByHash)
+
+		r.Get("/dists/{dist}/{component}/Contents-{architecture:[^.]+}", h.Contents)
+		r.Get("/dists/{dist}/{component}/Contents-{architecture:[^.]+}.{compression}", h.Contents)
+		r.Get("/dists/{dist}/{component}/by-hash/{digestAlgo}/{digest}", h.ByHash)
+
+		r.Get("/pool/*", h.Pool)
+	})
+
+	h.admin = h.adminRouter(cfg.Admin)
+	if h.admin != nil && cfg.Admin.Addr == "" {
+		if _, ok := cfg.Repos["admin"]; ok {
+			return nil, fmt.Errorf("repo name %q is reserved for the admin API, use a different name or admin.addr", "admin")
+		}
+	}
 
-	for name, cfg := range cfg.Repos {
-		repo, err := BuildRepo(ctx, name, cfg)
+	for name, repoCfg := range cfg.Repos {
+		repo, err := BuildRepo(ctx, name, repoCfg)
 		if err != nil {
 			return nil, fmt.Errorf("error building repo %q: %w", name, err)
 		}
+		if cfg.Offline {
+			for _, c := range caches(repo) {
+				c.Offline = true
+			}
+		}
 		h.repos[name] = repo
+		h.types[name] = repoCfg.Type
+		h.apt[name] = repoCfg.Apt
+	}
+
+	if h.admin != nil && cfg.Admin.Addr == "" {
+		h.mux.Mount("/admin", h.admin)
 	}
 
 	return h, nil
@@ -56,11 +99,30 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.mux.ServeHTTP(w, r)
 }
 
-func (h Handler) RepoSource(w http.ResponseWriter, r *http.Request) {
+// repoMetrics labels metrics recorded while handling the request with the repo, and counts bytes served.
+func (h Handler) repoMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repoName := chi.URLParam(r, "repo")
+		if _, ok := h.repos[repoName]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		defer func() {
+			metrics.BytesServed.WithLabelValues(repoName).Add(float64(ww.BytesWritten()))
+		}()
+		next.ServeHTTP(ww, r.WithContext(metrics.WithRepo(r.Context(), repoName)))
+	})
+}
+
+func (h Handler) InRelease(w http.ResponseWriter, r *http.Request) {
 	repoName := chi.URLParam(r, "repo")
-	slog.Info("handling Key",
+	dist := repo.Distribution(chi.URLParam(r, "dist"))
+	slog.Info("handling InRelease",
 		slog.String("request_id", middleware.GetReqID(r.Context())),
 		slog.String("repo", repoName),
+		slog.Any("dist", dist),
 	)
 
 	repo, ok := h.repos[repoName]
@@ -69,40 +131,41 @@ func (h Handler) RepoSource(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	signedBy, err := repo.SigningKeyPEM()
+	res, err := repo.InRelease(r.Context(), dist)
 	if err != nil {
-		slog.Error("repo.SigningKeyPEM", slog.String("error", err.Error()))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, "repo.InRelease", err)
 		return
 	}
-	if len(signedBy) == 0 {
-		signedBy = []byte("/usr/share/keyrings/debian-archive-keyring.gpg")
-	}
+	serveBody(w, r, res)
+}
 
-	r.URL.Scheme = "http"
-	r.URL.Host = r.Host
-	r.URL.Path = ""
+func (h Handler) Release(w http.ResponseWriter, r *http.Request) {
+	repoName := chi.URLParam(r, "repo")
+	dist := repo.Distribution(chi.URLParam(r, "dist"))
+	slog.Info("handling Release",
+		slog.String("request_id", middleware.GetReqID(r.Context())),
+		slog.String("repo", repoName),
+		slog.Any("dist", dist),
+	)
 
-	suite := "bookworm"
-	if strings.Contains(repoName, "-security") {
-		suite = "bookworm-security"
+	repo, ok := h.repos[repoName]
+	if !ok {
+		http.NotFound(w, r)
+		return
 	}
 
-	repoGraph := debian.Paragraph{
-		"Types":      "deb",
-		"URIs":       r.URL.JoinPath(repoName).String(),
-		"Suites":     suite,
-		"Components": "main",
-		"Signed-By":  string(signedBy),
+	res, err := repo.Release(r.Context(), dist)
+	if err != nil {
+		writeError(w, r, "repo.Release", err)
+		return
 	}
-
-	_ = debian.WriteControlFile(w, repoGraph)
+	serveBody(w, r, res)
 }
 
-func (h Handler) InRelease(w http.ResponseWriter, r *http.Request) {
+func (h Handler) ReleaseGPG(w http.ResponseWriter, r *http.Request) {
 	repoName := chi.URLParam(r, "repo")
 	dist := repo.Distribution(chi.URLParam(r, "dist"))
-	slog.Info("handling InRelease",
+	slog.Info("handling ReleaseGPG",
 		slog.String("request_id", middleware.GetReqID(r.Context())),
 		slog.String("repo", repoName),
 		slog.Any("dist", dist),
@@ -114,18 +177,12 @@ func (h Handler) InRelease(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res, err := repo.InRelease(r.Context(), dist)
+	res, err := repo.ReleaseGPG(r.Context(), dist)
 	if err != nil {
-		slog.Error("repo.InRelease", slog.String("error", err.Error()))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, "repo.ReleaseGPG", err)
 		return
 	}
-	if len(res) == 0 {
-		http.NotFound(w, r)
-		return
-	}
-
-	_, _ = w.Write(res)
+	serveBody(w, r, res)
 }
 
 func (h Handler) Packages(w http.ResponseWriter, r *http.Request) {
@@ -151,16 +208,66 @@ func (h Handler) Packages(w http.ResponseWriter, r *http.Request) {
 
 	res, err := rep.Packages(r.Context(), dist, component, arch, compression)
 	if err != nil {
-		slog.Error("repo.Packages", slog.String("error", err.Error()))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, "repo.Packages", err)
+		return
+	}
+	serveBody(w, r, res)
+}
+
+func (h Handler) Sources(w http.ResponseWriter, r *http.Request) {
+	repoName := chi.URLParam(r, "repo")
+	dist := repo.Distribution(chi.URLParam(r, "dist"))
+	component := repo.Component(chi.URLParam(r, "component"))
+	compression := repo.ParseCompression(chi.URLParam(r, "compression"))
+	slog.Info("handling Sources",
+		slog.String("request_id", middleware.GetReqID(r.Context())),
+		slog.String("repo", repoName),
+		slog.Any("dist", dist),
+		slog.Any("component", component),
+		slog.Any("compression", compression),
+	)
+
+	rep, ok := h.repos[repoName]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	res, err := rep.Sources(r.Context(), dist, component, compression)
+	if err != nil {
+		writeError(w, r, "repo.Sources", err)
 		return
 	}
-	if len(res) == 0 {
+	serveBody(w, r, res)
+}
+
+func (h Handler) Contents(w http.ResponseWriter, r *http.Request) {
+	repoName := chi.URLParam(r, "repo")
+	dist := repo.Distribution(chi.URLParam(r, "dist"))
+	component := repo.Component(chi.URLParam(r, "component"))
+	arch := repo.Architecture(chi.URLParam(r, "architecture"))
+	compression := repo.ParseCompression(chi.URLParam(r, "compression"))
+	slog.Info("handling Contents",
+		slog.String("request_id", middleware.GetReqID(r.Context())),
+		slog.String("repo", repoName),
+		slog.Any("dist", dist),
+		slog.Any("component", component),
+		slog.Any("arch", arch),
+		slog.Any("compression", compression),
+	)
+
+	rep, ok := h.repos[repoName]
+	if !ok {
 		http.NotFound(w, r)
 		return
 	}
 
-	_, _ = w.Write(res)
+	res, err := rep.Contents(r.Context(), dist, component, arch, compression)
+	if err != nil {
+		writeError(w, r, "repo.Contents", err)
+		return
+	}
+	serveBody(w, r, res)
 }
 
 func (h Handler) ByHash(w http.ResponseWriter, r *http.Request) {
@@ -192,15 +299,10 @@ func (h Handler) ByHash(w http.ResponseWriter, r *http.Request) {
 
 	res, err := repo.ByHash(r.Context(), dist, component, arch, digest)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, "repo.ByHash", err)
 		return
 	}
-	if len(res) == 0 {
-		http.NotFound(w, r)
-		return
-	}
-
-	_, _ = w.Write(res)
+	serveBody(w, r, res)
 }
 
 func (h Handler) Pool(w http.ResponseWriter, r *http.Request) {
@@ -220,16 +322,10 @@ func (h Handler) Pool(w http.ResponseWriter, r *http.Request) {
 
 	b, err := repo.Pool(r.Context(), filename)
 	if err != nil {
-		slog.Error("repo.Pool", slog.String("error", err.Error()))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if len(b) == 0 {
-		http.NotFound(w, r)
+		writeError(w, r, "repo.Pool", err)
 		return
 	}
-
-	_, _ = w.Write(b)
+	serveBody(w, r, b)
 }
 
 func (h Handler) Translations(w http.ResponseWriter, r *http.Request) {
@@ -255,14 +351,8 @@ func (h Handler) Translations(w http.ResponseWriter, r *http.Request) {
 
 	res, err := repo.Translations(r.Context(), dist, component, lang, compression)
 	if err != nil {
-		slog.Error("repo.Translations", slog.String("error", err.Error()))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, "repo.Translations", err)
 		return
 	}
-	if len(res) == 0 {
-		http.NotFound(w, r)
-		return
-	}
-
-	_, _ = w.Write(res)
+	serveBody(w, r, res)
 }
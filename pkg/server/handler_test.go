@@ -0,0 +1,452 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/debcache/pkg/server"
+)
+
+func TestHandler_UpstreamErrors(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/dists/bookworm/InRelease":
+			_, _ = w.Write([]byte("release"))
+		case "/dists/bookworm/main/Contents-amd64.gz", "/dists/bookworm/main/by-hash/SHA256/abc123",
+			"/dists/bookworm/main/source/Sources.xz", "/dists/bookworm/main/source/by-hash/SHA256/abc123":
+			_, _ = w.Write([]byte("contents"))
+		case "/dists/bookworm/main/binary-amd64/Packages.xz":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/dists/bookworm/main/binary-amd64/Packages.gz":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	h := testHandler(t, map[string]server.RepoConfig{
+		"debian": {Type: "upstream", Config: map[string]any{"url": upstream.URL}},
+	})
+
+	cases := map[string]int{
+		"/debian/dists/bookworm/InRelease":                           http.StatusOK,
+		"/debian/dists/bookworm/main/i18n/Translation-en":            http.StatusNotFound,
+		"/debian/dists/bookworm/main/Contents-amd64.gz":              http.StatusOK,
+		"/debian/dists/bookworm/main/Contents-arm64":                 http.StatusNotFound,
+		"/debian/dists/bookworm/main/by-hash/SHA256/abc123":          http.StatusOK,
+		"/debian/dists/bookworm/main/source/Sources.xz":              http.StatusOK,
+		"/debian/dists/bookworm/main/source/Sources.gz":              http.StatusNotFound,
+		"/debian/dists/bookworm/main/source/by-hash/SHA256/abc123":   http.StatusOK,
+		"/debian/dists/bookworm/main/binary-amd64/Packages.xz":       http.StatusBadGateway,
+		"/debian/dists/bookworm/main/binary-amd64/Packages.gz":       http.StatusServiceUnavailable,
+		"/debian/pool/main/p/pkg/pkg_1.0_amd64.deb":                  http.StatusNotFound,
+		"/missing/dists/bookworm/InRelease":                          http.StatusNotFound,
+		"/debian/dists/bookworm/main/binary-amd64/by-hash/MD5/abc12": http.StatusNotFound,
+	}
+	for path, expected := range cases {
+		path, expected := path, expected
+		t.Run(path, func(t *testing.T) {
+			t.Parallel()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			assert.Equal(t, expected, rec.Code)
+		})
+	}
+}
+
+func TestHandler_AbortedBody(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	t.Cleanup(upstream.Close)
+	srv := httptest.NewServer(testHandler(t, map[string]server.RepoConfig{
+		"debian": {Type: "upstream", Config: map[string]any{"url": upstream.URL}},
+	}))
+	t.Cleanup(srv.Close)
+
+	// The response fails like the upstream's did, instead of ending as if it was complete:
+	resp, err := http.Get(srv.URL + "/debian/pool/main/p/pkg/pkg_1.0_amd64.deb")
+	if err == nil {
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+	}
+	assert.Error(t, err)
+}
+
+func TestHandler_Conditional(t *testing.T) {
+	t.Parallel()
+
+	h := testHandler(t, map[string]server.RepoConfig{
+		"local": {Type: "dynamic", Config: map[string]any{
+			"signingKeyPath": "../dynamic/testdata/key.asc",
+			"files":          map[string]any{"dir": "../debian/testdata"},
+		}},
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/local/dists/bookworm/InRelease", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+	lastModified, err := http.ParseTime(rec.Header().Get("Last-Modified"))
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		header, value string
+		expected      int
+	}{
+		"matching etag":      {header: "If-None-Match", value: etag, expected: http.StatusNotModified},
+		"weak etag":          {header: "If-None-Match", value: `"nope", W/` + etag, expected: http.StatusNotModified},
+		"other etag":         {header: "If-None-Match", value: `"nope"`, expected: http.StatusOK},
+		"not modified since": {header: "If-Modified-Since", value: lastModified.Format(http.TimeFormat), expected: http.StatusNotModified},
+		"modified since":     {header: "If-Modified-Since", value: lastModified.Add(-time.Minute).Format(http.TimeFormat), expected: http.StatusOK},
+	}
+	for label, tc := range cases {
+		tc := tc
+		t.Run(label, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, "/local/dists/bookworm/InRelease", nil)
+			req.Header.Set(tc.header, tc.value)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expected, rec.Code)
+		})
+	}
+}
+
+func TestHandler_Head(t *testing.T) {
+	t.Parallel()
+
+	h := testHandler(t, map[string]server.RepoConfig{
+		"local": {Type: "dynamic", Config: map[string]any{
+			"signingKeyPath": "../dynamic/testdata/key.asc",
+			"files":          map[string]any{"dir": "../debian/testdata"},
+		}},
+	})
+
+	for _, path := range []string{
+		"/local/dists/bookworm/InRelease",
+		"/local/dists/bookworm/main/binary-amd64/Packages.gz",
+		"/local/pool/main/p/pkg/foobar_1.2.3_amd64.deb",
+	} {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			t.Parallel()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, path, nil))
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.NotEmpty(t, rec.Header().Get("Content-Length"))
+			assert.Empty(t, rec.Body.Bytes())
+		})
+	}
+}
+
+func TestHandler_HeadMiss(t *testing.T) {
+	t.Parallel()
+
+	const content = "0123456789"
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	t.Cleanup(upstream.Close)
+	h := testHandler(t, map[string]server.RepoConfig{
+		"debian": {Type: "memory-cache", Config: map[string]any{
+			"source": map[string]any{"type": "upstream", "url": upstream.URL},
+		}},
+	})
+	const pkg = "/debian/pool/main/p/pkg/pkg_1.0_amd64.deb"
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, pkg, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "10", rec.Header().Get("Content-Length"))
+	assert.Empty(t, rec.Body.Bytes())
+
+	// The value fetched for HEAD is stored, instead of fetched again:
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, pkg, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, content, rec.Body.String())
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestHandler_Range(t *testing.T) {
+	t.Parallel()
+
+	const content = "0123456789"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"origin"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	t.Cleanup(upstream.Close)
+
+	h := testHandler(t, map[string]server.RepoConfig{
+		"upstream": {Type: "upstream", Config: map[string]any{"url": upstream.URL}},
+		"cached": {Type: "file-cache", Config: map[string]any{
+			"path":   t.TempDir(),
+			"source": map[string]any{"type": "upstream", "url": upstream.URL},
+		}},
+	})
+	const pkg = "/pool/main/p/pkg/pkg_1.0_amd64.deb"
+
+	// Fill the cache:
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cached"+pkg, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, content, rec.Body.String())
+
+	cases := map[string]struct {
+		repo     string
+		header   map[string]string
+		status   int
+		body     string
+		multi    bool
+		contains []string
+	}{
+		"cached single range": {
+			repo:   "cached",
+			header: map[string]string{"Range": "bytes=2-4"},
+			status: http.StatusPartialContent,
+			body:   "234",
+		},
+		"cached multi range": {
+			repo:     "cached",
+			header:   map[string]string{"Range": "bytes=0-1,5-6"},
+			status:   http.StatusPartialContent,
+			multi:    true,
+			contains: []string{"01", "56"},
+		},
+		"cached stale if-range": {
+			repo:   "cached",
+			header: map[string]string{"Range": "bytes=2-4", "If-Range": `"other"`},
+			status: http.StatusOK,
+			body:   content,
+		},
+		"upstream single range": {
+			repo:   "upstream",
+			header: map[string]string{"Range": "bytes=2-4"},
+			status: http.StatusPartialContent,
+			body:   "234",
+		},
+		"upstream multi range": {
+			repo:     "upstream",
+			header:   map[string]string{"Range": "bytes=0-1,5-6"},
+			status:   http.StatusPartialContent,
+			multi:    true,
+			contains: []string{"01", "56"},
+		},
+		"upstream matching if-range": {
+			repo:   "upstream",
+			header: map[string]string{"Range": "bytes=2-4", "If-Range": `"origin"`},
+			status: http.StatusPartialContent,
+			body:   "234",
+		},
+		"upstream unsatisfiable": {
+			repo:   "upstream",
+			header: map[string]string{"Range": "bytes=20-30"},
+			status: http.StatusRequestedRangeNotSatisfiable,
+		},
+	}
+	for label, tc := range cases {
+		tc := tc
+		t.Run(label, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, "/"+tc.repo+pkg, nil)
+			for k, v := range tc.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			assert.Equal(t, tc.status, rec.Code)
+			if tc.multi {
+				assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "multipart/byteranges"))
+				for _, c := range tc.contains {
+					assert.Contains(t, rec.Body.String(), c)
+				}
+			} else if tc.body != "" {
+				assert.Equal(t, tc.body, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandler_CorruptPool(t *testing.T) {
+	t.Parallel()
+
+	const content = "0123456789"
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	t.Cleanup(upstream.Close)
+
+	cases := map[string]func(dir string) map[string]any{
+		"file": func(dir string) map[string]any {
+			return map[string]any{"path": dir}
+		},
+		"content": func(dir string) map[string]any {
+			return map[string]any{"path": filepath.Join(dir, "cache"), "content": map[string]any{"path": dir}}
+		},
+	}
+	for label, cfg := range cases {
+		cfg := cfg
+		t.Run(label, func(t *testing.T) {
+			dir := t.TempDir()
+			config := cfg(dir)
+			config["source"] = map[string]any{"type": "upstream", "url": upstream.URL}
+			h := testHandler(t, map[string]server.RepoConfig{
+				"debian": {Type: "file-cache", Config: config},
+			})
+			const pkg = "/debian/pool/main/p/pkg/pkg_1.0_amd64.deb"
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, pkg, nil))
+			require.Equal(t, http.StatusOK, rec.Code)
+			before := requests.Load()
+
+			// Corrupt the cached value, in place:
+			var corrupted int
+			err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+				if err != nil || !d.Type().IsRegular() {
+					return err
+				}
+				b, err := os.ReadFile(p)
+				if err != nil || !strings.HasPrefix(string(b), content) {
+					return err
+				}
+				corrupted++
+				b[0] = 'X'
+				if err := os.WriteFile(p, b, 0o600); err != nil {
+					return err
+				}
+				// Modification times can be coarser than the test, the file must look changed:
+				modified := time.Now().Add(-time.Second)
+				return os.Chtimes(p, modified, modified)
+			})
+			require.NoError(t, err)
+			require.Equal(t, 1, corrupted)
+
+			// The corrupt value is quarantined and fetched again, instead of served:
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, pkg, nil))
+			require.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, content, rec.Body.String())
+			assert.Equal(t, "application/octet-stream", rec.Header().Get("Content-Type"))
+			assert.Equal(t, before+1, requests.Load())
+			quarantined, err := filepath.Glob(filepath.Join(dir, ".quarantine", "*"))
+			require.NoError(t, err)
+			assert.Len(t, quarantined, 1)
+		})
+	}
+}
+
+func TestHandler_Metrics(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dists/bookworm/InRelease" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("release"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	// Metrics are global, so use repo names unique to this test:
+	h := testHandler(t, map[string]server.RepoConfig{
+		"metrics-debian": {Type: "memory-cache", Config: map[string]any{
+			"source": map[string]any{"type": "upstream", "url": upstream.URL},
+		}},
+		"metrics-local": {Type: "dynamic", Config: map[string]any{
+			"signingKeyPath": "../dynamic/testdata/key.asc",
+			"files":          map[string]any{"dir": "../debian/testdata"},
+		}},
+	})
+	for _, path := range []string{
+		"/metrics-debian/dists/bookworm/InRelease",
+		"/metrics-debian/dists/bookworm/InRelease",
+		"/metrics-debian/dists/bookworm/Release",
+		"/metrics-local/dists/bookworm/InRelease",
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	for _, expected := range []string{
+		`debcache_cache_requests_total{namespace="releases",repo="metrics-debian",result="hit"} 1`,
+		`debcache_cache_requests_total{namespace="releases",repo="metrics-debian",result="miss"} 2`,
+		`debcache_http_response_bytes_total{repo="metrics-local"} `,
+		`debcache_upstream_request_duration_seconds_count{repo="metrics-debian"} 2`,
+		`debcache_upstream_errors_total{repo="metrics-debian",status="500"} 1`,
+		`debcache_dynamic_renders_total{repo="metrics-local",result="rendered"} 1`,
+		`debcache_storage_bytes{repo="metrics-debian"} 7`,
+	} {
+		assert.Contains(t, body, expected)
+	}
+}
+
+func TestHandler_Stale(t *testing.T) {
+	t.Parallel()
+
+	var status atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s := status.Load(); s != 0 {
+			w.WriteHeader(int(s))
+			return
+		}
+		_, _ = w.Write([]byte("release"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	h := testHandler(t, map[string]server.RepoConfig{
+		"debian": {Type: "file-cache", Config: map[string]any{
+			"path":         t.TempDir(),
+			"ttl":          "1ms",
+			"staleIfError": "1h",
+			"source":       map[string]any{"type": "upstream", "url": upstream.URL},
+		}},
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debian/dists/bookworm/InRelease", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Warning"))
+
+	time.Sleep(5 * time.Millisecond)
+	status.Store(http.StatusBadGateway)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debian/dists/bookworm/InRelease", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `110 - "Response is Stale"`, rec.Header().Get("Warning"))
+	assert.Equal(t, "release", rec.Body.String())
+}
+
+func testHandler(tb testing.TB, repos map[string]server.RepoConfig) *server.Handler {
+	tb.Helper()
+	h, err := server.NewHandler(context.Background(), &server.Config{Repos: repos})
+	require.NoError(tb, err)
+	return h
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/thepwagner/debcache/pkg/repo"
+)
+
+// KeyASC writes the repo's signing keys in PEM format, for /etc/apt/keyrings/*.asc.
+func (h Handler) KeyASC(w http.ResponseWriter, r *http.Request) {
+	signingKey, ok := h.signingKey(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/pgp-keys")
+	_, _ = w.Write(signingKey)
+}
+
+// KeyGPG writes the repo's signing keys as a binary keyring, for /etc/apt/keyrings/*.gpg.
+func (h Handler) KeyGPG(w http.ResponseWriter, r *http.Request) {
+	signingKey, ok := h.signingKey(w, r)
+	if !ok {
+		return
+	}
+	block, err := armor.Decode(bytes.NewReader(signingKey))
+	if err != nil {
+		writeError(w, r, "armor.Decode", err)
+		return
+	}
+	keyring, err := io.ReadAll(block.Body)
+	if err != nil {
+		writeError(w, r, "armor.Decode", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(keyring)
+}
+
+func (h Handler) signingKey(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	repoName := chi.URLParam(r, "repo")
+	slog.Info("handling Key",
+		slog.String("request_id", middleware.GetReqID(r.Context())),
+		slog.String("repo", repoName),
+	)
+
+	rep, ok := h.repos[repoName]
+	if !ok {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	signingKey, err := rep.SigningKeyPEM()
+	if err != nil {
+		writeError(w, r, "repo.SigningKeyPEM", err)
+		return nil, false
+	}
+	if len(signingKey) == 0 {
+		writeError(w, r, "repo.SigningKeyPEM", fmt.Errorf("%w: %q has no signing key", repo.ErrNotFound, repoName))
+		return nil, false
+	}
+	return signingKey, true
+}
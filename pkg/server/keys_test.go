@@ -0,0 +1,62 @@
+package server_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/debcache/pkg/server"
+)
+
+func TestHandler_Key(t *testing.T) {
+	t.Parallel()
+
+	h := testHandler(t, map[string]server.RepoConfig{
+		"local": {Type: "dynamic", Config: map[string]any{
+			"signingKeyPath": "../dynamic/testdata/key.asc",
+			"files":          map[string]any{"dir": "../debian/testdata"},
+		}},
+		"debian": {Type: "upstream", Config: map[string]any{
+			"url":     "https://deb.debian.org/debian",
+			"keyring": "../dynamic/testdata/key.asc",
+		}},
+		"unsigned": {Type: "upstream", Config: map[string]any{"url": "https://deb.debian.org/debian"}},
+	})
+
+	for _, repoName := range []string{"local", "debian"} {
+		repoName := repoName
+		t.Run(repoName, func(t *testing.T) {
+			t.Parallel()
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+repoName+"/key.asc", nil))
+			require.Equal(t, http.StatusOK, rec.Code)
+			armored, err := openpgp.ReadArmoredKeyRing(rec.Body)
+			require.NoError(t, err)
+			require.Len(t, armored, 1)
+			assert.Nil(t, armored[0].PrivateKey)
+
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+repoName+"/key.gpg", nil))
+			require.Equal(t, http.StatusOK, rec.Code)
+			binary, err := openpgp.ReadKeyRing(bytes.NewReader(rec.Body.Bytes()))
+			require.NoError(t, err)
+			require.Len(t, binary, 1)
+			assert.Equal(t, armored[0].PrimaryKey.Fingerprint, binary[0].PrimaryKey.Fingerprint)
+		})
+	}
+
+	for _, path := range []string{"/unsigned/key.asc", "/unsigned/key.gpg"} {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			t.Parallel()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+		})
+	}
+}
@@ -17,7 +17,7 @@ func Logger(next http.Handler) http.Handler {
 		t1 := time.Now()
 		defer func() {
 			level := slog.LevelInfo
-			if ww.Status() != http.StatusOK {
+			if ww.Status() >= http.StatusBadRequest {
 				level = slog.LevelWarn
 			}
 
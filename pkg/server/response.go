@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/thepwagner/debcache/pkg/repo"
+)
+
+// writeError responds with the HTTP status matching err.
+func writeError(w http.ResponseWriter, r *http.Request, op string, err error) {
+	status := errorStatus(err)
+	level := slog.LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	slog.Log(r.Context(), level, op,
+		slog.String("request_id", middleware.GetReqID(r.Context())),
+		slog.Int("status", status),
+		slog.String("error", err.Error()),
+	)
+	http.Error(w, err.Error(), status)
+}
+
+func errorStatus(err error) int {
+	var upstreamErr *repo.UpstreamError
+	switch {
+	case errors.Is(err, repo.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, repo.ErrBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, repo.ErrVerificationFailed):
+		return http.StatusForbidden
+	case errors.As(err, &upstreamErr):
+		if upstreamErr.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return http.StatusRequestedRangeNotSatisfiable
+		}
+		// No response, or upstream is explicitly unavailable:
+		if upstreamErr.StatusCode == 0 || upstreamErr.StatusCode == http.StatusServiceUnavailable {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusBadGateway
+	case errors.Is(err, repo.ErrUpstreamUnavailable):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// serveBody streams a Body to the client, unless the client's copy is current.
+// Seekable bodies support range requests, other bodies are only partial if the Repo handled the range request.
+func serveBody(w http.ResponseWriter, r *http.Request, body *repo.Body) {
+	defer body.Close()
+	if body.ETag != "" {
+		w.Header().Set("ETag", body.ETag)
+	}
+	if body.Stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	// Repository files are binary, don't let the response be sniffed from its first bytes:
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if seeker, ok := body.ReadCloser.(io.ReadSeeker); ok && body.Partial == nil {
+		w.Header().Set("Accept-Ranges", "bytes")
+		http.ServeContent(w, r, "", body.ModTime, seeker)
+		return
+	}
+
+	if !body.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", body.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, body) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if body.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(body.Size, 10))
+	}
+	if body.Partial != nil {
+		if body.Partial.ContentRange != "" {
+			w.Header().Set("Content-Range", body.Partial.ContentRange)
+		}
+		if body.Partial.ContentType != "" {
+			w.Header().Set("Content-Type", body.Partial.ContentType)
+		}
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		slog.Warn("error writing response", slog.String("error", err.Error()))
+		// The status was sent, so the client must see the connection fail instead of a complete response:
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// byteRanges passes range requests to the Repo, in case it can serve partial content without the whole file.
+func byteRanges(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rng := r.Header.Get("Range"); rng != "" {
+			ctx := repo.WithByteRange(r.Context(), repo.ByteRange{Range: rng, IfRange: r.Header.Get("If-Range")})
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headRequests tells the Repo that HEAD requests don't read the Body.
+func headRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			r = r.WithContext(repo.WithHead(r.Context()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// notModified evaluates the request's conditional headers against the Body.
+// If-None-Match takes precedence over If-Modified-Since, as per RFC 9110.
+func notModified(r *http.Request, body *repo.Body) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return body.ETag != "" && etagMatch(inm, body.ETag)
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || body.ModTime.IsZero() {
+		return false
+	}
+	return !body.ModTime.Truncate(time.Second).After(ims)
+}
+
+// etagMatch performs a weak comparison of etag against an If-None-Match header.
+func etagMatch(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -28,6 +28,17 @@ func Run(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+
+	if admin := handler.Admin(); admin != nil && cfg.Admin.Addr != "" {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- runHandler(ctx, cfg.Admin.Addr, admin)
+		}()
+		if err := runHandler(ctx, cfg.Addr, handler); err != nil {
+			return err
+		}
+		return <-errs
+	}
 	return runHandler(ctx, cfg.Addr, handler)
 }
 
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/thepwagner/debcache/pkg/debian"
+	"github.com/thepwagner/debcache/pkg/repo"
+)
+
+// AptConfig describes how apt clients should use a repo, for generated sources.
+type AptConfig struct {
+	// Types are the kinds of archives to use, e.g. "deb" and "deb-src". Defaults to "deb".
+	Types []string `yaml:"types"`
+	// Suites that clients may select with the suite query parameter, the first is the default.
+	Suites        []string `yaml:"suites"`
+	Components    []string `yaml:"components"`
+	Architectures []string `yaml:"architectures"`
+	// URL is the public URL of the repo, e.g. when behind a TLS reverse proxy. Defaults to the requested URL.
+	URL string `yaml:"url"`
+	// Proxy is the proxy clients should use to reach the repo in apt.conf. Defaults to "DIRECT".
+	Proxy string `yaml:"proxy"`
+}
+
+// debianArchiveKeyring verifies upstream Debian repositories, which are not signed by debcache.
+const debianArchiveKeyring = "/usr/share/keyrings/debian-archive-keyring.gpg"
+
+func (c AptConfig) types() []string {
+	if len(c.Types) == 0 {
+		return []string{"deb"}
+	}
+	return c.Types
+}
+
+func (c AptConfig) suites(repoName string) []string {
+	if len(c.Suites) > 0 {
+		return c.Suites
+	}
+	if strings.Contains(repoName, "-security") {
+		return []string{"bookworm-security"}
+	}
+	return []string{"bookworm"}
+}
+
+func (c AptConfig) components() []string {
+	if len(c.Components) == 0 {
+		return []string{"main"}
+	}
+	return c.Components
+}
+
+// url returns the public URL of the repo.
+func (c AptConfig) url(r *http.Request, repoName string) (*url.URL, error) {
+	if c.URL != "" {
+		return url.Parse(c.URL)
+	}
+	u := &url.URL{Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	return u.JoinPath(repoName), nil
+}
+
+// RepoSource writes an apt source for the repo.
+// Suites are selected by the suite query parameter, and format=list writes the one-line sources.list format instead of deb822.
+func (h Handler) RepoSource(w http.ResponseWriter, r *http.Request) {
+	repoName := chi.URLParam(r, "repo")
+	slog.Info("handling RepoSource",
+		slog.String("request_id", middleware.GetReqID(r.Context())),
+		slog.String("repo", repoName),
+	)
+
+	rep, ok := h.repos[repoName]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	cfg := h.apt[repoName]
+
+	suites := cfg.suites(repoName)
+	if selected := r.URL.Query()["suite"]; len(selected) > 0 {
+		for _, suite := range selected {
+			if !slices.Contains(suites, suite) {
+				writeError(w, r, "RepoSource", fmt.Errorf("%w: unknown suite %q", repo.ErrBadRequest, suite))
+				return
+			}
+		}
+		suites = selected
+	} else {
+		suites = suites[:1]
+	}
+
+	u, err := cfg.url(r, repoName)
+	if err != nil {
+		writeError(w, r, "RepoSource", err)
+		return
+	}
+
+	signingKey, err := rep.SigningKeyPEM()
+	if err != nil {
+		writeError(w, r, "repo.SigningKeyPEM", err)
+		return
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "deb822":
+		writeDeb822Source(w, cfg, u, suites, signingKey)
+	case "list":
+		writeListSource(w, cfg, u, repoName, suites, signingKey)
+	default:
+		writeError(w, r, "RepoSource", fmt.Errorf("%w: unknown format %q", repo.ErrBadRequest, format))
+	}
+}
+
+func writeDeb822Source(w http.ResponseWriter, cfg AptConfig, u *url.URL, suites []string, signingKey []byte) {
+	signedBy := debianArchiveKeyring
+	if len(signingKey) > 0 {
+		// Blank lines would end the paragraph, so they are written as ".":
+		lines := strings.Split(strings.TrimSpace(string(signingKey)), "\n")
+		for i, line := range lines {
+			if strings.TrimSpace(line) == "" {
+				lines[i] = "."
+			}
+		}
+		signedBy = strings.Join(lines, "\n")
+	}
+
+	src := debian.Paragraph{
+		"Types":         strings.Join(cfg.types(), " "),
+		"URIs":          u.String(),
+		"Suites":        strings.Join(suites, " "),
+		"Components":    strings.Join(cfg.components(), " "),
+		"Architectures": strings.Join(cfg.Architectures, " "),
+		"Signed-By":     signedBy,
+	}
+	_ = debian.WriteControlFile(w, src)
+}
+
+func writeListSource(w http.ResponseWriter, cfg AptConfig, u *url.URL, repoName string, suites []string, signingKey []byte) {
+	// The one-line format cannot embed keys, so the key must be saved alongside:
+	signedBy := debianArchiveKeyring
+	if len(signingKey) > 0 {
+		signedBy = fmt.Sprintf("/etc/apt/keyrings/debcache-%s.asc", repoName)
+		_, _ = fmt.Fprintf(w, "# Save the signing key from %s to %s\n", u.JoinPath("key.asc"), signedBy)
+	}
+
+	options := []string{"signed-by=" + signedBy}
+	if len(cfg.Architectures) > 0 {
+		options = append([]string{"arch=" + strings.Join(cfg.Architectures, ",")}, options...)
+	}
+	for _, typ := range cfg.types() {
+		for _, suite := range suites {
+			_, _ = fmt.Fprintf(w, "%s [%s] %s %s %s\n", typ, strings.Join(options, " "), u, suite, strings.Join(cfg.components(), " "))
+		}
+	}
+}
+
+// AptConf writes an apt.conf snippet, configuring the proxy for the repo's host.
+func (h Handler) AptConf(w http.ResponseWriter, r *http.Request) {
+	repoName := chi.URLParam(r, "repo")
+	slog.Info("handling AptConf",
+		slog.String("request_id", middleware.GetReqID(r.Context())),
+		slog.String("repo", repoName),
+	)
+
+	cfg := h.apt[repoName]
+	u, err := cfg.url(r, repoName)
+	if err != nil {
+		writeError(w, r, "AptConf", err)
+		return
+	}
+	proxy := cfg.Proxy
+	if proxy == "" {
+		proxy = "DIRECT"
+	}
+	_, _ = fmt.Fprintf(w, "Acquire::%s::Proxy::%s %q;\n", u.Scheme, u.Hostname(), proxy)
+}
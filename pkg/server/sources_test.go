@@ -0,0 +1,149 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thepwagner/debcache/pkg/debian"
+	"github.com/thepwagner/debcache/pkg/server"
+)
+
+func TestHandler_RepoSource(t *testing.T) {
+	t.Parallel()
+
+	h := testHandler(t, map[string]server.RepoConfig{
+		"debian": {Type: "upstream", Config: map[string]any{"url": "https://deb.debian.org/debian"}},
+		"configured": {
+			Type: "upstream",
+			Apt: server.AptConfig{
+				Types:         []string{"deb", "deb-src"},
+				Suites:        []string{"bookworm", "bookworm-updates"},
+				Components:    []string{"main", "contrib"},
+				Architectures: []string{"amd64", "arm64"},
+				URL:           "https://apt.example.com/configured",
+			},
+			Config: map[string]any{"url": "https://deb.debian.org/debian"},
+		},
+		"local": {Type: "dynamic", Config: map[string]any{
+			"signingKeyPath": "../dynamic/testdata/key.asc",
+			"files":          map[string]any{"dir": "../debian/testdata"},
+		}},
+	})
+
+	cases := map[string]debian.Paragraph{
+		"/debian/repo.source": {
+			"Types":      "deb",
+			"URIs":       "http://example.com/debian",
+			"Suites":     "bookworm",
+			"Components": "main",
+			"Signed-By":  "/usr/share/keyrings/debian-archive-keyring.gpg",
+		},
+		"/configured/repo.source": {
+			"Types":         "deb deb-src",
+			"URIs":          "https://apt.example.com/configured",
+			"Suites":        "bookworm",
+			"Components":    "main contrib",
+			"Architectures": "amd64 arm64",
+			"Signed-By":     "/usr/share/keyrings/debian-archive-keyring.gpg",
+		},
+		"/configured/repo.source?suite=bookworm-updates&suite=bookworm": {
+			"Types":         "deb deb-src",
+			"URIs":          "https://apt.example.com/configured",
+			"Suites":        "bookworm-updates bookworm",
+			"Components":    "main contrib",
+			"Architectures": "amd64 arm64",
+			"Signed-By":     "/usr/share/keyrings/debian-archive-keyring.gpg",
+		},
+	}
+	for path, expected := range cases {
+		path, expected := path, expected
+		t.Run(path, func(t *testing.T) {
+			t.Parallel()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			graphs, err := debian.ParseControlFile(rec.Body)
+			require.NoError(t, err)
+			require.Len(t, graphs, 1)
+			assert.Equal(t, expected, graphs[0])
+		})
+	}
+
+	t.Run("signed", func(t *testing.T) {
+		t.Parallel()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/local/repo.source", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		graphs, err := debian.ParseControlFile(rec.Body)
+		require.NoError(t, err)
+		require.Len(t, graphs, 1)
+		assert.Contains(t, graphs[0]["Signed-By"], "-----BEGIN PGP PUBLIC KEY BLOCK-----")
+		assert.Contains(t, graphs[0]["Signed-By"], "-----END PGP PUBLIC KEY BLOCK-----")
+	})
+
+	t.Run("list", func(t *testing.T) {
+		t.Parallel()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/configured/repo.source?format=list&suite=bookworm-updates", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "deb [arch=amd64,arm64 signed-by=/usr/share/keyrings/debian-archive-keyring.gpg] https://apt.example.com/configured bookworm-updates main contrib\n"+
+			"deb-src [arch=amd64,arm64 signed-by=/usr/share/keyrings/debian-archive-keyring.gpg] https://apt.example.com/configured bookworm-updates main contrib\n",
+			rec.Body.String())
+	})
+
+	t.Run("signed list", func(t *testing.T) {
+		t.Parallel()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/local/repo.source?format=list", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "# Save the signing key from http://example.com/local/key.asc to /etc/apt/keyrings/debcache-local.asc\n"+
+			"deb [signed-by=/etc/apt/keyrings/debcache-local.asc] http://example.com/local bookworm main\n",
+			rec.Body.String())
+	})
+
+	for _, path := range []string{
+		"/configured/repo.source?suite=sid",
+		"/debian/repo.source?format=yaml",
+	} {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			t.Parallel()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		})
+	}
+}
+
+func TestHandler_AptConf(t *testing.T) {
+	t.Parallel()
+
+	h := testHandler(t, map[string]server.RepoConfig{
+		"debian": {Type: "upstream", Config: map[string]any{"url": "https://deb.debian.org/debian"}},
+		"proxied": {
+			Type:   "upstream",
+			Apt:    server.AptConfig{URL: "https://apt.example.com/proxied", Proxy: "http://proxy.example.com:3128"},
+			Config: map[string]any{"url": "https://deb.debian.org/debian"},
+		},
+	})
+
+	cases := map[string]string{
+		"/debian/apt.conf":  "Acquire::http::Proxy::example.com \"DIRECT\";\n",
+		"/proxied/apt.conf": "Acquire::https::Proxy::apt.example.com \"http://proxy.example.com:3128\";\n",
+	}
+	for path, expected := range cases {
+		path, expected := path, expected
+		t.Run(path, func(t *testing.T) {
+			t.Parallel()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			require.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, expected, rec.Body.String())
+		})
+	}
+}